@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// POST /records/batch makes a list of changes to the user's records all at
+// once: either all of them happen, with one serial bump, or none do.
+//
+//	{"operations": [
+//	  {"op": "reset"},
+//	  {"op": "create", "record": {"Hdr": {...}, "A": "192.0.2.1", "weight": 2}},
+//	  {"op": "update", "id": 12, "record": {...}},
+//	  {"op": "delete", "id": 13}
+//	]}
+//
+// The records are what /record/new takes. The response has a result for each
+// operation, in the same order.
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+	// ChangeReset deletes all of the user's records
+	ChangeReset = "reset"
+	// ChangeCheckZoneSerial fails the batch unless the zone's serial (see
+	// GetZoneSerial) is still Serial. It isn't something the batch API takes.
+	ChangeCheckZoneSerial = "check-zone-serial"
+)
+
+// more than anyone needs to set up a zone
+const maxBatchOperations = 100
+
+// RecordChange is one operation in a batch
+type RecordChange struct {
+	Op      string
+	ID      int
+	Record  dns.RR
+	Options RecordOptions
+	Serial  uint32
+}
+
+// changeError says which change in a batch failed
+type changeError struct {
+	Index int
+	Err   error
+}
+
+func (e *changeError) Error() string {
+	return fmt.Sprintf("operation %d: %s", e.Index, e.Err.Error())
+}
+
+func (e *changeError) Unwrap() error {
+	return e.Err
+}
+
+type batchOperation struct {
+	Op     string          `json:"op"`
+	ID     int             `json:"id"`
+	Record json.RawMessage `json:"record"`
+}
+
+type batchResult struct {
+	Op    string `json:"op"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// parseBatch checks every operation before any of them are applied
+func parseBatch(r *http.Request, store RecordStore, username string, operations []batchOperation) ([]RecordChange, []batchResult, bool) {
+	changes := make([]RecordChange, len(operations))
+	results := make([]batchResult, len(operations))
+	valid := true
+	for i, operation := range operations {
+		results[i] = batchResult{Op: operation.Op, ID: operation.ID}
+		change, err := parseChange(r, store, username, operation)
+		if err != nil {
+			results[i].Error = err.Error()
+			valid = false
+		}
+		changes[i] = change
+	}
+	return changes, results, valid
+}
+
+func parseChange(r *http.Request, store RecordStore, username string, operation batchOperation) (RecordChange, error) {
+	change := RecordChange{Op: operation.Op, ID: operation.ID}
+	switch operation.Op {
+	case ChangeCreate, ChangeUpdate:
+		if operation.Op == ChangeUpdate && operation.ID <= 0 {
+			return change, fmt.Errorf("update needs an id")
+		}
+		if len(operation.Record) == 0 {
+			return change, fmt.Errorf("%s needs a record", operation.Op)
+		}
+		rr, err := ParseRecord(operation.Record)
+		if err != nil {
+			return change, fmt.Errorf("error parsing record: %s", err.Error())
+		}
+		if err = validateRecordName(r.Context(), store, rr, username); err != nil {
+			return change, err
+		}
+		options, err := ParseRecordOptions(operation.Record)
+		if err != nil {
+			return change, err
+		}
+		change.Record = rr
+		change.Options = options
+	case ChangeDelete:
+		if operation.ID <= 0 {
+			return change, fmt.Errorf("delete needs an id")
+		}
+	case ChangeReset:
+	default:
+		return change, fmt.Errorf("unknown operation %q", operation.Op)
+	}
+	return change, nil
+}
+
+func batchRecords(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error reading body: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	var batch struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing batch: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Operations) > maxBatchOperations {
+		returnError(
+			w,
+			fmt.Errorf("a batch can have at most %d operations", maxBatchOperations),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	changes, results, valid := parseBatch(r, store, username, batch.Operations)
+	if !valid {
+		writeBatchResults(w, results, http.StatusBadRequest)
+		return
+	}
+	ids, err := store.ApplyRecordChanges(r.Context(), username, changes)
+	var failed *changeError
+	if errors.As(err, &failed) {
+		results[failed.Index].Error = failed.Err.Error()
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotFound) {
+			status = http.StatusNotFound
+		}
+		if lw, ok := w.(*loggingWriter); ok {
+			lw.err = err
+		}
+		writeBatchResults(w, results, status)
+		return
+	}
+	if err != nil {
+		returnError(w, fmt.Errorf("error applying batch: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	for i, id := range ids {
+		results[i].ID = id
+	}
+	writeBatchResults(w, results, http.StatusOK)
+}
+
+func writeBatchResults(w http.ResponseWriter, results []batchResult, status int) {
+	jsonOutput, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		returnError(w, fmt.Errorf("error marshalling json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonOutput)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreApplyRecordChanges(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ids, err := store.ApplyRecordChanges(ctx, "store", []RecordChange{
+				{Op: ChangeCreate, Record: makeA("www.store.flatbo.at.", "192.0.2.1"), Options: defaultOptions()},
+				{Op: ChangeCreate, Record: makeA("api.store.flatbo.at.", "192.0.2.2"), Options: defaultOptions()},
+			})
+			assert.Nil(t, err)
+			assert.Len(t, ids, 2)
+			serial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(11), serial)
+
+			// the delete fails, so the update doesn't happen either
+			_, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{
+				{Op: ChangeUpdate, ID: ids[0], Record: makeA("www.store.flatbo.at.", "192.0.2.3"), Options: defaultOptions()},
+				{Op: ChangeDelete, ID: 12345},
+			})
+			var failed *changeError
+			assert.ErrorAs(t, err, &failed)
+			assert.Equal(t, 1, failed.Index)
+			assert.ErrorIs(t, err, errNotFound)
+			records, err := store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, "192.0.2.1", records[ids[0]].RR.(*dns.A).A.String())
+			serial, err = store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(11), serial)
+
+			ids, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{
+				{Op: ChangeReset},
+				{Op: ChangeCreate, Record: makeA("new.store.flatbo.at.", "192.0.2.4"), Options: defaultOptions()},
+			})
+			assert.Nil(t, err)
+			records, err = store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, records, 1)
+			assert.Equal(t, "new.store.flatbo.at.", records[ids[1]].RR.Header().Name)
+			serial, err = store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(12), serial)
+		})
+	}
+}
+
+func TestBatchRecords(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	assert.Nil(t, store.InsertSubdomain(ctx, "bob"))
+	assert.Nil(t, store.InsertRecord(ctx, "bob", makeA("www.bob.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	records, err := store.GetRecordsForName(ctx, "bob")
+	assert.Nil(t, err)
+	var bobs string
+	for id := range records {
+		bobs = strconv.Itoa(id)
+	}
+	post := func(body string) (int, []batchResult) {
+		w := httptest.NewRecorder()
+		batchRecords(store, "alice", w, httptest.NewRequest("POST", "/records/batch", strings.NewReader(body)))
+		var response struct {
+			Results []batchResult `json:"results"`
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response.Results
+	}
+	www := `{"Hdr":{"Name":"www.alice.flatbo.at.","Rrtype":1,"Class":1,"Ttl":300},"A":"192.0.2.1"}`
+
+	// everything is checked before anything happens
+	status, results := post(`{"operations": [
+		{"op": "create", "record": ` + www + `},
+		{"op": "create", "record": {"Hdr":{"Name":"www.bob.flatbo.at.","Rrtype":1,"Class":1,"Ttl":300},"A":"192.0.2.1"}},
+		{"op": "rename"}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "", results[0].Error)
+	assert.Contains(t, results[1].Error, "subdomain must be 'alice'")
+	assert.Contains(t, results[2].Error, "unknown operation")
+	count, err := store.CountRecords(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// bob's records are as good as missing
+	status, results = post(`{"operations": [
+		{"op": "create", "record": ` + www + `},
+		{"op": "delete", "id": ` + bobs + `}
+	]}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "record not found", results[1].Error)
+	count, err = store.CountRecords(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	status, results = post(`{"operations": [{"op": "reset"}, {"op": "create", "record": ` + www + `}]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, 0, results[1].ID)
+	records, err = store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Contains(t, records, results[1].ID)
+}
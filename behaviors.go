@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Behaviors are records whose answer is worked out when the query comes in,
+// instead of being stored. They're here to make resolver caching and
+// forwarding visible.
+const (
+	// TXT with the resolver's IP and ASN, and the client subnet if we got one
+	BehaviorWhoami = "whoami"
+	// TXT with the current time
+	BehaviorTimestamp = "timestamp"
+	// TXT with how many times this name has been queried
+	BehaviorCounter = "counter"
+	// A/AAAA that alternates between two IPs, to demonstrate DNS rebinding
+	BehaviorRebind = "rebind"
+)
+
+const defaultBehaviorTTL = 60
+
+type Behavior struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	TTL  uint32 `json:"ttl"`
+	// the two IPs a rebind record alternates between
+	IPs []string `json:"ips,omitempty"`
+}
+
+type behaviorCount struct {
+	n        uint64
+	lastUsed time.Time
+}
+
+// counts are per instance, which is fine for showing off caching
+var behaviorCounts = struct {
+	sync.Mutex
+	m map[int]*behaviorCount
+}{m: make(map[int]*behaviorCount)}
+
+func nextCount(id int) uint64 {
+	behaviorCounts.Lock()
+	defer behaviorCounts.Unlock()
+	count, ok := behaviorCounts.m[id]
+	if !ok {
+		count = &behaviorCount{}
+		behaviorCounts.m[id] = count
+	}
+	count.n++
+	count.lastUsed = time.Now()
+	return count.n
+}
+
+// lastCount is the count of the latest answer, or of the first one if there
+// hasn't been one yet
+func lastCount(id int) uint64 {
+	behaviorCounts.Lock()
+	defer behaviorCounts.Unlock()
+	if count, ok := behaviorCounts.m[id]; ok {
+		return count.n
+	}
+	return 1
+}
+
+// forgetOldCounts drops the counts that haven't been used since cutoff.
+// Behaviors are deleted once they're older than that, so it's only the
+// counts of behaviors that are gone.
+func forgetOldCounts(cutoff time.Time) {
+	behaviorCounts.Lock()
+	defer behaviorCounts.Unlock()
+	for id, count := range behaviorCounts.m {
+		if count.lastUsed.Before(cutoff) {
+			delete(behaviorCounts.m, id)
+		}
+	}
+}
+
+func validateBehavior(behavior *Behavior) error {
+	switch behavior.Kind {
+	case BehaviorWhoami, BehaviorTimestamp, BehaviorCounter:
+		if len(behavior.IPs) > 0 {
+			return fmt.Errorf("only rebind behaviors take IPs")
+		}
+	case BehaviorRebind:
+		if len(behavior.IPs) != 2 {
+			return fmt.Errorf("rebind behaviors need exactly 2 IPs")
+		}
+		first := net.ParseIP(behavior.IPs[0])
+		second := net.ParseIP(behavior.IPs[1])
+		if first == nil || second == nil {
+			return fmt.Errorf("invalid IP in rebind behavior")
+		}
+		if (first.To4() == nil) != (second.To4() == nil) {
+			return fmt.Errorf("rebind IPs must both be IPv4 or both be IPv6")
+		}
+	default:
+		return fmt.Errorf("unknown behavior '%s'", behavior.Kind)
+	}
+	return nil
+}
+
+// rrtype is the type of record a behavior answers with
+func (behavior Behavior) rrtype() uint16 {
+	if behavior.Kind != BehaviorRebind {
+		return dns.TypeTXT
+	}
+	if net.ParseIP(behavior.IPs[0]).To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+func (behavior Behavior) Records(qtype uint16, client *Client) []dns.RR {
+	return behavior.records(qtype, client, nextCount)
+}
+
+// Peek is Records without counting it as a query, for lookups we only make
+// to fill in the answer to another one
+func (behavior Behavior) Peek(qtype uint16, client *Client) []dns.RR {
+	return behavior.records(qtype, client, lastCount)
+}
+
+func (behavior Behavior) records(qtype uint16, client *Client, count func(id int) uint64) []dns.RR {
+	rrtype := behavior.rrtype()
+	if qtype != rrtype && qtype != dns.TypeANY {
+		return nil
+	}
+	hdr := dns.RR_Header{
+		Name:   behavior.Name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    behavior.TTL,
+	}
+	switch behavior.Kind {
+	case BehaviorWhoami:
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: whoami(client)}}
+	case BehaviorTimestamp:
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{now}}}
+	case BehaviorCounter:
+		n := fmt.Sprintf("%d", count(behavior.ID))
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{n}}}
+	case BehaviorRebind:
+		ip := net.ParseIP(behavior.IPs[(count(behavior.ID)-1)%2])
+		if rrtype == dns.TypeA {
+			return []dns.RR{&dns.A{Hdr: hdr, A: ip.To4()}}
+		}
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return nil
+}
+
+func whoami(client *Client) []string {
+	txt := []string{"resolver=" + client.Resolver.String()}
+	if client.ResolverASN != nil {
+		txt = append(txt, fmt.Sprintf(
+			"resolver-asn=AS%d %s (%s)",
+			client.ResolverASN.Num,
+			client.ResolverASN.Name,
+			client.ResolverASN.Country,
+		))
+	}
+	if client.Subnet != nil && client.Subnet.SourceNetmask > 0 {
+		// the answer depends on the subnet now, so scope it to that
+		client.Locate()
+		txt = append(txt, "client-subnet="+client.Subnet.String())
+		if client.Subnet.ASN != 0 {
+			txt = append(txt, fmt.Sprintf(
+				"client-asn=AS%d %s (%s)",
+				client.Subnet.ASN,
+				client.Subnet.ASName,
+				client.Subnet.Country,
+			))
+		}
+	}
+	return txt
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	behavior := Behavior{
+		ID:   2001,
+		Name: "rebind.test.flatbo.at.",
+		Kind: BehaviorRebind,
+		IPs:  []string{"192.0.2.1", "127.0.0.1"},
+	}
+	assert.Nil(t, validateBehavior(&behavior))
+	client := makeClient()
+	first := behavior.Records(dns.TypeA, client)[0].(*dns.A)
+	second := behavior.Records(dns.TypeA, client)[0].(*dns.A)
+	third := behavior.Records(dns.TypeA, client)[0].(*dns.A)
+	assert.Equal(t, "192.0.2.1", first.A.String())
+	assert.Equal(t, "127.0.0.1", second.A.String())
+	assert.Equal(t, "192.0.2.1", third.A.String())
+
+	assert.Nil(t, behavior.Records(dns.TypeAAAA, client))
+}
+
+func TestCounter(t *testing.T) {
+	behavior := Behavior{ID: 2002, Name: "count.test.flatbo.at.", Kind: BehaviorCounter}
+	client := makeClient()
+	assert.Equal(t, []string{"1"}, behavior.Records(dns.TypeTXT, client)[0].(*dns.TXT).Txt)
+	assert.Equal(t, []string{"2"}, behavior.Records(dns.TypeTXT, client)[0].(*dns.TXT).Txt)
+	assert.Equal(t, []string{"2"}, behavior.Peek(dns.TypeTXT, client)[0].(*dns.TXT).Txt)
+
+	forgetOldCounts(time.Now().Add(-time.Hour))
+	assert.Equal(t, []string{"3"}, behavior.Records(dns.TypeTXT, client)[0].(*dns.TXT).Txt)
+	forgetOldCounts(time.Now().Add(time.Hour))
+	assert.Equal(t, []string{"1"}, behavior.Records(dns.TypeTXT, client)[0].(*dns.TXT).Txt)
+}
+
+func TestWhoamiScope(t *testing.T) {
+	request := makeECSQuestion("whoami.test.flatbo.at.", "192.0.2.0", 24)
+	client := newClient(request, makeClient().Resolver, nil)
+	behavior := Behavior{Name: "whoami.test.flatbo.at.", Kind: BehaviorWhoami}
+	txt := behavior.Records(dns.TypeTXT, client)[0].(*dns.TXT).Txt
+	assert.Equal(t, []string{"resolver=127.0.0.1", "client-subnet=192.0.2.0/24"}, txt)
+	assert.Equal(t, uint8(24), client.scope)
+}
+
+func TestValidateBehavior(t *testing.T) {
+	assert.NotNil(t, validateBehavior(&Behavior{Kind: "teleport"}))
+	assert.NotNil(t, validateBehavior(&Behavior{Kind: BehaviorRebind, IPs: []string{"192.0.2.1"}}))
+	assert.NotNil(t, validateBehavior(&Behavior{Kind: BehaviorRebind, IPs: []string{"192.0.2.1", "::1"}}))
+	assert.NotNil(t, validateBehavior(&Behavior{Kind: BehaviorWhoami, IPs: []string{"192.0.2.1"}}))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Identity is how this instance identifies itself in CHAOS queries, in NSID
+// (RFC 5001) and in the request log, so we can tell which of the instances
+// behind anycast answered.
+type Identity struct {
+	Hostname string `json:"hostname"`
+	ID       string `json:"id"`
+	// left empty, version.bind is refused
+	Version string `json:"version"`
+	NSID    string `json:"nsid"`
+}
+
+var identity = Identity{}
+
+// withDefaults fills in whatever wasn't configured: the ID defaults to the
+// hostname and the NSID to the ID
+func (identity Identity) withDefaults() Identity {
+	if identity.Hostname == "" {
+		identity.Hostname, _ = os.Hostname()
+	}
+	if identity.ID == "" {
+		identity.ID = identity.Hostname
+	}
+	if identity.NSID == "" {
+		identity.NSID = identity.ID
+	}
+	return identity
+}
+
+func chaosTXT(name string) string {
+	switch strings.ToLower(name) {
+	case "version.bind.", "version.server.":
+		return identity.Version
+	case "hostname.bind.":
+		return identity.Hostname
+	case "id.server.":
+		return identity.ID
+	}
+	return ""
+}
+
+func chaosResponse(request *dns.Msg) *dns.Msg {
+	question := request.Question[0]
+	txt := chaosTXT(question.Name)
+	if txt == "" || (question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY) {
+		return refusedResponse(request)
+	}
+	msg := dns.Msg{Compress: true}
+	msg.SetReply(request)
+	msg.Authoritative = true
+	msg.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: []string{txt},
+	}}
+	return &msg
+}
+
+func wantsNSID(request *dns.Msg) bool {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_NSID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func nsidOption() *dns.EDNS0_NSID {
+	return &dns.EDNS0_NSID{
+		Code: dns.EDNS0NSID,
+		Nsid: hex.EncodeToString([]byte(identity.NSID)),
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeChaosQuestion(name string) *dns.Msg {
+	msg := makeQuestion(name, dns.TypeTXT)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	return msg
+}
+
+func TestChaos(t *testing.T) {
+	identity = Identity{Hostname: "dns-1.example", ID: "fra-1", NSID: "fra-1"}
+	defer func() { identity = Identity{} }()
+
+	response := dnsResponse(context.Background(), nil, makeChaosQuestion("hostname.bind."), makeClient())
+	assert.Equal(t, dns.RcodeSuccess, response.Rcode)
+	assert.Equal(t, []string{"dns-1.example"}, response.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, uint16(dns.ClassCHAOS), response.Answer[0].Header().Class)
+
+	response = dnsResponse(context.Background(), nil, makeChaosQuestion("id.server."), makeClient())
+	assert.Equal(t, []string{"fra-1"}, response.Answer[0].(*dns.TXT).Txt)
+
+	// no version configured
+	response = dnsResponse(context.Background(), nil, makeChaosQuestion("version.bind."), makeClient())
+	assert.Equal(t, dns.RcodeRefused, response.Rcode)
+}
+
+func TestNSID(t *testing.T) {
+	identity = Identity{NSID: "fra-1"}
+	defer func() { identity = Identity{} }()
+
+	request := makeChaosQuestion("id.server.")
+	request.SetEdns0(4096, false)
+	opt := request.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+	response := dnsResponse(context.Background(), nil, request, makeClient())
+	nsid := response.IsEdns0().Option[0].(*dns.EDNS0_NSID)
+	assert.Equal(t, hex.EncodeToString([]byte("fra-1")), nsid.Nsid)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is everything we can be configured with. It starts out as
+// defaultConfig(), then the config file, the environment and the command
+// line each override what came before.
+type Config struct {
+	DNSAddr   string `json:"dns_addr"`
+	HTTPAddr  string `json:"http_addr"`
+	AdminAddr string `json:"admin_addr"`
+
+	// a MySQL DSN, postgres://..., sqlite:<path> or memory, see store.go
+	DSN string `json:"dsn"`
+	// apply pending migrations on startup, see migrate.go
+	Migrate bool `json:"migrate"`
+
+	// base64, 32 bytes each
+	HashKey            string `json:"hash_key"`
+	BlockKey           string `json:"block_key"`
+	GitHubClientID     string `json:"github_client_id"`
+	GitHubClientSecret string `json:"github_client_secret"`
+
+	SentryDSN    string    `json:"sentry_dsn"`
+	Log          LogConfig `json:"log"`
+	Identity     Identity  `json:"identity"`
+	ReverseZones string    `json:"reverse_zones"`
+	ASNv4File    string    `json:"asn_v4_file"`
+	ASNv6File    string    `json:"asn_v6_file"`
+
+	// how long records, requests and everything else users make stick around
+	Retention       Duration `json:"retention"`
+	CleanupInterval Duration `json:"cleanup_interval"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// how long the history of changes to records is kept, which is as far
+	// back as a restore can go
+	HistoryRetention Duration `json:"history_retention"`
+}
+
+// Duration is a time.Duration written like "15m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		DNSAddr:          ":53",
+		HTTPAddr:         ":8080",
+		AdminAddr:        ":9090",
+		Migrate:          true,
+		Log:              LogConfig{Level: slog.LevelInfo, Format: "json"},
+		ReverseZones:     defaultReverseZones,
+		ASNv4File:        "ip2asn-v4.tsv",
+		ASNv6File:        "ip2asn-v6.tsv",
+		Retention:        Duration{24 * time.Hour},
+		HistoryRetention: Duration{7 * 24 * time.Hour},
+		CleanupInterval:  Duration{15 * time.Minute},
+		ShutdownTimeout:  Duration{30 * time.Second},
+	}
+}
+
+// loadConfig reads the config file given by --config (or CONFIG_FILE), then
+// applies the environment and the rest of the command line. It also says
+// whether we were asked to --print-config.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, bool, error) {
+	config := defaultConfig()
+	flags := flag.NewFlagSet("mess-with-dns", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON config file")
+	printConfig := flags.Bool("print-config", false, "print the effective config, with secrets redacted, and exit")
+	dnsAddr := flags.String("dns-addr", "", "address to answer DNS queries on, UDP and TCP")
+	httpAddr := flags.String("http-addr", "", "address to serve the API on")
+	adminAddr := flags.String("admin-addr", "", "address to serve metrics on")
+	migrate := flags.Bool("migrate", true, "apply pending migrations on startup")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	logFormat := flags.String("log-format", "", "json or text")
+	err := flags.Parse(args)
+	if err != nil {
+		return config, false, err
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		err = readConfigFile(*configFile, &config)
+		if err != nil {
+			return config, false, err
+		}
+	}
+	err = applyEnv(&config, lookupEnv)
+	if err != nil {
+		return config, false, err
+	}
+
+	// only the flags that were given override anything
+	var levelErr error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dns-addr":
+			config.DNSAddr = *dnsAddr
+		case "http-addr":
+			config.HTTPAddr = *httpAddr
+		case "admin-addr":
+			config.AdminAddr = *adminAddr
+		case "migrate":
+			config.Migrate = *migrate
+		case "log-level":
+			levelErr = config.Log.Level.UnmarshalText([]byte(*logLevel))
+		case "log-format":
+			config.Log.Format = *logFormat
+		}
+	})
+	if levelErr != nil {
+		return config, false, fmt.Errorf("invalid --log-level: %s", levelErr.Error())
+	}
+	// we used to take just the port as an argument
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		config.DNSAddr = ":" + flags.Arg(0)
+	default:
+		return config, false, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return config, *printConfig, nil
+}
+
+func readConfigFile(path string, config *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err.Error())
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func applyEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"DNS_ADDR":             &config.DNSAddr,
+		"HTTP_ADDR":            &config.HTTPAddr,
+		"ADMIN_ADDR":           &config.AdminAddr,
+		"DSN":                  &config.DSN,
+		"HASH_KEY":             &config.HashKey,
+		"BLOCK_KEY":            &config.BlockKey,
+		"GITHUB_CLIENT_ID":     &config.GitHubClientID,
+		"GITHUB_CLIENT_SECRET": &config.GitHubClientSecret,
+		"SENTRY_DSN":           &config.SentryDSN,
+		"LOG_FORMAT":           &config.Log.Format,
+		"DNS_HOSTNAME":         &config.Identity.Hostname,
+		"DNS_ID":               &config.Identity.ID,
+		"DNS_VERSION":          &config.Identity.Version,
+		"DNS_NSID":             &config.Identity.NSID,
+		"ASN_V4_FILE":          &config.ASNv4File,
+		"ASN_V6_FILE":          &config.ASNv6File,
+	}
+	for name, field := range strs {
+		if value, ok := lookupEnv(name); ok && value != "" {
+			*field = value
+		}
+	}
+	// an empty REVERSE_ZONES turns them off
+	if value, ok := lookupEnv("REVERSE_ZONES"); ok {
+		config.ReverseZones = value
+	}
+	if value, _ := lookupEnv("MIGRATE"); value != "" {
+		config.Migrate = value == "true"
+	}
+	if value, _ := lookupEnv("LOG_LEVEL"); value != "" {
+		err := config.Log.Level.UnmarshalText([]byte(value))
+		if err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %s", err.Error())
+		}
+	}
+	if value, _ := lookupEnv("LOG_REDACT"); value != "" {
+		config.Log.Redact = nil
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				config.Log.Redact = append(config.Log.Redact, field)
+			}
+		}
+	}
+	durations := map[string]*Duration{
+		"RETENTION":         &config.Retention,
+		"HISTORY_RETENTION": &config.HistoryRetention,
+		"CLEANUP_INTERVAL":  &config.CleanupInterval,
+		"SHUTDOWN_TIMEOUT":  &config.ShutdownTimeout,
+	}
+	for name, field := range durations {
+		if value, _ := lookupEnv(name); value != "" {
+			err := field.UnmarshalText([]byte(value))
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports everything that's wrong with the config at once
+func (config Config) Validate() error {
+	var errs []error
+	addrs := []struct{ name, addr string }{
+		{"dns_addr", config.DNSAddr},
+		{"http_addr", config.HTTPAddr},
+		{"admin_addr", config.AdminAddr},
+	}
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", a.name, err.Error()))
+		}
+	}
+	if config.DSN == "" {
+		errs = append(errs, fmt.Errorf("dsn is required"))
+	}
+	if _, err := decodeKey(config.HashKey); err != nil {
+		errs = append(errs, fmt.Errorf("hash_key: %s", err.Error()))
+	}
+	if _, err := decodeKey(config.BlockKey); err != nil {
+		errs = append(errs, fmt.Errorf("block_key: %s", err.Error()))
+	}
+	if (config.GitHubClientID == "") != (config.GitHubClientSecret == "") {
+		errs = append(errs, fmt.Errorf("github_client_id and github_client_secret go together"))
+	}
+	if config.Log.Format != "json" && config.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format must be json or text, not %q", config.Log.Format))
+	}
+	if _, err := parseReverseZones(config.ReverseZones); err != nil {
+		errs = append(errs, fmt.Errorf("reverse_zones: %s", err.Error()))
+	}
+	for _, file := range []string{config.ASNv4File, config.ASNv6File} {
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("ip2asn file: %s", err.Error()))
+		}
+	}
+	durations := []struct {
+		name     string
+		duration Duration
+	}{
+		{"retention", config.Retention},
+		{"history_retention", config.HistoryRetention},
+		{"cleanup_interval", config.CleanupInterval},
+		{"shutdown_timeout", config.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.duration.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", d.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func decodeKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, base64 encoded")
+	}
+	return decoded, nil
+}
+
+// Redacted is the config with the secrets blanked out, for printing
+func (config Config) Redacted() Config {
+	for _, secret := range []*string{
+		&config.DSN,
+		&config.HashKey,
+		&config.BlockKey,
+		&config.GitHubClientSecret,
+		&config.SentryDSN,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return config
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{
+		"dns_addr": ":5353",
+		"http_addr": ":8081",
+		"dsn": "from-file",
+		"log": {"level": "warn"},
+		"retention": "48h"
+	}`), 0o600)
+	assert.Nil(t, err)
+
+	config, printConfig, err := loadConfig(
+		[]string{"--config", file, "--http-addr", ":8082", "--print-config"},
+		envFrom(map[string]string{
+			"DSN":        "from-env",
+			"LOG_LEVEL":  "debug",
+			"LOG_REDACT": "remote, subdomain",
+		}),
+	)
+	assert.Nil(t, err)
+	assert.True(t, printConfig)
+	// file over defaults
+	assert.Equal(t, ":5353", config.DNSAddr)
+	assert.Equal(t, 48*time.Hour, config.Retention.Duration)
+	assert.Equal(t, ":9090", config.AdminAddr)
+	// env over file
+	assert.Equal(t, "from-env", config.DSN)
+	assert.Equal(t, slog.LevelDebug, config.Log.Level)
+	assert.Equal(t, []string{"remote", "subdomain"}, config.Log.Redact)
+	// flags over everything
+	assert.Equal(t, ":8082", config.HTTPAddr)
+}
+
+func TestConfigErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"dns_adr": ":53"}`), 0o600)
+	assert.Nil(t, err)
+	_, _, err = loadConfig([]string{"--config", file}, envFrom(nil))
+	assert.ErrorContains(t, err, "dns_adr")
+
+	_, _, err = loadConfig(nil, envFrom(map[string]string{"RETENTION": "a day"}))
+	assert.ErrorContains(t, err, "RETENTION")
+
+	// the port on its own still works
+	config, _, err := loadConfig([]string{"5353"}, envFrom(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, ":5353", config.DNSAddr)
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := defaultConfig()
+	config.HashKey = "not base64"
+	config.GitHubClientID = "id"
+	config.Log.Format = "xml"
+	config.ASNv4File = "/nonexistent"
+	err := config.Validate()
+	assert.ErrorContains(t, err, "dsn is required")
+	assert.ErrorContains(t, err, "hash_key")
+	assert.ErrorContains(t, err, "github_client_id and github_client_secret")
+	assert.ErrorContains(t, err, "log.format")
+	assert.ErrorContains(t, err, "/nonexistent")
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := defaultConfig()
+	config.DSN = "user:password@tcp(db)/dns"
+	config.GitHubClientID = "id"
+	config.GitHubClientSecret = "secret"
+	redactedConfig := config.Redacted()
+	assert.Equal(t, "[redacted]", redactedConfig.DSN)
+	assert.Equal(t, "[redacted]", redactedConfig.GitHubClientSecret)
+	assert.Equal(t, "id", redactedConfig.GitHubClientID)
+	// sentry isn't set up, so there's nothing to hide
+	assert.Equal(t, "", redactedConfig.SentryDSN)
+	// the original is untouched
+	assert.Equal(t, "secret", config.GitHubClientSecret)
+}
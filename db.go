@@ -1,98 +1,254 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
-// connect to planetscale
-func connect() (*sql.DB, error) {
-	// get connection string from environment
-	connStr := os.Getenv("DSN")
-	db, err := sql.Open("mysql", connStr)
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+// sqlStore is the Store for the SQL databases. The queries are the same
+// everywhere except for the bits in dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
 }
 
-func createTables(db *sql.DB) error {
-	if os.Getenv("DEV") == "true" {
-		fmt.Println("creating tables...")
-		err := loadSQLFile(db, "create.sql")
-		if err != nil {
-			return err
-		}
-		// initialize the serials table
-		// check if serials table has anything in it
-		rows, err := db.Query("SELECT * FROM dns_serials")
-		if err != nil {
-			return err
-		}
-		if rows.Next() {
-			// if it has something in it, we don't need to do anything
-			return nil
-		}
-		_, err = db.Exec("INSERT INTO dns_serials (serial) VALUES (10)")
-		if err != nil {
-			return err
+// dialect is the SQL that differs between databases
+type dialect struct {
+	// the directory in migrations/
+	name string
+	// for sql.Open
+	driver string
+	// for spans
+	system attribute.KeyValue
+	// olderThan is a condition that created_at is more than ? seconds ago
+	olderThan string
+	// unixTime turns a timestamp column into seconds since the epoch
+	unixTime func(column string) string
+	// how stale the reads that answer queries are allowed to be
+	readIsolation sql.IsolationLevel
+	// upsert finishes an INSERT so that it updates the columns instead when
+	// the key is already there
+	upsert func(key string, columns ...string) string
+	// numbered means placeholders are $1, $2, ... instead of ?
+	numbered bool
+	// returning means new IDs come from INSERT ... RETURNING id, because the
+	// driver doesn't do LastInsertId
+	returning bool
+	// lockMigrations keeps other instances from migrating until unlock is
+	// called. It holds the lock on conn.
+	lockMigrations func(ctx context.Context, conn *sql.Conn) (unlock func(), err error)
+}
+
+// bind rewrites the ? placeholders the queries are written with for the
+// dialect
+func (d dialect) bind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
 		}
+		b.WriteRune(c)
 	}
-	return nil
+	return b.String()
 }
 
-func loadSQLFile(db *sql.DB, sqlFile string) error {
-	file, err := os.ReadFile(sqlFile)
+var mysqlDialect = dialect{
+	name:      "mysql",
+	driver:    "mysql",
+	system:    semconv.DBSystemMySQL,
+	olderThan: "created_at < NOW() - INTERVAL ? SECOND",
+	unixTime: func(column string) string {
+		return "UNIX_TIMESTAMP(" + column + ")"
+	},
+	readIsolation: sql.LevelReadUncommitted,
+	upsert: func(key string, columns ...string) string {
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + " = VALUES(" + column + ")"
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	},
+	lockMigrations: lockMySQL,
+}
+
+// connect to planetscale. The migrations add a foreign key from dns_records
+// to subdomains, so foreign key support has to be turned on in the
+// database's settings before running them.
+func openMySQL(dsn string) (*sqlStore, error) {
+	db, err := sql.Open(mysqlDialect.driver, dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tx, err := db.Begin()
+	return &sqlStore{db: db, dialect: mysqlDialect}, nil
+}
+
+// lockMySQL uses a named lock, which MySQL lets go of by itself if the
+// connection holding it dies
+func lockMySQL(ctx context.Context, conn *sql.Conn) (func(), error) {
+	var locked sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&locked)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
-	for _, q := range strings.Split(string(file), ";") {
-		q := strings.TrimSpace(q)
-		if q == "" {
-			continue
-		}
-		if _, err := tx.Exec(q); err != nil {
-			return err
-		}
+	if locked.Int64 != 1 {
+		return nil, fmt.Errorf("another instance has been migrating for over %s", migrationLockTimeout)
+	}
+	return func() {
+		var released sql.NullInt64
+		_ = conn.QueryRowContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName).Scan(&released)
+	}, nil
+}
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStore) exec(ctx context.Context, q querier, query string, args ...interface{}) (sql.Result, error) {
+	return q.ExecContext(ctx, s.dialect.bind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.QueryContext(ctx, s.dialect.bind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, q querier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRowContext(ctx, s.dialect.bind(query), args...)
+}
+
+// insert runs an INSERT and gets the new row's ID
+func (s *sqlStore) insert(ctx context.Context, q querier, query string, args ...interface{}) (int64, error) {
+	if s.dialect.returning {
+		var id int64
+		err := s.queryRow(ctx, q, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := s.exec(ctx, q, query, args...)
+	if err != nil {
+		return 0, err
 	}
-	return tx.Commit()
+	return result.LastInsertId()
 }
 
-func GetSerial(db *sql.DB) (uint32, error) {
+func (s *sqlStore) trace(ctx context.Context, query string) (context.Context, func()) {
+	return traceQuery(ctx, query, s.dialect.system)
+}
+
+// readTx is for reads that don't need to wait for other transactions
+func (s *sqlStore) readTx(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, &sql.TxOptions{Isolation: s.dialect.readIsolation})
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) GetSerial(ctx context.Context) (uint32, error) {
+	ctx, end := s.trace(ctx, "GetSerial")
+	defer end()
 	var serial uint32
-	err := db.QueryRow("SELECT serial FROM dns_serials").Scan(&serial)
+	err := s.queryRow(ctx, s.db, "SELECT serial FROM dns_serials").Scan(&serial)
 	if err != nil {
 		return 0, err
 	}
 	return serial, nil
 }
 
-func IncrementSerial(tx *sql.Tx) error {
-	_, err := tx.Exec("UPDATE dns_serials SET serial = serial + 1")
+func (s *sqlStore) incrementSerial(ctx context.Context, tx *sql.Tx) error {
+	_, err := s.exec(ctx, tx, "UPDATE dns_serials SET serial = serial + 1")
+	if err != nil {
+		return err
+	}
+	return s.commitSerial(ctx, tx, nil)
+}
+
+func (s *sqlStore) GetZoneSerial(ctx context.Context, subdomain string) (uint32, error) {
+	ctx, end := s.trace(ctx, "GetZoneSerial")
+	defer end()
+	return s.zoneSerial(ctx, s.db, subdomain)
+}
+
+// zoneSerial is the serial subdomain's records last changed at. It's kept
+// in subdomains rather than worked out from the history, since the history
+// gets pruned and the zone serial must never go back.
+func (s *sqlStore) zoneSerial(ctx context.Context, q querier, subdomain string) (uint32, error) {
+	var serial uint32
+	err := s.queryRow(ctx, q, "SELECT serial FROM subdomains WHERE name = ?", subdomain).Scan(&serial)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return serial, err
+}
+
+// checkZoneSerial increments the serial, and fails unless subdomain's zone
+// serial is still serial. Every change to the records increments the serial
+// first thing, so while tx has the row locked nothing else can change in
+// between, and the zone serial it reads after that is up to date.
+func (s *sqlStore) checkZoneSerial(ctx context.Context, tx *sql.Tx, subdomain string, serial uint32) error {
+	_, err := s.exec(ctx, tx, "UPDATE dns_serials SET serial = serial + 1")
 	if err != nil {
 		return err
 	}
+	current, err := s.zoneSerial(ctx, tx, subdomain)
+	if err != nil {
+		return err
+	}
+	if current != serial {
+		return errSerialChanged
+	}
+	return nil
+}
+
+// commitSerial commits tx once it has incremented the serial, along with
+// the history of the records it changed and the new serial of their zones
+func (s *sqlStore) commitSerial(ctx context.Context, tx *sql.Tx, history []HistoryEntry) error {
 	// get new serial
 	var serial uint32
-	err = tx.QueryRow("SELECT serial FROM dns_serials").Scan(&serial)
+	err := s.queryRow(ctx, tx, "SELECT serial FROM dns_serials").Scan(&serial)
 	if err != nil {
 		return err
 	}
+	changed := make(map[string]bool)
+	for _, entry := range history {
+		err = s.insertHistory(ctx, tx, entry, serial-1, serial)
+		if err != nil {
+			return err
+		}
+		if !changed[entry.subdomain] {
+			changed[entry.subdomain] = true
+			_, err = s.exec(ctx, tx, "UPDATE subdomains SET serial = ? WHERE name = ?", serial, entry.subdomain)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	// commit transaction
 	err = tx.Commit()
 	if err != nil {
@@ -102,228 +258,638 @@ func IncrementSerial(tx *sql.Tx) error {
 	return nil
 }
 
-func DeleteRecord(db *sql.DB, id int) error {
-	tx, err := db.Begin()
+// checkOwner makes sure record id belongs to subdomain
+func (s *sqlStore) checkOwner(ctx context.Context, tx *sql.Tx, subdomain string, id int) error {
+	var one int
+	err := s.queryRow(ctx, tx, "SELECT 1 FROM dns_records WHERE id = ? AND subdomain = ?", id, subdomain).Scan(&one)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *sqlStore) DeleteRecord(ctx context.Context, subdomain string, id int) error {
+	ctx, end := s.trace(ctx, "DeleteRecord")
+	defer end()
+	return s.applyChange(ctx, subdomain, RecordChange{Op: ChangeDelete, ID: id})
+}
+
+// applyChange makes one change the way ApplyRecordChanges does, so that it
+// goes in the history, but with the error it would have on its own
+func (s *sqlStore) applyChange(ctx context.Context, subdomain string, change RecordChange) error {
+	_, err := s.ApplyRecordChanges(ctx, subdomain, []RecordChange{change})
+	var failed *changeError
+	if errors.As(err, &failed) {
+		return failed.Err
+	}
+	return err
+}
+
+func (s *sqlStore) deleteRecord(ctx context.Context, tx *sql.Tx, subdomain string, id int) error {
+	result, err := s.exec(ctx, tx, "DELETE FROM dns_records WHERE id = ? AND subdomain = ?", id, subdomain)
 	if err != nil {
 		return err
 	}
-
-	_, err = tx.Exec("DELETE FROM dns_records WHERE id = ?", id)
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	return IncrementSerial(tx)
+	if n == 0 {
+		return errNotFound
+	}
+	_, err = s.exec(ctx, tx, "DELETE FROM dns_health_checks WHERE record_id = ?", id)
+	return err
 }
 
-func DeleteOldRecords(db *sql.DB) {
-	// delete records where created_at timestamp is more than a week old
-	_, err := db.Exec("DELETE FROM dns_records WHERE created_at < NOW() - INTERVAL 1 DAY")
+// deleteOwned deletes the row with id from table, or returns errNotFound if
+// there isn't one that belongs to subdomain
+func (s *sqlStore) deleteOwned(ctx context.Context, tx *sql.Tx, table string, subdomain string, id int) error {
+	result, err := s.exec(ctx, tx, "DELETE FROM "+table+" WHERE id = ? AND subdomain = ?", id, subdomain)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
 }
 
-func DeleteOldRequests(db *sql.DB) {
-	// delete requests where created_at timestamp is more than a day
-	// if we don't put the limit I get a "resources exhausted" error
-	// 1 day ago, postgres
-	_, err := db.Exec("DELETE FROM dns_requests WHERE created_at < NOW() - INTERVAL 1 DAY")
+func (s *sqlStore) deleteOld(ctx context.Context, table string, query string, args ...interface{}) error {
+	result, err := s.exec(ctx, s.db, query, args...)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil {
+		countDeleted(table, n)
 	}
+	return nil
 }
 
-func UpdateRecord(db *sql.DB, id int, record dns.RR) error {
-	tx, err := db.Begin()
+func (s *sqlStore) DeleteOldRecords(ctx context.Context, retention time.Duration) error {
+	ctx, end := s.trace(ctx, "DeleteOldRecords")
+	defer end()
+	// delete records where created_at timestamp is older than the retention
+	seconds := int(retention.Seconds())
+	err := s.deleteOldRecords(ctx, seconds)
 	if err != nil {
 		return err
 	}
-
-	jsonString, err := json.Marshal(record)
+	err = s.deleteOld(ctx, "dns_health_checks", "DELETE FROM dns_health_checks WHERE record_id NOT IN (SELECT id FROM dns_records)")
 	if err != nil {
 		return err
 	}
-	name := record.Header().Name
-	_, err = tx.Exec(
-		"UPDATE dns_records SET name = ?, subdomain = ?, rrtype = ?, content = ? WHERE id = ?",
-		name,
-		ExtractSubdomain(name),
-		record.Header().Rrtype,
-		jsonString,
-		id,
-	)
+	err = s.deleteOld(ctx, "dns_behaviors", "DELETE FROM dns_behaviors WHERE "+s.dialect.olderThan, seconds)
+	if err != nil {
+		return err
+	}
+	err = s.deleteOld(ctx, "dns_faults", "DELETE FROM dns_faults WHERE "+s.dialect.olderThan, seconds)
 	if err != nil {
 		return err
 	}
-	return IncrementSerial(tx)
+	// reverse slices go back in the pool once nobody has records in them
+	return s.deleteOld(
+		ctx,
+		"dns_reverse_slices",
+		`DELETE FROM dns_reverse_slices
+WHERE `+s.dialect.olderThan+`
+AND subdomain NOT IN (SELECT subdomain FROM dns_records)`,
+		seconds,
+	)
 }
 
-func InsertRecord(db *sql.DB, record dns.RR) error {
-	tx, err := db.Begin()
+// deleteOldRecords deletes records one by one, so that each one goes in the
+// history
+func (s *sqlStore) deleteOldRecords(ctx context.Context, seconds int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	jsonString, err := json.Marshal(record)
+	rows, err := s.query(ctx, tx, "SELECT DISTINCT subdomain FROM dns_records WHERE "+s.dialect.olderThan, seconds)
 	if err != nil {
 		return err
 	}
-	name := record.Header().Name
-	_, err = tx.Exec(
-		"INSERT INTO dns_records (name, subdomain, rrtype, content) VALUES (?, ?, ?, ?)",
-		name,
-		ExtractSubdomain(name),
-		record.Header().Rrtype,
-		jsonString,
-	)
+	var subdomains []string
+	for rows.Next() {
+		var subdomain string
+		err = rows.Scan(&subdomain)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		subdomains = append(subdomains, subdomain)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var history []HistoryEntry
+	for _, subdomain := range subdomains {
+		old, err := s.getRecords(ctx, tx, "r.subdomain = ? AND "+s.dialect.olderThan, subdomain, seconds)
+		if err != nil {
+			return err
+		}
+		entries, err := deletedEntries(subdomain, actorRetention, old)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = s.deleteRecord(ctx, tx, subdomain, entry.RecordID)
+			if err != nil {
+				return err
+			}
+		}
+		history = append(history, entries...)
+	}
+	if len(history) == 0 {
+		return nil
+	}
+	_, err = s.exec(ctx, tx, "UPDATE dns_serials SET serial = serial + 1")
 	if err != nil {
 		return err
 	}
-	return IncrementSerial(tx)
+	err = s.commitSerial(ctx, tx, history)
+	if err != nil {
+		return err
+	}
+	countDeleted("dns_records", int64(len(history)))
+	return nil
+}
+
+// DeleteOldHistory deletes changes from more than retention ago
+func (s *sqlStore) DeleteOldHistory(ctx context.Context, retention time.Duration) error {
+	ctx, end := s.trace(ctx, "DeleteOldHistory")
+	defer end()
+	seconds := int(retention.Seconds())
+	return s.deleteOld(ctx, "dns_record_history", "DELETE FROM dns_record_history WHERE "+s.dialect.olderThan, seconds)
 }
 
-func uncommittedTransaction(db *sql.DB) (*sql.Tx, error) {
-	tx, err := db.Begin()
+func (s *sqlStore) insertHistory(ctx context.Context, tx *sql.Tx, entry HistoryEntry, before uint32, after uint32) error {
+	oldValue, err := marshalValue(entry.Old)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED")
+	newValue, err := marshalValue(entry.New)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return tx, nil
+	_, err = s.exec(
+		ctx,
+		tx,
+		`INSERT INTO dns_record_history (subdomain, record_id, op, actor, old_value, new_value, serial_before, serial_after)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.subdomain,
+		entry.RecordID,
+		entry.Op,
+		entry.Actor,
+		oldValue,
+		newValue,
+		before,
+		after,
+	)
+	return err
 }
 
-func GetRecordsForName(db *sql.DB, subdomain string) (map[int]dns.RR, error) {
-	// we're stricter about the isolation level here because it's weird if you delete
-	// a record, but it still exists after
-	rows, err := db.Query("SELECT id, content FROM dns_records WHERE subdomain = ?", subdomain)
+// GetRecordHistory reads the history newest first, until it gets to since
+func (s *sqlStore) GetRecordHistory(ctx context.Context, subdomain string, since time.Time, limit int) ([]HistoryEntry, error) {
+	ctx, end := s.trace(ctx, "GetRecordHistory")
+	defer end()
+	// created_at only has seconds, so changes in the same second as since
+	// count as before it
+	query := `SELECT id, ` + s.dialect.unixTime("created_at") + `, record_id, op, actor, old_value, new_value, serial_before, serial_after
+FROM dns_record_history
+WHERE subdomain = ? AND ` + s.dialect.unixTime("created_at") + ` > ?
+ORDER BY id DESC`
+	args := []interface{}{subdomain, since.Unix()}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := s.query(ctx, s.db, query, args...)
 	if err != nil {
 		return nil, err
 	}
-	records := make(map[int]dns.RR)
+	defer rows.Close()
+	entries := make([]HistoryEntry, 0)
 	for rows.Next() {
-		var content []byte
-		var id int
-		err = rows.Scan(&id, &content)
+		entry, err := scanHistory(rows, subdomain)
 		if err != nil {
 			return nil, err
 		}
-		record, err := ParseRecord(content)
-		if err != nil {
-			return nil, err
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) GetHistoryEntry(ctx context.Context, subdomain string, id int) (HistoryEntry, error) {
+	ctx, end := s.trace(ctx, "GetHistoryEntry")
+	defer end()
+	rows, err := s.query(
+		ctx,
+		s.db,
+		`SELECT id, `+s.dialect.unixTime("created_at")+`, record_id, op, actor, old_value, new_value, serial_before, serial_after
+FROM dns_record_history
+WHERE id = ? AND subdomain = ?`,
+		id,
+		subdomain,
+	)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return HistoryEntry{}, err
 		}
-		records[id] = record
+		return HistoryEntry{}, errNotFound
 	}
-	return records, nil
+	return scanHistory(rows, subdomain)
 }
 
-func LogRequest(
-	db *sql.DB,
-	request *dns.Msg,
-	response *dns.Msg,
-	src_ip net.IP,
-	src_host string,
-) error {
-	jsonRequest, err := json.Marshal(request)
+func scanHistory(rows *sql.Rows, subdomain string) (HistoryEntry, error) {
+	entry := HistoryEntry{subdomain: subdomain}
+	var createdAt float64
+	var oldValue, newValue *string
+	err := rows.Scan(&entry.ID, &createdAt, &entry.RecordID, &entry.Op, &entry.Actor, &oldValue, &newValue, &entry.SerialBefore, &entry.SerialAfter)
 	if err != nil {
-		return err
+		return entry, err
 	}
-	jsonResponse, err := json.Marshal(response)
+	entry.CreatedAt = time.Unix(0, int64(createdAt*float64(time.Second))).UTC()
+	entry.Old, err = unmarshalValue(oldValue)
+	if err != nil {
+		return entry, err
+	}
+	entry.New, err = unmarshalValue(newValue)
+	return entry, err
+}
+
+func (s *sqlStore) DeleteOldRequests(ctx context.Context, retention time.Duration) error {
+	ctx, end := s.trace(ctx, "DeleteOldRequests")
+	defer end()
+	// delete requests where created_at timestamp is older than the retention
+	// if we don't put the limit I get a "resources exhausted" error
+	// 1 day ago, postgres
+	seconds := int(retention.Seconds())
+	return s.deleteOld(ctx, "dns_requests", "DELETE FROM dns_requests WHERE "+s.dialect.olderThan, seconds)
+}
+
+func (s *sqlStore) UpdateRecord(ctx context.Context, subdomain string, id int, record dns.RR, options RecordOptions) error {
+	ctx, end := s.trace(ctx, "UpdateRecord")
+	defer end()
+	return s.applyChange(ctx, subdomain, RecordChange{Op: ChangeUpdate, ID: id, Record: record, Options: options})
+}
+
+func (s *sqlStore) updateRecord(ctx context.Context, tx *sql.Tx, subdomain string, id int, record dns.RR, options RecordOptions) error {
+	rr, err := FormatRecord(record)
 	if err != nil {
 		return err
 	}
-	name := request.Question[0].Name
-	subdomain := ExtractSubdomain(name)
-	err = StreamRequest(subdomain, jsonRequest, jsonResponse, src_ip.String(), src_host)
+	// MySQL doesn't count rows that didn't change as affected, so this is
+	// checked up front
+	err = s.checkOwner(ctx, tx, subdomain, id)
 	if err != nil {
 		return err
 	}
-
-	_, err = db.Exec(
-		"INSERT INTO dns_requests (name, subdomain, request, response, src_ip, src_host) VALUES (?, ?, ?, ?, ?, ?)",
+	name := record.Header().Name
+	_, err = s.exec(
+		ctx,
+		tx,
+		"UPDATE dns_records SET name = ?, rrtype = ?, ttl = ?, rr = ?, weight = ?, backup = ? WHERE id = ? AND subdomain = ?",
 		name,
+		record.Header().Rrtype,
+		record.Header().Ttl,
+		rr,
+		options.Weight,
+		options.Backup,
+		id,
 		subdomain,
-		jsonRequest,
-		jsonResponse,
-		src_ip.String(),
-		src_host,
 	)
 	if err != nil {
 		return err
 	}
+	_, err = s.exec(ctx, tx, "DELETE FROM dns_health_checks WHERE record_id = ?", id)
+	if err != nil {
+		return err
+	}
+	if options.HealthCheck != nil {
+		return s.insertHealthCheck(ctx, tx, id, options.HealthCheck)
+	}
 	return nil
 }
 
-func StreamRequest(
-	subdomain string,
-	request []byte,
-	response []byte,
-	src_ip string,
-	src_host string,
-) error {
-	fmt.Println("writing", subdomain)
-	// get base domain
-	x := map[string]interface{}{
-		"created_at": time.Now().Unix(),
-		"request":    string(request),
-		"response":   string(response),
-		"src_ip":     src_ip,
-		"src_host":   src_host,
+func (s *sqlStore) InsertRecord(ctx context.Context, subdomain string, record dns.RR, options RecordOptions) error {
+	ctx, end := s.trace(ctx, "InsertRecord")
+	defer end()
+	return s.applyChange(ctx, subdomain, RecordChange{Op: ChangeCreate, Record: record, Options: options})
+}
+
+func (s *sqlStore) insertRecord(ctx context.Context, tx *sql.Tx, subdomain string, record dns.RR, options RecordOptions) (int, error) {
+	rr, err := FormatRecord(record)
+	if err != nil {
+		return 0, err
+	}
+	name := record.Header().Name
+	id, err := s.insert(
+		ctx,
+		tx,
+		"INSERT INTO dns_records (name, subdomain, rrtype, ttl, rr, weight, backup) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		name,
+		subdomain,
+		record.Header().Rrtype,
+		record.Header().Ttl,
+		rr,
+		options.Weight,
+		options.Backup,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if options.HealthCheck != nil {
+		err = s.insertHealthCheck(ctx, tx, int(id), options.HealthCheck)
+		if err != nil {
+			return 0, err
+		}
 	}
-	jsonString, err := json.Marshal(x)
+	return int(id), nil
+}
+
+// resetRecords deletes all of subdomain's records
+func (s *sqlStore) resetRecords(ctx context.Context, tx *sql.Tx, subdomain string) error {
+	_, err := s.exec(
+		ctx,
+		tx,
+		"DELETE FROM dns_health_checks WHERE record_id IN (SELECT id FROM dns_records WHERE subdomain = ?)",
+		subdomain,
+	)
 	if err != nil {
 		return err
 	}
-	WriteToStreams(subdomain, jsonString)
-	return nil
+	_, err = s.exec(ctx, tx, "DELETE FROM dns_records WHERE subdomain = ?", subdomain)
+	return err
 }
 
-func DeleteRequestsForDomain(db *sql.DB, subdomain string) error {
-	_, err := db.Exec("DELETE FROM dns_requests WHERE subdomain = ?", subdomain)
+// ApplyRecordChanges runs the changes in one transaction
+func (s *sqlStore) ApplyRecordChanges(ctx context.Context, subdomain string, changes []RecordChange) ([]int, error) {
+	ctx, end := s.trace(ctx, "ApplyRecordChanges")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(changes))
+	var history []HistoryEntry
+	checked := false
+	for i, change := range changes {
+		ids[i] = change.ID
+		// what's there now, for the history
+		var old map[int]Record
+		switch change.Op {
+		case ChangeUpdate, ChangeDelete:
+			old, err = s.getRecords(ctx, tx, "r.id = ? AND r.subdomain = ?", change.ID, subdomain)
+		case ChangeReset:
+			old, err = s.getRecords(ctx, tx, "r.subdomain = ?", subdomain)
+		}
+		if err != nil {
+			return nil, &changeError{Index: i, Err: err}
+		}
+		switch change.Op {
+		case ChangeCreate:
+			ids[i], err = s.insertRecord(ctx, tx, subdomain, change.Record, change.Options)
+		case ChangeUpdate:
+			err = s.updateRecord(ctx, tx, subdomain, change.ID, change.Record, change.Options)
+		case ChangeDelete:
+			err = s.deleteRecord(ctx, tx, subdomain, change.ID)
+		case ChangeReset:
+			err = s.resetRecords(ctx, tx, subdomain)
+		case ChangeCheckZoneSerial:
+			err = s.checkZoneSerial(ctx, tx, subdomain, change.Serial)
+			checked = true
+		default:
+			err = fmt.Errorf("unknown operation %q", change.Op)
+		}
+		if err != nil {
+			return nil, &changeError{Index: i, Err: err}
+		}
+		entries, err := historyEntries(subdomain, change, ids[i], old)
+		if err != nil {
+			return nil, &changeError{Index: i, Err: err}
+		}
+		history = append(history, entries...)
+	}
+	if len(changes) == 0 {
+		return ids, nil
+	}
+	// the check already incremented it
+	if !checked {
+		_, err = s.exec(ctx, tx, "UPDATE dns_serials SET serial = serial + 1")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, s.commitSerial(ctx, tx, history)
+}
+
+func (s *sqlStore) insertHealthCheck(ctx context.Context, tx *sql.Tx, recordID int, check *HealthCheck) error {
+	_, err := s.exec(
+		ctx,
+		tx,
+		"INSERT INTO dns_health_checks (record_id, kind, target, interval_seconds, threshold) VALUES (?, ?, ?, ?, ?)",
+		recordID,
+		check.Kind,
+		check.Target,
+		check.Interval,
+		check.Threshold,
+	)
+	return err
+}
+
+func (s *sqlStore) CountRecords(ctx context.Context) (int, error) {
+	ctx, end := s.trace(ctx, "CountRecords")
+	defer end()
+	var count int
+	err := s.queryRow(ctx, s.db, "SELECT COUNT(*) FROM dns_records").Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) GetHealthChecks(ctx context.Context) ([]HealthCheck, error) {
+	ctx, end := s.trace(ctx, "GetHealthChecks")
+	defer end()
+	rows, err := s.query(
+		ctx,
+		s.db,
+		`SELECT c.record_id, r.name, r.subdomain, c.kind, c.target, c.interval_seconds, c.threshold
+FROM dns_health_checks c
+JOIN dns_records r ON r.id = c.record_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checks := make([]HealthCheck, 0)
+	for rows.Next() {
+		var check HealthCheck
+		err = rows.Scan(
+			&check.RecordID,
+			&check.Name,
+			&check.Subdomain,
+			&check.Kind,
+			&check.Target,
+			&check.Interval,
+			&check.Threshold,
+		)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	return checks, rows.Err()
+}
+
+func (s *sqlStore) GetRecordsForName(ctx context.Context, subdomain string) (map[int]Record, error) {
+	ctx, end := s.trace(ctx, "GetRecordsForName")
+	defer end()
+	// we're stricter about the isolation level here because it's weird if you delete
+	// a record, but it still exists after
+	return s.getRecords(ctx, s.db, "r.subdomain = ?", subdomain)
+}
+
+// getRecords gets the records that match where, along with their options
+func (s *sqlStore) getRecords(ctx context.Context, q querier, where string, args ...interface{}) (map[int]Record, error) {
+	rows, err := s.query(
+		ctx,
+		q,
+		`SELECT r.id, r.rr, r.weight, r.backup, c.kind, c.target, c.interval_seconds, c.threshold
+FROM dns_records r
+LEFT JOIN dns_health_checks c ON c.record_id = r.id
+WHERE `+where,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make(map[int]Record)
+	for rows.Next() {
+		var rr string
+		var id int
+		var weight int
+		var backup bool
+		var kind, target sql.NullString
+		var interval, threshold sql.NullInt32
+		err = rows.Scan(&id, &rr, &weight, &backup, &kind, &target, &interval, &threshold)
+		if err != nil {
+			return nil, err
+		}
+		record, err := ParsePresentation(rr)
+		if err != nil {
+			return nil, err
+		}
+		var check *HealthCheck
+		if kind.Valid {
+			check = &HealthCheck{
+				RecordID:  id,
+				Kind:      kind.String,
+				Target:    target.String,
+				Interval:  int(interval.Int32),
+				Threshold: int(threshold.Int32),
+			}
+		}
+		records[id] = Record{ID: id, RR: record, Weight: weight, Backup: backup, HealthCheck: check}
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) InsertRequest(ctx context.Context, request LoggedRequest) error {
+	ctx, end := s.trace(ctx, "LogRequest")
+	defer end()
+	_, err := s.exec(
+		ctx,
+		s.db,
+		"INSERT INTO dns_requests (name, subdomain, request, response, src_ip, src_host, ecs, faults, instance) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		request.Name,
+		request.Subdomain,
+		request.Request,
+		request.Response,
+		request.SrcIP,
+		request.SrcHost,
+		request.ECS,
+		request.Faults,
+		request.Instance,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteRequestsForDomain(ctx context.Context, subdomain string) error {
+	ctx, end := s.trace(ctx, "DeleteRequestsForDomain")
+	defer end()
+	_, err := s.exec(ctx, s.db, "DELETE FROM dns_requests WHERE subdomain = ?", subdomain)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetRequests(db *sql.DB, subdomain string) ([]map[string]interface{}, error) {
-	tx, err := uncommittedTransaction(db)
+func (s *sqlStore) GetRequests(ctx context.Context, subdomain string) ([]map[string]interface{}, error) {
+	ctx, end := s.trace(ctx, "GetRequests")
+	defer end()
+	tx, err := s.readTx(ctx)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := tx.Query(
-		`SELECT id, UNIX_TIMESTAMP(created_at), request, response, src_ip, src_host
+	defer tx.Rollback()
+	rows, err := s.query(
+		ctx,
+		tx,
+		`SELECT id, `+s.dialect.unixTime("created_at")+`, request, response, src_ip, src_host, ecs, faults, instance
 FROM dns_requests
 WHERE subdomain = ?
-ORDER BY created_at
-DESC LIMIT 30`,
+ORDER BY created_at DESC, id DESC
+LIMIT ?`,
 		subdomain,
+		requestsShown,
 	)
 	if err != nil {
 		return make([]map[string]interface{}, 0), err
 	}
+	defer rows.Close()
 	requests := make([]map[string]interface{}, 0)
 	for rows.Next() {
 		var id int
-		var created_at float32
-		var request []byte
-		var response []byte
-		var src_ip string
-		var src_host string
-		err = rows.Scan(&id, &created_at, &request, &response, &src_ip, &src_host)
+		var created_at float64
+		var request LoggedRequest
+		var ecs sql.NullString
+		var faults sql.NullString
+		var instance sql.NullString
+		err = rows.Scan(
+			&id,
+			&created_at,
+			&request.Request,
+			&request.Response,
+			&request.SrcIP,
+			&request.SrcHost,
+			&ecs,
+			&faults,
+			&instance,
+		)
 		if err != nil {
 			return make([]map[string]interface{}, 0), err
 		}
-		x := map[string]interface{}{
-			"id":         id,
-			"created_at": int64(created_at),
-			"request":    string(request),
-			"response":   string(response),
-			"src_ip":     src_ip,
-			"src_host":   src_host,
-		}
-		requests = append(requests, x)
+		request.ECS = []byte(ecs.String)
+		request.Faults = faults.String
+		request.Instance = instance.String
+		requests = append(requests, requestJSON(id, int64(created_at), request))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 	err = tx.Commit()
 	if err != nil {
@@ -332,56 +898,436 @@ DESC LIMIT 30`,
 	return requests, nil
 }
 
-func GetRecords(db *sql.DB, name string, rrtype uint16) ([]dns.RR, int, error) {
-	tx, err := uncommittedTransaction(db)
+func (s *sqlStore) GetRecords(ctx context.Context, name string, rrtype uint16) ([]dns.RR, int, error) {
+	ctx, end := s.trace(ctx, "GetRecords")
+	defer end()
+	tx, err := s.readTx(ctx)
 	if err != nil {
 		return nil, 0, err
 	}
-	// first get all the records
-	rows, err := tx.Query(
-		"SELECT content FROM dns_records WHERE name = ? ORDER BY created_at DESC",
+	defer tx.Rollback()
+	// first get all the records, along with the name's ordering policy
+	rows, err := s.query(
+		ctx,
+		tx,
+		`SELECT r.id, r.rr, r.weight, r.backup, p.ordering, p.answer_count
+FROM dns_records r
+LEFT JOIN dns_policies p ON p.name = r.name
+WHERE r.name = ?
+ORDER BY r.created_at DESC, r.id DESC`,
 		name,
 	)
 	if err != nil {
 		return nil, 0, err
 	}
+	defer rows.Close()
 	// next parse them
-	var records []dns.RR
+	var records []Record
+	policy := Policy{Name: name, Ordering: OrderFixed}
 	for rows.Next() {
-		var content []byte
-		err = rows.Scan(&content)
+		var id int
+		var rr string
+		var weight int
+		var backup bool
+		var ordering sql.NullString
+		var answerCount sql.NullInt32
+		err = rows.Scan(&id, &rr, &weight, &backup, &ordering, &answerCount)
 		if err != nil {
 			return nil, 0, err
 		}
-		record, err := ParseRecord(content)
+		record, err := ParsePresentation(rr)
 		if err != nil {
 			return nil, 0, err
 		}
-		records = append(records, record)
-	}
-	// now filter them
-	filtered := make([]dns.RR, 0)
-	for _, record := range records {
-		if shouldReturn(rrtype, record.Header().Rrtype) {
-			filtered = append(filtered, record)
+		records = append(records, Record{ID: id, RR: record, Weight: weight, Backup: backup})
+		if ordering.Valid {
+			policy.Ordering = ordering.String
+			policy.AnswerCount = int(answerCount.Int32)
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
 	err = tx.Commit()
 	if err != nil {
 		return nil, 0, err
 	}
-	return filtered, len(records), nil
+	// now filter them
+	return answerRecords(ctx, policy, records, rrtype), len(records), nil
+}
+
+func (s *sqlStore) GetPolicies(ctx context.Context, subdomain string) ([]Policy, error) {
+	ctx, end := s.trace(ctx, "GetPolicies")
+	defer end()
+	rows, err := s.query(
+		ctx,
+		s.db,
+		"SELECT name, ordering, answer_count FROM dns_policies WHERE subdomain = ?",
+		subdomain,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	policies := make([]Policy, 0)
+	for rows.Next() {
+		var policy Policy
+		err = rows.Scan(&policy.Name, &policy.Ordering, &policy.AnswerCount)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+func (s *sqlStore) SetPolicy(ctx context.Context, policy Policy) error {
+	ctx, end := s.trace(ctx, "SetPolicy")
+	defer end()
+	// fixed is what you get without a policy, so there's no need to keep it around
+	if policy.Ordering == OrderFixed && policy.AnswerCount == 0 {
+		_, err := s.exec(ctx, s.db, "DELETE FROM dns_policies WHERE name = ?", policy.Name)
+		return err
+	}
+	_, err := s.exec(
+		ctx,
+		s.db,
+		"INSERT INTO dns_policies (name, subdomain, ordering, answer_count) VALUES (?, ?, ?, ?)\n"+
+			s.dialect.upsert("name", "ordering", "answer_count"),
+		policy.Name,
+		ExtractSubdomain(policy.Name),
+		policy.Ordering,
+		policy.AnswerCount,
+	)
+	return err
+}
+
+func (s *sqlStore) InsertBehavior(ctx context.Context, behavior Behavior) error {
+	ctx, end := s.trace(ctx, "InsertBehavior")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	jsonString, err := json.Marshal(behavior)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(
+		ctx,
+		tx,
+		"INSERT INTO dns_behaviors (name, subdomain, kind, content) VALUES (?, ?, ?, ?)",
+		behavior.Name,
+		ExtractSubdomain(behavior.Name),
+		behavior.Kind,
+		string(jsonString),
+	)
+	if err != nil {
+		return err
+	}
+	return s.incrementSerial(ctx, tx)
+}
+
+func (s *sqlStore) DeleteBehavior(ctx context.Context, subdomain string, id int) error {
+	ctx, end := s.trace(ctx, "DeleteBehavior")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.deleteOwned(ctx, tx, "dns_behaviors", subdomain, id)
+	if err != nil {
+		return err
+	}
+	return s.incrementSerial(ctx, tx)
+}
+
+func scanBehaviors(rows *sql.Rows) ([]Behavior, error) {
+	defer rows.Close()
+	behaviors := make([]Behavior, 0)
+	for rows.Next() {
+		var id int
+		var content []byte
+		err := rows.Scan(&id, &content)
+		if err != nil {
+			return nil, err
+		}
+		var behavior Behavior
+		err = json.Unmarshal(content, &behavior)
+		if err != nil {
+			return nil, err
+		}
+		behavior.ID = id
+		behaviors = append(behaviors, behavior)
+	}
+	return behaviors, rows.Err()
+}
+
+// GetBehaviors gets the behaviors for a single name
+func (s *sqlStore) GetBehaviors(ctx context.Context, name string) ([]Behavior, error) {
+	ctx, end := s.trace(ctx, "GetBehaviors")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT id, content FROM dns_behaviors WHERE name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	return scanBehaviors(rows)
 }
 
-func shouldReturn(queryType uint16, recordType uint16) bool {
-	if queryType == recordType {
-		return true
+// GetBehaviorsForName gets all the behaviors in a subdomain
+func (s *sqlStore) GetBehaviorsForName(ctx context.Context, subdomain string) ([]Behavior, error) {
+	ctx, end := s.trace(ctx, "GetBehaviorsForName")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT id, content FROM dns_behaviors WHERE subdomain = ?", subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return scanBehaviors(rows)
+}
+
+func (s *sqlStore) InsertFault(ctx context.Context, fault Fault) error {
+	ctx, end := s.trace(ctx, "InsertFault")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	if recordType == dns.TypeCNAME {
-		return true
+	defer tx.Rollback()
+
+	jsonString, err := json.Marshal(fault)
+	if err != nil {
+		return err
 	}
-	if queryType == dns.TypeHTTPS && (recordType == dns.TypeA || recordType == dns.TypeAAAA) {
-		return true
+	_, err = s.exec(
+		ctx,
+		tx,
+		"INSERT INTO dns_faults (name, subdomain, content) VALUES (?, ?, ?)",
+		fault.Name,
+		ExtractSubdomain(fault.Name),
+		string(jsonString),
+	)
+	if err != nil {
+		return err
 	}
-	return false
+	return s.incrementSerial(ctx, tx)
+}
+
+func (s *sqlStore) DeleteFault(ctx context.Context, subdomain string, id int) error {
+	ctx, end := s.trace(ctx, "DeleteFault")
+	defer end()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.deleteOwned(ctx, tx, "dns_faults", subdomain, id)
+	if err != nil {
+		return err
+	}
+	return s.incrementSerial(ctx, tx)
+}
+
+func scanFaults(rows *sql.Rows) ([]Fault, error) {
+	defer rows.Close()
+	faults := make([]Fault, 0)
+	for rows.Next() {
+		var id int
+		var content []byte
+		err := rows.Scan(&id, &content)
+		if err != nil {
+			return nil, err
+		}
+		var fault Fault
+		err = json.Unmarshal(content, &fault)
+		if err != nil {
+			return nil, err
+		}
+		fault.ID = id
+		faults = append(faults, fault)
+	}
+	return faults, rows.Err()
+}
+
+// GetFaults gets the faults to inject for a single name
+func (s *sqlStore) GetFaults(ctx context.Context, name string) ([]Fault, error) {
+	ctx, end := s.trace(ctx, "GetFaults")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT id, content FROM dns_faults WHERE name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	return scanFaults(rows)
+}
+
+// GetFaultsForName gets all the faults in a subdomain
+func (s *sqlStore) GetFaultsForName(ctx context.Context, subdomain string) ([]Fault, error) {
+	ctx, end := s.trace(ctx, "GetFaultsForName")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT id, content FROM dns_faults WHERE subdomain = ?", subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return scanFaults(rows)
+}
+
+func (s *sqlStore) GetFaultNames(ctx context.Context) ([]string, error) {
+	ctx, end := s.trace(ctx, "GetFaultNames")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT DISTINCT name FROM dns_faults")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetReverseSlices maps the allocated slices of a reverse zone to the
+// subdomains they belong to
+func (s *sqlStore) GetReverseSlices(ctx context.Context, zone string) (map[string]string, error) {
+	ctx, end := s.trace(ctx, "GetReverseSlices")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT prefix, subdomain FROM dns_reverse_slices WHERE zone = ?", zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slices := make(map[string]string)
+	for rows.Next() {
+		var prefix, subdomain string
+		err = rows.Scan(&prefix, &subdomain)
+		if err != nil {
+			return nil, err
+		}
+		slices[prefix] = subdomain
+	}
+	return slices, rows.Err()
+}
+
+func (s *sqlStore) GetReverseSliceOwner(ctx context.Context, prefix string) (string, error) {
+	ctx, end := s.trace(ctx, "GetReverseSliceOwner")
+	defer end()
+	var subdomain string
+	err := s.queryRow(
+		ctx,
+		s.db,
+		"SELECT subdomain FROM dns_reverse_slices WHERE prefix = ?",
+		prefix,
+	).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return subdomain, err
+}
+
+func (s *sqlStore) InsertReverseSlice(ctx context.Context, zone string, prefix string, subdomain string) error {
+	ctx, end := s.trace(ctx, "InsertReverseSlice")
+	defer end()
+	// if the slice is taken this doesn't change anything, and there's no
+	// error to tell apart from the others
+	_, err := s.exec(
+		ctx,
+		s.db,
+		"INSERT INTO dns_reverse_slices (prefix, zone, subdomain) VALUES (?, ?, ?) "+s.dialect.upsert("prefix", "prefix"),
+		prefix,
+		zone,
+		subdomain,
+	)
+	if err != nil {
+		return err
+	}
+	owner, err := s.GetReverseSliceOwner(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if owner != subdomain {
+		return errSliceTaken
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSettings(ctx context.Context, subdomain string) (Settings, error) {
+	ctx, end := s.trace(ctx, "GetSettings")
+	defer end()
+	var settings Settings
+	err := s.queryRow(
+		ctx,
+		s.db,
+		"SELECT ip_names, synthesize_https FROM dns_settings WHERE subdomain = ?",
+		subdomain,
+	).Scan(&settings.IPNames, &settings.SynthesizeHTTPS)
+	if err == sql.ErrNoRows {
+		return Settings{}, nil
+	}
+	if err != nil {
+		return Settings{}, err
+	}
+	return settings, nil
+}
+
+func (s *sqlStore) SetSettings(ctx context.Context, subdomain string, settings Settings) error {
+	ctx, end := s.trace(ctx, "SetSettings")
+	defer end()
+	_, err := s.exec(
+		ctx,
+		s.db,
+		"INSERT INTO dns_settings (subdomain, ip_names, synthesize_https) VALUES (?, ?, ?)\n"+
+			s.dialect.upsert("subdomain", "ip_names", "synthesize_https"),
+		subdomain,
+		settings.IPNames,
+		settings.SynthesizeHTTPS,
+	)
+	return err
+}
+
+func (s *sqlStore) GetSubdomains(ctx context.Context, prefix string) ([]string, error) {
+	ctx, end := s.trace(ctx, "GetSubdomains")
+	defer end()
+	rows, err := s.query(ctx, s.db, "SELECT name FROM subdomains WHERE name LIKE ?", prefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subdomains []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return subdomains, err
+		}
+		subdomains = append(subdomains, name)
+	}
+	return subdomains, rows.Err()
+}
+
+func (s *sqlStore) InsertSubdomain(ctx context.Context, subdomain string) error {
+	ctx, end := s.trace(ctx, "InsertSubdomain")
+	defer end()
+	_, err := s.exec(ctx, s.db, "INSERT INTO subdomains (name) VALUES (?)", subdomain)
+	return err
+}
+
+func (s *sqlStore) EnsureSubdomain(ctx context.Context, subdomain string) error {
+	ctx, end := s.trace(ctx, "EnsureSubdomain")
+	defer end()
+	_, err := s.exec(
+		ctx,
+		s.db,
+		"INSERT INTO subdomains (name) VALUES (?) "+s.dialect.upsert("name", "name"),
+		subdomain,
+	)
+	return err
 }
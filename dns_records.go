@@ -1,40 +1,133 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
 	"net"
 	"strings"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func lookupRecords(db *sql.DB, name string, qtype uint16) ([]dns.RR, int, error) {
+type peekingKey struct{}
+
+// peeking marks lookups we only make to fill in the answer to another query,
+// like following aliases or adding addresses to the additional section. They
+// shouldn't count as queries, so they don't move round robins on or change
+// what counters and rebinds answer with.
+func peeking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peekingKey{}, true)
+}
+
+func isPeeking(ctx context.Context) bool {
+	peek, _ := ctx.Value(peekingKey{}).(bool)
+	return peek
+}
+
+func lookupRecords(ctx context.Context, store RecordStore, client *Client, name string, qtype uint16) ([]dns.RR, int, error) {
+	ctx, span := tracer.Start(ctx, "lookupRecords", trace.WithAttributes(
+		attribute.String("dns.qname", name),
+		attribute.String("dns.qtype", dns.TypeToString[qtype]),
+	))
+	defer span.End()
 	records := specialRecords(name, qtype)
 	if len(records) > 0 {
 		return records, len(records), nil
 	}
-	return GetRecords(db, name, qtype)
+	records, totalRecords, err := store.GetRecords(ctx, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	behaviors, err := store.GetBehaviors(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, behavior := range behaviors {
+		if isPeeking(ctx) {
+			records = append(records, behavior.Peek(qtype, client)...)
+		} else {
+			records = append(records, behavior.Records(qtype, client)...)
+		}
+	}
+	totalRecords += len(behaviors)
+	if totalRecords > 0 {
+		return records, totalRecords, nil
+	}
+	// stored records win over synthesized ones
+	return synthesizedRecords(ctx, store, name, qtype)
 }
 
-func dnsResponse(db *sql.DB, request *dns.Msg) *dns.Msg {
-	if !strings.HasSuffix(request.Question[0].Name, "flatbo.at.") {
+func dnsResponse(ctx context.Context, store RecordStore, request *dns.Msg, client *Client) *dns.Msg {
+	ctx, span := tracer.Start(ctx, "dnsResponse")
+	defer span.End()
+	var msg *dns.Msg
+	switch {
+	case request.Question[0].Qclass == dns.ClassCHAOS:
+		msg = chaosResponse(request)
+	case !strings.HasSuffix(request.Question[0].Name, "flatbo.at.") &&
+		!inReverseZone(request.Question[0].Name):
 		return refusedResponse(request)
+	default:
+		msg = answer(ctx, store, request, client)
 	}
+	setEdns(request, msg, client)
+	return msg
+}
+
+func answer(ctx context.Context, store RecordStore, request *dns.Msg, client *Client) *dns.Msg {
 	records, totalRecords, err := lookupRecords(
-		db,
+		ctx,
+		store,
+		client,
 		request.Question[0].Name,
 		request.Question[0].Qtype,
 	)
 	if err != nil {
 		msg := errorResponse(request)
-		fmt.Println("Error getting records:", err)
+		logger.Error("error getting records", "qname", request.Question[0].Name, "err", err)
 		return msg
 	}
 	if totalRecords == 0 {
 		return nxDomainResponse(request)
 	}
-	return successResponse(request, records)
+	if !isServiceBinding(request.Question[0].Qtype) {
+		return successResponse(request, records)
+	}
+	if len(records) == 0 && request.Question[0].Qtype == dns.TypeHTTPS {
+		records, err = synthesizedHTTPS(ctx, store, client, request.Question[0].Name)
+		if err != nil {
+			logger.Error("error synthesizing HTTPS record", "qname", request.Question[0].Name, "err", err)
+			return errorResponse(request)
+		}
+	}
+	records, extra, err := serviceBinding(ctx, store, client, request.Question[0].Qtype, records)
+	if err != nil {
+		logger.Error("error following service binding", "qname", request.Question[0].Name, "err", err)
+		return errorResponse(request)
+	}
+	msg := successResponse(request, records)
+	msg.Extra = extra
+	return msg
+}
+
+func synthesizedHTTPS(ctx context.Context, store RecordStore, client *Client, name string) ([]dns.RR, error) {
+	settings, err := store.GetSettings(ctx, ExtractSubdomain(name))
+	if err != nil || !settings.SynthesizeHTTPS {
+		return nil, err
+	}
+	addresses := make([]dns.RR, 0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		found, _, err := lookupRecords(peeking(ctx), store, client, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, found...)
+	}
+	if https := synthesizeHTTPS(name, addresses); https != nil {
+		return []dns.RR{https}, nil
+	}
+	return nil, nil
 }
 
 func emptyMessage(request *dns.Msg) *dns.Msg {
@@ -42,7 +135,7 @@ func emptyMessage(request *dns.Msg) *dns.Msg {
 	msg.SetReply(request)
 	msg.Authoritative = true
 	msg.Ns = []dns.RR{
-		getSOA(soaSerial),
+		soaFor(request.Question[0].Name),
 	}
 	return &msg
 }
@@ -132,9 +225,20 @@ func specialRecords(name string, qtype uint16) []dns.RR {
 	if qtype == dns.TypeSOA && name == "flatbo.at." {
 		return []dns.RR{getSOA(soaSerial)}
 	}
+	if zone, ok := findReverseZone(name); ok && qtype == dns.TypeSOA && name == zone.Apex() {
+		return []dns.RR{reverseSOA(zone, soaSerial)}
+	}
 	return nil
 }
 
+// soaFor is the SOA of the zone a name is in
+func soaFor(name string) *dns.SOA {
+	if zone, ok := findReverseZone(name); ok {
+		return reverseSOA(zone, soaSerial)
+	}
+	return getSOA(soaSerial)
+}
+
 func getSOA(serial uint32) *dns.SOA {
 	var soa = dns.SOA{
 		Hdr: dns.RR_Header{
@@ -1,25 +1,14 @@
 package main
 
 import (
-	"database/sql"
-	"database/sql/driver"
-	"encoding/json"
+	"context"
 	"net"
 	"testing"
 
-	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/suite"
 )
 
-func connectTestDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatal(err)
-	}
-	return db, mock
-}
-
 func makeA(name string, ip string) *dns.A {
 	return &dns.A{
 		Hdr: dns.RR_Header{
@@ -56,38 +45,26 @@ func makeQuestion(name string, qtype uint16) *dns.Msg {
 	}
 }
 
+func defaultOptions() RecordOptions {
+	return RecordOptions{Weight: defaultWeight}
+}
+
+func makeClient() *Client {
+	return &Client{Resolver: net.ParseIP("127.0.0.1")}
+}
+
 type RecordSuite struct {
 	suite.Suite
-	db     *sql.DB
-	mock   sqlmock.Sqlmock
+	store  *memoryStore
 	prefix string
 	name   string
 }
 
 func (rs *RecordSuite) SetupTest() {
-	rs.db, rs.mock = connectTestDB(rs.T())
+	rs.store = newMemoryStore()
 	rs.prefix = randString(10)
 	rs.name = rs.prefix + ".flatbo.at."
-}
-
-func (rs *RecordSuite) scaffoldMocks(rr dns.RR, dnsType uint16) {
-	content, _ := json.Marshal(rr)
-	rs.mock.ExpectBegin()
-	rs.mock.ExpectExec("INSERT INTO dns_records").
-		WithArgs(rs.name, rs.prefix, dnsType, content).
-		WillReturnResult(driver.ResultNoRows)
-	rs.mock.ExpectExec("UPDATE dns_serials").WillReturnResult(driver.ResultNoRows)
-	rs.mock.ExpectQuery("SELECT serial").
-		WillReturnRows(sqlmock.NewRows([]string{"serial"}).AddRow(11))
-	rs.mock.ExpectCommit()
-
-	rows := sqlmock.NewRows([]string{"content"}).AddRow(content)
-	rs.mock.ExpectBegin()
-	rs.mock.ExpectExec("SET TRANSACTION").WillReturnResult(driver.ResultNoRows)
-	rs.mock.ExpectQuery("SELECT content FROM dns_records").
-		WithArgs(rs.name).
-		WillReturnRows(rows)
-	rs.mock.ExpectCommit()
+	rs.Require().Nil(rs.store.InsertSubdomain(context.Background(), rs.prefix))
 }
 
 func TestRecordSuite(t *testing.T) {
@@ -96,12 +73,10 @@ func TestRecordSuite(t *testing.T) {
 
 func (rs *RecordSuite) TestARecord() {
 	record := makeA(rs.name, "1.2.3.4")
-	rs.scaffoldMocks(record, dns.TypeA)
-
-	err := InsertRecord(rs.db, makeA(rs.name, "1.2.3.4"))
+	err := rs.store.InsertRecord(context.Background(), rs.prefix, record, defaultOptions())
 	rs.NoError(err)
 
-	response := dnsResponse(rs.db, makeQuestion(rs.name, dns.TypeA))
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeA), makeClient())
 	// check that we got NOERROR and 1 answer
 	rs.Equal(dns.RcodeSuccess, response.Rcode)
 	rs.Equal(1, len(response.Answer))
@@ -109,12 +84,10 @@ func (rs *RecordSuite) TestARecord() {
 
 func (rs *RecordSuite) TestCNAMERecord() {
 	record := makeCNAME(rs.name, "example.com.")
-	rs.scaffoldMocks(record, dns.TypeCNAME)
-
-	err := InsertRecord(rs.db, record)
+	err := rs.store.InsertRecord(context.Background(), rs.prefix, record, defaultOptions())
 	rs.NoError(err)
 
-	response := dnsResponse(rs.db, makeQuestion(rs.name, dns.TypeA))
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeA), makeClient())
 	// check that we got NOERROR and 1 answer
 	rs.Equal(dns.RcodeSuccess, response.Rcode)
 	rs.Equal(1, len(response.Answer))
@@ -122,41 +95,50 @@ func (rs *RecordSuite) TestCNAMERecord() {
 
 func (rs *RecordSuite) TestHTTPSRecord() {
 	record := makeA(rs.name, "1.2.3.4")
-	rs.scaffoldMocks(record, dns.TypeA)
-
-	err := InsertRecord(rs.db, record)
+	err := rs.store.InsertRecord(context.Background(), rs.prefix, record, defaultOptions())
 	rs.NoError(err)
 
-	response := dnsResponse(rs.db, makeQuestion(rs.name, dns.TypeHTTPS))
-	// check that we got NOERROR and 1 answer
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeHTTPS), makeClient())
+	// A records aren't an answer to an HTTPS query, so we get NODATA
 	rs.Equal(dns.RcodeSuccess, response.Rcode)
-	rs.Equal(1, len(response.Answer))
+	rs.Equal(0, len(response.Answer))
 }
 
 func (rs *RecordSuite) TestNoError() {
 	record := makeA(rs.name, "1.2.3.4")
-	rs.scaffoldMocks(record, dns.TypeA)
-
-	err := InsertRecord(rs.db, record)
+	err := rs.store.InsertRecord(context.Background(), rs.prefix, record, defaultOptions())
 	rs.NoError(err)
 
-	response := dnsResponse(rs.db, makeQuestion(rs.name, dns.TypeAAAA))
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeAAAA), makeClient())
 	// check that we got NOERROR and 0 answers
 	rs.Equal(dns.RcodeSuccess, response.Rcode)
 	rs.Equal(0, len(response.Answer))
 }
 
 func (rs *RecordSuite) TestNXDOMAIN() {
-	rows := sqlmock.NewRows([]string{"content"})
-	rs.mock.ExpectBegin()
-	rs.mock.ExpectExec("SET TRANSACTION").WillReturnResult(driver.ResultNoRows)
-	rs.mock.ExpectQuery("SELECT content FROM dns_records").
-		WithArgs(rs.name).
-		WillReturnRows(rows)
-	rs.mock.ExpectCommit()
-
-	response := dnsResponse(rs.db, makeQuestion(rs.name, dns.TypeA))
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeA), makeClient())
 
 	// check that we got NXDOMAIN
 	rs.Equal(dns.RcodeNameError, response.Rcode)
 }
+
+func (rs *RecordSuite) TestIPName() {
+	name := "10-0-0-5." + rs.name
+	err := rs.store.SetSettings(context.Background(), rs.prefix, Settings{IPNames: true})
+	rs.NoError(err)
+
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(name, dns.TypeA), makeClient())
+	rs.Equal(dns.RcodeSuccess, response.Rcode)
+	rs.Equal(1, len(response.Answer))
+	rs.Equal("10.0.0.5", response.Answer[0].(*dns.A).A.String())
+}
+
+func (rs *RecordSuite) TestWhoami() {
+	err := rs.store.InsertBehavior(context.Background(), Behavior{Name: rs.name, Kind: BehaviorWhoami})
+	rs.NoError(err)
+
+	response := dnsResponse(context.Background(), rs.store, makeQuestion(rs.name, dns.TypeTXT), makeClient())
+	rs.Equal(dns.RcodeSuccess, response.Rcode)
+	rs.Equal(1, len(response.Answer))
+	rs.Equal([]string{"resolver=127.0.0.1"}, response.Answer[0].(*dns.TXT).Txt)
+}
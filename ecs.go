@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ClientSubnet is the EDNS Client Subnet option (RFC 7871) a resolver sent
+// along with a query, enriched with what the ip2asn database knows about it.
+type ClientSubnet struct {
+	Family        uint16
+	SourceNetmask uint8
+	Address       net.IP
+	ASN           int
+	ASName        string
+	Country       string
+}
+
+// Client is who a query was sent on behalf of: the resolver that sent it
+// and, if the resolver passed one along, the subnet of the client behind it.
+type Client struct {
+	Resolver net.IP
+	// what the ip2asn database knows about the resolver, if anything
+	ResolverASN *IPRange
+	Subnet      *ClientSubnet
+	// scope is the SCOPE PREFIX-LENGTH we answer with. It stays 0 unless
+	// something in the answer was chosen by the client's location.
+	scope uint8
+}
+
+func newClient(request *dns.Msg, resolver net.IP, ranges *Ranges) *Client {
+	client := &Client{Resolver: resolver}
+	if ranges != nil {
+		if r, err := ranges.FindASN(resolver); err == nil {
+			client.ResolverASN = &r
+		}
+	}
+	opt := getClientSubnet(request)
+	if opt == nil {
+		return client
+	}
+	subnet := &ClientSubnet{
+		Family:        opt.Family,
+		SourceNetmask: opt.SourceNetmask,
+		Address:       opt.Address,
+	}
+	if ranges != nil {
+		if r, err := ranges.FindASN(opt.Address); err == nil {
+			subnet.ASN = r.Num
+			subnet.ASName = r.Name
+			subnet.Country = r.Country
+		}
+	}
+	client.Subnet = subnet
+	return client
+}
+
+func getClientSubnet(request *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// Locate returns the address location-conditioned answers should be chosen
+// by: the client subnet if the resolver sent one, otherwise the resolver.
+// Calling it marks the answer as depending on the subnet, so the response
+// gets a matching scope.
+func (c *Client) Locate() net.IP {
+	if c.Subnet == nil || c.Subnet.SourceNetmask == 0 {
+		return c.Resolver
+	}
+	c.scope = c.Subnet.SourceNetmask
+	return c.Subnet.Address
+}
+
+// String formats the subnet the way it's shown in the request log,
+// e.g. "192.0.2.0/24".
+func (s *ClientSubnet) String() string {
+	return fmt.Sprintf("%s/%d", s.Address, s.SourceNetmask)
+}
+
+// setEdns adds an OPT record to the response if the request had one,
+// echoing the client subnet back with the scope we answered for, and our
+// NSID if it was asked for.
+func setEdns(request *dns.Msg, msg *dns.Msg, client *Client) {
+	if request.IsEdns0() == nil {
+		return
+	}
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	if subnet := getClientSubnet(request); subnet != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        subnet.Family,
+			SourceNetmask: subnet.SourceNetmask,
+			SourceScope:   client.scope,
+			Address:       subnet.Address,
+		})
+	}
+	if wantsNSID(request) {
+		opt.Option = append(opt.Option, nsidOption())
+	}
+	msg.Extra = append(msg.Extra, opt)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeECSQuestion(name string, subnet string, netmask uint8) *dns.Msg {
+	msg := makeQuestion(name, dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: netmask,
+		Address:       net.ParseIP(subnet).To4(),
+	})
+	return msg
+}
+
+func TestClientSubnet(t *testing.T) {
+	request := makeECSQuestion("test.flatbo.at.", "192.0.2.0", 24)
+	client := newClient(request, net.ParseIP("127.0.0.1"), nil)
+	assert.NotNil(t, client.Subnet)
+	assert.Equal(t, "192.0.2.0/24", client.Subnet.String())
+
+	// answers that don't depend on location get scope 0
+	msg := new(dns.Msg)
+	setEdns(request, msg, client)
+	subnet := getClientSubnet(msg)
+	assert.NotNil(t, subnet)
+	assert.Equal(t, uint8(24), subnet.SourceNetmask)
+	assert.Equal(t, uint8(0), subnet.SourceScope)
+
+	// once something is chosen by location, the scope matches the source
+	assert.Equal(t, "192.0.2.0", client.Locate().String())
+	msg = new(dns.Msg)
+	setEdns(request, msg, client)
+	assert.Equal(t, uint8(24), getClientSubnet(msg).SourceScope)
+}
+
+func TestNoClientSubnet(t *testing.T) {
+	request := makeQuestion("test.flatbo.at.", dns.TypeA)
+	client := newClient(request, net.ParseIP("127.0.0.1"), nil)
+	assert.Nil(t, client.Subnet)
+	assert.Equal(t, "127.0.0.1", client.Locate().String())
+
+	// a source prefix of 0 means the client opted out
+	request = makeECSQuestion("test.flatbo.at.", "0.0.0.0", 0)
+	client = newClient(request, net.ParseIP("127.0.0.1"), nil)
+	assert.Equal(t, "127.0.0.1", client.Locate().String())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Faults make ServeDNS misbehave on purpose for a name, to show how
+// resolvers retry and fall back.
+const (
+	FaultServfail = "servfail"
+	FaultRefused  = "refused"
+	// don't answer at all
+	FaultDrop = "drop"
+	// wait DelayMs before answering
+	FaultDelay = "delay"
+	// set TC on UDP answers, so the resolver has to retry over TCP
+	FaultTruncate = "truncate"
+	// answer with a message ID that doesn't match the query
+	FaultWrongID = "wrong-id"
+	// answer without the AA bit
+	FaultNonAuthoritative = "non-authoritative"
+)
+
+var faultKinds = map[string]bool{
+	FaultServfail:         true,
+	FaultRefused:          true,
+	FaultDrop:             true,
+	FaultDelay:            true,
+	FaultTruncate:         true,
+	FaultWrongID:          true,
+	FaultNonAuthoritative: true,
+}
+
+const maxFaultDelay = 30000
+
+// faultNames is which names have faults, so that queries for the names
+// without any, which is nearly all of them, don't each cost a trip to the
+// database. It's loaded again whenever the serial changes, which every fault
+// change here does, and every faultNamesTTL for the changes other instances
+// make.
+var faultNames struct {
+	sync.Mutex
+	store  RecordStore
+	serial uint32
+	loaded time.Time
+	names  map[string]bool
+}
+
+const faultNamesTTL = 5 * time.Second
+
+// lookupFaults gets the faults for the query's name
+func lookupFaults(ctx context.Context, store RecordStore, name string) ([]Fault, error) {
+	has, err := hasFaults(ctx, store, name)
+	if err != nil || !has {
+		return nil, err
+	}
+	return store.GetFaults(ctx, name)
+}
+
+func hasFaults(ctx context.Context, store RecordStore, name string) (bool, error) {
+	faultNames.Lock()
+	defer faultNames.Unlock()
+	if faultNames.store != store || faultNames.serial != soaSerial || time.Since(faultNames.loaded) > faultNamesTTL {
+		serial := soaSerial
+		names, err := store.GetFaultNames(ctx)
+		if err != nil {
+			return false, err
+		}
+		faultNames.names = make(map[string]bool, len(names))
+		for _, name := range names {
+			faultNames.names[name] = true
+		}
+		faultNames.store = store
+		faultNames.serial = serial
+		faultNames.loaded = time.Now()
+	}
+	return faultNames.names[name], nil
+}
+
+type Fault struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	DelayMs int    `json:"delay_ms,omitempty"`
+	// how often the fault happens, from 1 to 100
+	Percent int `json:"percent"`
+}
+
+func validateFault(fault *Fault) error {
+	if _, ok := faultKinds[fault.Kind]; !ok {
+		return fmt.Errorf("unknown fault '%s'", fault.Kind)
+	}
+	if fault.Kind == FaultDelay && (fault.DelayMs <= 0 || fault.DelayMs > maxFaultDelay) {
+		return fmt.Errorf("delay must be between 1 and %d ms", maxFaultDelay)
+	}
+	if fault.Kind != FaultDelay && fault.DelayMs != 0 {
+		return fmt.Errorf("only delay faults take a delay")
+	}
+	if fault.Percent < 1 || fault.Percent > 100 {
+		return fmt.Errorf("percent must be between 1 and 100")
+	}
+	return nil
+}
+
+// injection is what the faults that fired for a query want done with it
+type injection struct {
+	fired   map[string][]Fault
+	applied []string
+	drop    bool
+	delay   time.Duration
+}
+
+// faults that replace the response go first, so the ones that tweak it
+// tweak the replacement
+var faultOrder = []string{
+	FaultServfail,
+	FaultRefused,
+	FaultTruncate,
+	FaultWrongID,
+	FaultNonAuthoritative,
+	FaultDelay,
+	FaultDrop,
+}
+
+// injectFaults rolls the dice for each fault and applies the ones that fire
+// to the response. Dropping and delaying are left to the caller.
+func injectFaults(faults []Fault, request *dns.Msg, msg *dns.Msg, udp bool) (*dns.Msg, injection) {
+	inj := rollFaults(faults)
+	return inj.apply(request, msg, udp), inj
+}
+
+// rollFaults rolls the dice for each fault, before there's a response to
+// apply them to
+func rollFaults(faults []Fault) injection {
+	fired := make(map[string][]Fault)
+	for _, fault := range faults {
+		if rand.Intn(100) < fault.Percent {
+			fired[fault.Kind] = append(fired[fault.Kind], fault)
+		}
+	}
+	return injection{fired: fired}
+}
+
+// replacesAnswer says whether the real answer won't be sent at all, so that
+// there's no need to work it out, and count the query for behaviors and
+// orderings when the resolver never sees the answer
+func (inj injection) replacesAnswer() bool {
+	return len(inj.fired[FaultServfail]) > 0 ||
+		len(inj.fired[FaultRefused]) > 0 ||
+		len(inj.fired[FaultDrop]) > 0
+}
+
+// apply applies the faults that fired to the response
+func (inj *injection) apply(request *dns.Msg, msg *dns.Msg, udp bool) *dns.Msg {
+	for _, kind := range faultOrder {
+		if len(inj.fired[kind]) == 0 {
+			continue
+		}
+		switch kind {
+		case FaultServfail:
+			msg = errorResponse(request)
+		case FaultRefused:
+			msg = refusedResponse(request)
+		case FaultTruncate:
+			// truncating over TCP would leave the resolver nowhere to go
+			if !udp {
+				continue
+			}
+			msg.Truncated = true
+			msg.Answer = nil
+		case FaultWrongID:
+			msg.Id = request.Id + 1
+		case FaultNonAuthoritative:
+			msg.Authoritative = false
+		case FaultDelay:
+			// only the longest one, so that adding more delays can't hold
+			// a query for longer than maxFaultDelay
+			for _, fault := range inj.fired[kind] {
+				inj.delay = max(inj.delay, time.Duration(fault.DelayMs)*time.Millisecond)
+			}
+		case FaultDrop:
+			inj.drop = true
+		}
+		inj.applied = append(inj.applied, kind)
+	}
+	return msg
+}
+
+// wait holds the query for the delay, or until ctx is done. It says whether
+// the whole delay passed.
+func (inj injection) wait(ctx context.Context) bool {
+	if inj.delay <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(inj.delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
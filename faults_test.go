@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeResponse(request *dns.Msg) *dns.Msg {
+	return successResponse(request, []dns.RR{makeA("test.flatbo.at.", "192.0.2.1")})
+}
+
+func TestInjectFaults(t *testing.T) {
+	request := makeQuestion("test.flatbo.at.", dns.TypeA)
+	request.Id = 42
+	faults := []Fault{
+		{Kind: FaultWrongID, Percent: 100},
+		{Kind: FaultServfail, Percent: 100},
+		{Kind: FaultDelay, DelayMs: 10, Percent: 100},
+	}
+	msg, inj := injectFaults(faults, request, makeResponse(request), true)
+	assert.Equal(t, dns.RcodeServerFailure, msg.Rcode)
+	// the ID is mangled even though the servfail replaced the response
+	assert.Equal(t, uint16(43), msg.Id)
+	assert.Equal(t, 10*time.Millisecond, inj.delay)
+	assert.False(t, inj.drop)
+	assert.Equal(t, []string{FaultServfail, FaultWrongID, FaultDelay}, inj.applied)
+}
+
+func TestFaultDelays(t *testing.T) {
+	request := makeQuestion("test.flatbo.at.", dns.TypeA)
+	var faults []Fault
+	for i := 0; i < 10; i++ {
+		faults = append(faults, Fault{Kind: FaultDelay, DelayMs: maxFaultDelay, Percent: 100})
+	}
+	faults = append(faults, Fault{Kind: FaultDelay, DelayMs: 10, Percent: 100})
+	// the delays don't add up
+	_, inj := injectFaults(faults, request, makeResponse(request), true)
+	assert.Equal(t, maxFaultDelay*time.Millisecond, inj.delay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, inj.wait(ctx))
+	assert.True(t, injection{delay: time.Millisecond}.wait(context.Background()))
+	assert.True(t, injection{}.wait(ctx))
+}
+
+func TestTruncateOnlyOverUDP(t *testing.T) {
+	request := makeQuestion("test.flatbo.at.", dns.TypeA)
+	faults := []Fault{{Kind: FaultTruncate, Percent: 100}}
+
+	msg, inj := injectFaults(faults, request, makeResponse(request), true)
+	assert.True(t, msg.Truncated)
+	assert.Equal(t, 0, len(msg.Answer))
+	assert.Equal(t, []string{FaultTruncate}, inj.applied)
+
+	msg, inj = injectFaults(faults, request, makeResponse(request), false)
+	assert.False(t, msg.Truncated)
+	assert.Equal(t, 1, len(msg.Answer))
+	assert.Nil(t, inj.applied)
+}
+
+func TestDroppedQueryDoesntCount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "faults"))
+	assert.Nil(t, store.InsertBehavior(ctx, Behavior{Name: "count.faults.flatbo.at.", Kind: BehaviorCounter, TTL: 60}))
+	assert.Nil(t, store.InsertFault(ctx, Fault{Name: "count.faults.flatbo.at.", Kind: FaultDrop, Percent: 100}))
+	forgetOldCounts(time.Now().Add(time.Hour))
+	handle := &handler{records: store, requests: store}
+	request := makeQuestion("count.faults.flatbo.at.", dns.TypeTXT)
+
+	for i := 0; i < 3; i++ {
+		_, inj := handle.respond(ctx, request, makeClient(), true)
+		assert.True(t, inj.drop)
+	}
+	faults, err := store.GetFaultsForName(ctx, "faults")
+	assert.Nil(t, err)
+	assert.Nil(t, store.DeleteFault(ctx, "faults", faults[0].ID))
+
+	// the resolver never saw the dropped answers, so they didn't count
+	msg, inj := handle.respond(ctx, request, makeClient(), true)
+	assert.False(t, inj.drop)
+	assert.Equal(t, []string{"1"}, msg.Answer[0].(*dns.TXT).Txt)
+}
+
+// faultCountingStore counts the trips to the database for faults
+type faultCountingStore struct {
+	RecordStore
+	lookups int
+}
+
+func (s *faultCountingStore) GetFaults(ctx context.Context, name string) ([]Fault, error) {
+	s.lookups++
+	return s.RecordStore.GetFaults(ctx, name)
+}
+
+func (s *faultCountingStore) GetFaultNames(ctx context.Context) ([]string, error) {
+	s.lookups++
+	return s.RecordStore.GetFaultNames(ctx)
+}
+
+func TestFaultLookups(t *testing.T) {
+	ctx := context.Background()
+	memory := newMemoryStore()
+	assert.Nil(t, memory.InsertSubdomain(ctx, "faults"))
+	assert.Nil(t, memory.InsertFault(ctx, Fault{Name: "slow.faults.flatbo.at.", Kind: FaultDelay, DelayMs: 10, Percent: 100}))
+	store := &faultCountingStore{RecordStore: memory}
+	handle := &handler{records: store, requests: memory}
+
+	// just the one trip for the names, and none for each query after that
+	for i := 0; i < 3; i++ {
+		_, inj := handle.respond(ctx, makeQuestion("fast.faults.flatbo.at.", dns.TypeA), makeClient(), true)
+		assert.Nil(t, inj.applied)
+	}
+	assert.Equal(t, 1, store.lookups)
+	_, inj := handle.respond(ctx, makeQuestion("slow.faults.flatbo.at.", dns.TypeA), makeClient(), true)
+	assert.Equal(t, []string{FaultDelay}, inj.applied)
+	assert.Equal(t, 2, store.lookups)
+}
+
+func TestValidateFault(t *testing.T) {
+	assert.Nil(t, validateFault(&Fault{Kind: FaultDrop, Percent: 50}))
+	assert.Nil(t, validateFault(&Fault{Kind: FaultDelay, DelayMs: 500, Percent: 100}))
+	assert.NotNil(t, validateFault(&Fault{Kind: FaultDelay, Percent: 100}))
+	assert.NotNil(t, validateFault(&Fault{Kind: FaultDrop, DelayMs: 500, Percent: 100}))
+	assert.NotNil(t, validateFault(&Fault{Kind: FaultDrop, Percent: 0}))
+	assert.NotNil(t, validateFault(&Fault{Kind: "explode", Percent: 100}))
+}
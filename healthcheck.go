@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+)
+
+const checkTimeout = 5 * time.Second
+
+// HealthCheck is a probe attached to a record. Once Threshold checks in a
+// row fail, the record stops being served until Threshold checks in a row
+// succeed again.
+type HealthCheck struct {
+	RecordID  int    `json:"-"`
+	Name      string `json:"-"`
+	Subdomain string `json:"-"`
+	Kind      string
+	// host:port for tcp checks, a URL for http checks
+	Target string
+	// seconds between checks
+	Interval  int
+	Threshold int
+}
+
+type healthState struct {
+	healthy bool
+	streak  int
+	lastRun time.Time
+}
+
+var health = struct {
+	sync.Mutex
+	m map[int]*healthState
+}{m: make(map[int]*healthState)}
+
+// checks aren't allowed to poke at our own network, except in tests
+var allowPrivateTargets = false
+
+func validateHealthCheck(check *HealthCheck) error {
+	switch check.Kind {
+	case CheckTCP:
+		if _, _, err := net.SplitHostPort(check.Target); err != nil {
+			return fmt.Errorf("tcp health check target must be host:port")
+		}
+	case CheckHTTP:
+		u, err := url.Parse(check.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http health check target must be an http(s) URL")
+		}
+	default:
+		return fmt.Errorf("unknown health check kind '%s'", check.Kind)
+	}
+	if check.Interval < 10 || check.Interval > 3600 {
+		return fmt.Errorf("health check interval must be between 10 and 3600 seconds")
+	}
+	if check.Threshold < 1 || check.Threshold > 10 {
+		return fmt.Errorf("health check threshold must be between 1 and 10")
+	}
+	return nil
+}
+
+// isHealthy reports whether a record should be served. Records that haven't
+// been checked yet get the benefit of the doubt.
+func isHealthy(id int) bool {
+	health.Lock()
+	defer health.Unlock()
+	state, ok := health.m[id]
+	return !ok || state.healthy
+}
+
+// filterHealthy leaves out records that failed their health checks. If that
+// leaves nothing, we fall back to the backup records, and if there aren't
+// any of those we'd rather answer with unhealthy records than with nothing.
+func filterHealthy(records []Record) []Record {
+	primary := make([]Record, 0)
+	backup := make([]Record, 0)
+	for _, record := range records {
+		if record.Backup {
+			if isHealthy(record.ID) {
+				backup = append(backup, record)
+			}
+		} else if isHealthy(record.ID) {
+			primary = append(primary, record)
+		}
+	}
+	if len(primary) > 0 {
+		return primary
+	}
+	if len(backup) > 0 {
+		return backup
+	}
+	nonBackup := make([]Record, 0)
+	for _, record := range records {
+		if !record.Backup {
+			nonBackup = append(nonBackup, record)
+		}
+	}
+	return nonBackup
+}
+
+func dialControl(network, address string, c syscall.RawConn) error {
+	if allowPrivateTargets {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("not allowed to connect to %s", host)
+	}
+	return nil
+}
+
+func runCheck(ctx context.Context, check HealthCheck) error {
+	dialer := &net.Dialer{Timeout: checkTimeout, Control: dialControl}
+	switch check.Kind {
+	case CheckTCP:
+		conn, err := dialer.DialContext(ctx, "tcp", check.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckHTTP:
+		client := &http.Client{
+			Timeout: checkTimeout,
+			// each check gets its own transport, so there's no pool of
+			// idle connections to keep around
+			Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+			// a redirect is an answer, that's healthy enough
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", check.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown health check kind '%s'", check.Kind)
+}
+
+// recordResult updates a record's health with the result of a check and
+// reports whether its health changed
+func recordResult(check HealthCheck, err error) bool {
+	health.Lock()
+	defer health.Unlock()
+	state, ok := health.m[check.RecordID]
+	if !ok {
+		state = &healthState{healthy: true}
+		health.m[check.RecordID] = state
+	}
+	// a streak is a run of results that disagree with the current health
+	if (err == nil) == state.healthy {
+		state.streak = 0
+		return false
+	}
+	state.streak++
+	if state.streak < check.Threshold {
+		return false
+	}
+	state.healthy = !state.healthy
+	state.streak = 0
+	return true
+}
+
+// claimDue reports whether a check is due to run, and if it is, marks it as
+// run so the next pass doesn't start it again while it's still going
+func claimDue(check HealthCheck, now time.Time) bool {
+	health.Lock()
+	defer health.Unlock()
+	state, ok := health.m[check.RecordID]
+	if !ok {
+		state = &healthState{healthy: true}
+		health.m[check.RecordID] = state
+	} else if now.Sub(state.lastRun) < time.Duration(check.Interval)*time.Second {
+		return false
+	}
+	state.lastRun = now
+	return true
+}
+
+// forgetRemovedChecks drops the state of records that don't have a check
+// anymore
+func forgetRemovedChecks(checks []HealthCheck) {
+	ids := make(map[int]bool)
+	for _, check := range checks {
+		ids[check.RecordID] = true
+	}
+	health.Lock()
+	defer health.Unlock()
+	for id := range health.m {
+		if !ids[id] {
+			delete(health.m, id)
+		}
+	}
+}
+
+func streamHealthChange(check HealthCheck, err error) {
+	x := map[string]interface{}{
+		"type":       "health",
+		"created_at": time.Now().Unix(),
+		"name":       check.Name,
+		"record_id":  check.RecordID,
+		"target":     check.Target,
+		"healthy":    err == nil,
+	}
+	if err != nil {
+		x["error"] = err.Error()
+	}
+	jsonString, err := json.Marshal(x)
+	if err != nil {
+		return
+	}
+	WriteToStreams(check.Subdomain, jsonString)
+}
+
+// runHealthChecks starts the checks that are due, adding them to running
+func runHealthChecks(ctx context.Context, store RecordStore, running *sync.WaitGroup) {
+	checks, err := store.GetHealthChecks(ctx)
+	if err != nil {
+		logger.Error("error getting health checks", "err", err)
+		return
+	}
+	forgetRemovedChecks(checks)
+	now := time.Now()
+	for _, check := range checks {
+		if !claimDue(check, now) {
+			continue
+		}
+		running.Add(1)
+		go func(check HealthCheck) {
+			defer running.Done()
+			err := runCheck(ctx, check)
+			if recordResult(check, err) {
+				streamHealthChange(check, err)
+			}
+		}(check)
+	}
+}
+
+func healthCheckLoop(ctx context.Context, store RecordStore) {
+	// the loop isn't done until its checks are, so shutdown waits for them
+	var running sync.WaitGroup
+	defer running.Wait()
+	for {
+		runHealthChecks(ctx, store, &running)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPCheck(t *testing.T) {
+	allowPrivateTargets = true
+	defer func() { allowPrivateTargets = false }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	check := HealthCheck{Kind: CheckTCP, Target: listener.Addr().String()}
+	assert.Nil(t, runCheck(context.Background(), check))
+
+	listener.Close()
+	assert.NotNil(t, runCheck(context.Background(), check))
+}
+
+func TestHTTPCheck(t *testing.T) {
+	allowPrivateTargets = true
+	defer func() { allowPrivateTargets = false }()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	check := HealthCheck{Kind: CheckHTTP, Target: server.URL}
+	assert.Nil(t, runCheck(context.Background(), check))
+
+	status = http.StatusServiceUnavailable
+	assert.NotNil(t, runCheck(context.Background(), check))
+}
+
+func TestHealthCheckLoopWaitsForChecks(t *testing.T) {
+	allowPrivateTargets = true
+	defer func() { allowPrivateTargets = false }()
+
+	started := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "loop"))
+	check := &HealthCheck{Kind: CheckHTTP, Target: server.URL, Interval: 10, Threshold: 1}
+	ids, err := store.ApplyRecordChanges(ctx, "loop", []RecordChange{
+		{Op: ChangeCreate, Record: makeA("www.loop.flatbo.at.", "192.0.2.1"), Options: RecordOptions{Weight: 1, HealthCheck: check}},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer forgetRemovedChecks(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan bool)
+	go func() {
+		healthCheckLoop(ctx, store)
+		close(done)
+	}()
+	<-started
+	cancel()
+	<-done
+	// the cancelled check finished, and failed, before the loop returned
+	assert.False(t, isHealthy(ids[0]))
+}
+
+func TestPrivateTargetsRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	check := HealthCheck{Kind: CheckTCP, Target: listener.Addr().String()}
+	assert.NotNil(t, runCheck(context.Background(), check))
+}
+
+func TestFailover(t *testing.T) {
+	check := HealthCheck{RecordID: 1001, Threshold: 2}
+	primary := Record{ID: 1001, RR: makeA("test.flatbo.at.", "1.1.1.1"), HealthCheck: &check}
+	backup := Record{ID: 1002, RR: makeA("test.flatbo.at.", "2.2.2.2"), Backup: true}
+	records := []Record{primary, backup}
+	defer forgetRemovedChecks(nil)
+
+	assert.Equal(t, []Record{primary}, filterHealthy(records))
+
+	// one failure isn't enough to go unhealthy
+	assert.False(t, recordResult(check, net.ErrClosed))
+	assert.Equal(t, []Record{primary}, filterHealthy(records))
+
+	assert.True(t, recordResult(check, net.ErrClosed))
+	assert.Equal(t, []Record{backup}, filterHealthy(records))
+
+	// without a backup we still answer with the unhealthy record
+	assert.Equal(t, []Record{primary}, filterHealthy([]Record{primary}))
+
+	assert.False(t, recordResult(check, nil))
+	assert.True(t, recordResult(check, nil))
+	assert.Equal(t, []Record{primary}, filterHealthy(records))
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	assert.Nil(t, validateHealthCheck(&HealthCheck{Kind: CheckTCP, Target: "192.0.2.1:80", Interval: 30, Threshold: 3}))
+	assert.NotNil(t, validateHealthCheck(&HealthCheck{Kind: CheckTCP, Target: "192.0.2.1", Interval: 30, Threshold: 3}))
+	assert.NotNil(t, validateHealthCheck(&HealthCheck{Kind: CheckHTTP, Target: "ftp://example.com", Interval: 30, Threshold: 3}))
+	assert.NotNil(t, validateHealthCheck(&HealthCheck{Kind: CheckHTTP, Target: "https://example.com", Interval: 1, Threshold: 3}))
+	assert.NotNil(t, validateHealthCheck(&HealthCheck{Kind: "icmp", Target: "192.0.2.1", Interval: 30, Threshold: 3}))
+}
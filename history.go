@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Every change to a record goes in the history, in the same transaction as
+// the change: who made it, the record before and after, and the serial
+// before and after. That's what these are built on:
+//
+//	GET /history                     the user's latest changes, newest first
+//	POST /history/<id>/undo          puts one change back
+//	POST /history/restore?at=<time>  puts the records back the way they were
+//
+// Undo and restore are changes like any other, so they're in the history
+// too, and can be undone.
+
+// actorRetention is who deleted records that got too old
+const actorRetention = "retention"
+
+// how many changes GET /history returns
+const historyShown = 100
+
+// HistoryEntry is one change to a record. Creates have no old value and
+// deletes no new one.
+type HistoryEntry struct {
+	ID           int          `json:"id"`
+	RecordID     int          `json:"record_id"`
+	Op           string       `json:"op"`
+	Actor        string       `json:"actor"`
+	Old          *RecordValue `json:"old,omitempty"`
+	New          *RecordValue `json:"new,omitempty"`
+	SerialBefore uint32       `json:"serial_before"`
+	SerialAfter  uint32       `json:"serial_after"`
+	CreatedAt    time.Time    `json:"created_at"`
+
+	subdomain string
+}
+
+// RecordValue is a record as it's kept in the history
+type RecordValue struct {
+	RR          string       `json:"rr"`
+	Weight      int          `json:"weight"`
+	Backup      bool         `json:"backup"`
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+func newRecordValue(record dns.RR, options RecordOptions) (*RecordValue, error) {
+	rr, err := FormatRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	value := &RecordValue{RR: rr, Weight: options.Weight, Backup: options.Backup}
+	if options.HealthCheck != nil {
+		// just the settings, not which record it's attached to
+		value.HealthCheck = &HealthCheck{
+			Kind:      options.HealthCheck.Kind,
+			Target:    options.HealthCheck.Target,
+			Interval:  options.HealthCheck.Interval,
+			Threshold: options.HealthCheck.Threshold,
+		}
+	}
+	return value, nil
+}
+
+func recordValue(record Record) (*RecordValue, error) {
+	return newRecordValue(record.RR, RecordOptions{Weight: record.Weight, Backup: record.Backup, HealthCheck: record.HealthCheck})
+}
+
+// change turns the value back into something ApplyRecordChanges takes
+func (value *RecordValue) change(op string, id int) (RecordChange, error) {
+	rr, err := ParsePresentation(value.RR)
+	if err != nil {
+		return RecordChange{}, err
+	}
+	return RecordChange{
+		Op:      op,
+		ID:      id,
+		Record:  rr,
+		Options: RecordOptions{Weight: value.Weight, Backup: value.Backup, HealthCheck: value.HealthCheck},
+	}, nil
+}
+
+// historyEntries is what a change to subdomain's records adds to the
+// history. id is the record's ID once it's been made, and old has the
+// records the change replaces or deletes.
+func historyEntries(subdomain string, change RecordChange, id int, old map[int]Record) ([]HistoryEntry, error) {
+	entry := HistoryEntry{RecordID: id, Op: change.Op, Actor: subdomain, subdomain: subdomain}
+	var err error
+	switch change.Op {
+	case ChangeCreate:
+		entry.New, err = newRecordValue(change.Record, change.Options)
+	case ChangeUpdate:
+		entry.Old, err = recordValue(old[id])
+		if err == nil {
+			entry.New, err = newRecordValue(change.Record, change.Options)
+		}
+	case ChangeDelete, ChangeReset:
+		return deletedEntries(subdomain, subdomain, old)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []HistoryEntry{entry}, nil
+}
+
+// deletedEntries is the history for deleting records
+func deletedEntries(subdomain string, actor string, records map[int]Record) ([]HistoryEntry, error) {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	entries := make([]HistoryEntry, 0, len(ids))
+	for _, id := range ids {
+		value, err := recordValue(records[id])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, HistoryEntry{RecordID: id, Op: ChangeDelete, Actor: actor, Old: value, subdomain: subdomain})
+	}
+	return entries, nil
+}
+
+// marshalValue is how values are stored, NULL for none
+func marshalValue(value *RecordValue) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+func unmarshalValue(text *string) (*RecordValue, error) {
+	if text == nil {
+		return nil, nil
+	}
+	var value RecordValue
+	err := json.Unmarshal([]byte(*text), &value)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func getHistory(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	entries, err := store.GetRecordHistory(r.Context(), username, time.Time{}, historyShown)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting history: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	jsonOutput, err := json.Marshal(entries)
+	if err != nil {
+		returnError(w, fmt.Errorf("error marshalling json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+// undoChange makes the change that reverses entry, as long as the record
+// hasn't changed again since
+func undoChange(entry HistoryEntry, current map[int]Record) (RecordChange, error) {
+	conflict := fmt.Errorf("record %d has changed since", entry.RecordID)
+	if entry.Op == ChangeDelete {
+		if _, ok := current[entry.RecordID]; ok {
+			return RecordChange{}, conflict
+		}
+		return entry.Old.change(ChangeCreate, 0)
+	}
+	record, ok := current[entry.RecordID]
+	if !ok {
+		return RecordChange{}, conflict
+	}
+	value, err := recordValue(record)
+	if err != nil {
+		return RecordChange{}, err
+	}
+	if !reflect.DeepEqual(value, entry.New) {
+		return RecordChange{}, conflict
+	}
+	if entry.Op == ChangeCreate {
+		return RecordChange{Op: ChangeDelete, ID: entry.RecordID}, nil
+	}
+	return entry.Old.change(ChangeUpdate, entry.RecordID)
+}
+
+func undoHistory(store RecordStore, username string, idString string, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		returnError(w, fmt.Errorf("invalid id: %s", idString), http.StatusBadRequest)
+		return
+	}
+	entry, err := store.GetHistoryEntry(r.Context(), username, id)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error getting change: %s", err.Error()), err)
+		return
+	}
+	serial, current, err := recordsAtSerial(r, store, username)
+	if err != nil {
+		returnError(w, err, http.StatusInternalServerError)
+		return
+	}
+	change, err := undoChange(entry, current)
+	if err != nil {
+		returnError(w, err, http.StatusConflict)
+		return
+	}
+	applyAtSerial(store, username, serial, []RecordChange{change}, w, r)
+}
+
+// restorePlan works out the changes that get the records back to how they
+// were before entries, which are newest first
+func restorePlan(serial uint32, current map[int]Record, entries []HistoryEntry) (*ZonePlan, error) {
+	state := make(map[int]*RecordValue, len(current))
+	for id, record := range current {
+		value, err := recordValue(record)
+		if err != nil {
+			return nil, err
+		}
+		state[id] = value
+	}
+	for _, entry := range entries {
+		if entry.Op == ChangeCreate {
+			delete(state, entry.RecordID)
+		} else {
+			state[entry.RecordID] = entry.Old
+		}
+	}
+
+	plan := &ZonePlan{Serial: serial, Add: []PlanEntry{}, Change: []PlanEntry{}, Delete: []PlanEntry{}, Warnings: []string{}}
+	var ids []int
+	for id := range current {
+		ids = append(ids, id)
+	}
+	for id := range state {
+		if _, ok := current[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		record, exists := current[id]
+		value, wanted := state[id]
+		var change RecordChange
+		var err error
+		switch {
+		case exists && !wanted:
+			plan.Delete = append(plan.Delete, PlanEntry{ID: id, Old: record.RR.String()})
+			change = RecordChange{Op: ChangeDelete, ID: id}
+		case !exists:
+			// it gets a new ID
+			plan.Add = append(plan.Add, PlanEntry{Record: value.RR})
+			change, err = value.change(ChangeCreate, 0)
+		default:
+			var have *RecordValue
+			have, err = recordValue(record)
+			if err != nil {
+				return nil, err
+			}
+			if reflect.DeepEqual(have, value) {
+				continue
+			}
+			plan.Change = append(plan.Change, PlanEntry{ID: id, Record: value.RR, Old: have.RR})
+			change, err = value.change(ChangeUpdate, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.changes = append(plan.changes, change)
+	}
+	return plan, nil
+}
+
+func restoreHistory(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		returnError(w, fmt.Errorf("at must be a time like 2006-01-02T15:04:05Z: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if at.Before(time.Now().Add(-cfg.HistoryRetention.Duration)) {
+		returnError(w, fmt.Errorf("the history only goes back %s", cfg.HistoryRetention.Duration), http.StatusBadRequest)
+		return
+	}
+	serial, current, err := recordsAtSerial(r, store, username)
+	if err != nil {
+		returnError(w, err, http.StatusInternalServerError)
+		return
+	}
+	entries, err := store.GetRecordHistory(r.Context(), username, at, 0)
+	if err != nil {
+		returnError(w, fmt.Errorf("error getting history: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	plan, err := restorePlan(serial, current, entries)
+	if err != nil {
+		returnError(w, fmt.Errorf("error restoring records: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !applyAtSerial(store, username, serial, plan.changes, w, r) {
+		return
+	}
+	jsonOutput, err := json.Marshal(plan)
+	if err != nil {
+		returnError(w, fmt.Errorf("error marshalling json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+// recordsAtSerial gets the user's records along with their zone's serial
+// from before they were read, for applyAtSerial
+func recordsAtSerial(r *http.Request, store RecordStore, username string) (uint32, map[int]Record, error) {
+	serial, err := store.GetZoneSerial(r.Context(), username)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error getting serial: %s", err.Error())
+	}
+	records, err := store.GetRecordsForName(r.Context(), username)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error getting records: %s", err.Error())
+	}
+	return serial, records, nil
+}
+
+// applyAtSerial makes the changes unless the user's records changed since
+// serial, and says whether it worked
+func applyAtSerial(store RecordStore, username string, serial uint32, changes []RecordChange, w http.ResponseWriter, r *http.Request) bool {
+	if len(changes) == 0 {
+		return true
+	}
+	changes = append([]RecordChange{{Op: ChangeCheckZoneSerial, Serial: serial}}, changes...)
+	_, err := store.ApplyRecordChanges(r.Context(), username, changes)
+	if errors.Is(err, errSerialChanged) {
+		returnError(w, fmt.Errorf("the records changed in the meantime, try again"), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		returnError(w, fmt.Errorf("error saving records: %s", err.Error()), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreRecordHistory(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ids, err := store.ApplyRecordChanges(ctx, "store", []RecordChange{
+				{Op: ChangeCreate, Record: makeA("www.store.flatbo.at.", "192.0.2.1"), Options: defaultOptions()},
+			})
+			assert.Nil(t, err)
+			id := ids[0]
+			assert.Nil(t, store.UpdateRecord(ctx, "store", id, makeA("www.store.flatbo.at.", "192.0.2.2"), RecordOptions{Weight: 3}))
+			assert.Nil(t, store.DeleteRecord(ctx, "store", id))
+			// nothing's kept for changes that fail
+			assert.ErrorIs(t, store.DeleteRecord(ctx, "store", id), errNotFound)
+
+			history, err := store.GetRecordHistory(ctx, "store", time.Time{}, 0)
+			assert.Nil(t, err)
+			assert.Len(t, history, 3)
+			deleted, updated, created := history[0], history[1], history[2]
+			assert.Equal(t, ChangeCreate, created.Op)
+			assert.Equal(t, "store", created.Actor)
+			assert.Equal(t, id, created.RecordID)
+			assert.Nil(t, created.Old)
+			assert.Equal(t, "www.store.flatbo.at.\t0\tIN\tA\t192.0.2.1", created.New.RR)
+			assert.Equal(t, created.SerialBefore+1, created.SerialAfter)
+
+			assert.Equal(t, ChangeUpdate, updated.Op)
+			assert.Equal(t, created.New, updated.Old)
+			assert.Equal(t, &RecordValue{RR: "www.store.flatbo.at.\t0\tIN\tA\t192.0.2.2", Weight: 3}, updated.New)
+			assert.Equal(t, created.SerialAfter, updated.SerialBefore)
+
+			assert.Equal(t, ChangeDelete, deleted.Op)
+			assert.Equal(t, updated.New, deleted.Old)
+			assert.Nil(t, deleted.New)
+
+			history, err = store.GetRecordHistory(ctx, "store", time.Time{}, 1)
+			assert.Nil(t, err)
+			assert.Equal(t, []HistoryEntry{deleted}, history)
+			history, err = store.GetRecordHistory(ctx, "store", time.Now().Add(-time.Hour), 2)
+			assert.Nil(t, err)
+			assert.Equal(t, []HistoryEntry{deleted, updated}, history)
+			history, err = store.GetRecordHistory(ctx, "store", time.Now().Add(time.Hour), 0)
+			assert.Nil(t, err)
+			assert.Empty(t, history)
+			history, err = store.GetRecordHistory(ctx, "nobody", time.Time{}, 0)
+			assert.Nil(t, err)
+			assert.Empty(t, history)
+			entry, err := store.GetHistoryEntry(ctx, "store", updated.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, updated, entry)
+			_, err = store.GetHistoryEntry(ctx, "nobody", updated.ID)
+			assert.ErrorIs(t, err, errNotFound)
+
+			// records that get too old are in the history too
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("old.store.flatbo.at.", "192.0.2.3"), defaultOptions()))
+			assert.Nil(t, store.DeleteOldRecords(ctx, -time.Hour))
+			history, err = store.GetRecordHistory(ctx, "store", time.Time{}, 1)
+			assert.Nil(t, err)
+			assert.Equal(t, ChangeDelete, history[0].Op)
+			assert.Equal(t, actorRetention, history[0].Actor)
+			assert.Equal(t, "old.store.flatbo.at.\t0\tIN\tA\t192.0.2.3", history[0].Old.RR)
+
+			assert.Nil(t, store.DeleteOldHistory(ctx, -time.Hour))
+			history, err = store.GetRecordHistory(ctx, "store", time.Time{}, 0)
+			assert.Nil(t, err)
+			assert.Empty(t, history)
+		})
+	}
+}
+
+func TestUndoAndRestore(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	assert.Nil(t, store.InsertSubdomain(ctx, "bob"))
+	aRecord := func(name string) string {
+		records, err := store.GetRecordsForName(ctx, "alice")
+		assert.Nil(t, err)
+		for _, record := range records {
+			if record.RR.Header().Name == name {
+				return record.RR.(*dns.A).A.String()
+			}
+		}
+		return ""
+	}
+	getHistoryIDs := func(username string) []int {
+		w := httptest.NewRecorder()
+		getHistory(store, username, w, httptest.NewRequest("GET", "/history", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var entries []HistoryEntry
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		var ids []int
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	undo := func(username string, id int) int {
+		w := httptest.NewRecorder()
+		url := "/history/" + strconv.Itoa(id) + "/undo"
+		undoHistory(store, username, strconv.Itoa(id), w, httptest.NewRequest("POST", url, nil))
+		return w.Code
+	}
+	restore := func(at string) int {
+		w := httptest.NewRecorder()
+		restoreHistory(store, "alice", w, httptest.NewRequest("POST", "/history/restore?at="+at, nil))
+		return w.Code
+	}
+
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("www.alice.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	before := time.Now()
+	records, err := store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	for id := range records {
+		assert.Nil(t, store.UpdateRecord(ctx, "alice", id, makeA("www.alice.flatbo.at.", "192.0.2.2"), defaultOptions()))
+	}
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("api.alice.flatbo.at.", "192.0.2.3"), defaultOptions()))
+	ids := getHistoryIDs("alice")
+	assert.Len(t, ids, 3)
+	assert.Empty(t, getHistoryIDs("bob"))
+
+	// undoing the update puts the old address back, once
+	assert.Equal(t, http.StatusNotFound, undo("bob", ids[1]))
+	assert.Equal(t, http.StatusOK, undo("alice", ids[1]))
+	assert.Equal(t, "192.0.2.1", aRecord("www.alice.flatbo.at."))
+	assert.Equal(t, http.StatusConflict, undo("alice", ids[1]))
+	// and the undo can be undone
+	assert.Equal(t, http.StatusOK, undo("alice", getHistoryIDs("alice")[0]))
+	assert.Equal(t, "192.0.2.2", aRecord("www.alice.flatbo.at."))
+
+	assert.Equal(t, http.StatusOK, restore(before.Format(time.RFC3339Nano)))
+	assert.Equal(t, "192.0.2.1", aRecord("www.alice.flatbo.at."))
+	assert.Equal(t, "", aRecord("api.alice.flatbo.at."))
+
+	// a deleted record comes back with a new ID
+	restored := time.Now()
+	records, err = store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	for id := range records {
+		assert.Nil(t, store.DeleteRecord(ctx, "alice", id))
+	}
+	assert.Equal(t, http.StatusOK, restore(restored.Format(time.RFC3339Nano)))
+	assert.Equal(t, "192.0.2.1", aRecord("www.alice.flatbo.at."))
+
+	assert.Equal(t, http.StatusBadRequest, restore("yesterday"))
+	assert.Equal(t, http.StatusBadRequest, restore(time.Now().Add(-30*24*time.Hour).Format(time.RFC3339)))
+}
+
+// pruningStore prunes the history while an undo is working, and slips in a
+// change of someone else's between reading the serial and the records
+type pruningStore struct {
+	RecordStore
+	raced bool
+}
+
+func (s *pruningStore) GetHistoryEntry(ctx context.Context, subdomain string, id int) (HistoryEntry, error) {
+	entry, err := s.RecordStore.GetHistoryEntry(ctx, subdomain, id)
+	if err != nil {
+		return entry, err
+	}
+	return entry, s.RecordStore.DeleteOldHistory(ctx, -time.Hour)
+}
+
+func (s *pruningStore) GetRecordsForName(ctx context.Context, subdomain string) (map[int]Record, error) {
+	if !s.raced {
+		s.raced = true
+		err := s.RecordStore.InsertRecord(ctx, subdomain, makeA("raced."+subdomain+".flatbo.at.", "192.0.2.9"), defaultOptions())
+		if err != nil {
+			return nil, err
+		}
+		err = s.RecordStore.DeleteOldHistory(ctx, -time.Hour)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.RecordStore.GetRecordsForName(ctx, subdomain)
+}
+
+func TestUndoAfterPruning(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ids, err := store.ApplyRecordChanges(ctx, "store", []RecordChange{
+				{Op: ChangeCreate, Record: makeA("www.store.flatbo.at.", "192.0.2.1"), Options: defaultOptions()},
+			})
+			assert.Nil(t, err)
+			history, err := store.GetRecordHistory(ctx, "store", time.Time{}, 0)
+			assert.Nil(t, err)
+			assert.Len(t, history, 1)
+
+			// the serial undo read is stale even though there's no history
+			// left to show it
+			w := httptest.NewRecorder()
+			id := strconv.Itoa(history[0].ID)
+			undoHistory(&pruningStore{RecordStore: store}, "store", id, w, httptest.NewRequest("POST", "/history/"+id+"/undo", nil))
+			assert.Equal(t, http.StatusConflict, w.Code)
+			records, err := store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Contains(t, records, ids[0])
+			assert.Len(t, records, 2)
+		})
+	}
+}
@@ -31,12 +31,12 @@ func parseInt(s string) int {
 	return i
 }
 
-func ReadRanges() (Ranges, error) {
-	ipv4Ranges, err := ReadASNs("ip2asn-v4.tsv")
+func ReadRanges(ipv4File string, ipv6File string) (Ranges, error) {
+	ipv4Ranges, err := ReadASNs(ipv4File)
 	if err != nil {
 		return Ranges{}, err
 	}
-	ipv6Ranges, err := ReadASNs("ip2asn-v6.tsv")
+	ipv6Ranges, err := ReadASNs(ipv6File)
 	if err != nil {
 		return Ranges{}, err
 	}
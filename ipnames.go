@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names like 10-0-0-5.alice.flatbo.at. resolve to the IP in them, if alice
+// turned on ip_names. These all mean 10.0.0.5:
+//
+//	10-0-0-5.alice.flatbo.at.
+//	10.0.0.5.alice.flatbo.at.
+//	0a000005.alice.flatbo.at.
+//	app.10-0-0-5.alice.flatbo.at.
+//
+// and IPv6 addresses work with dashes instead of colons (2001-db8--1) or as
+// 32 hex digits.
+
+const ipNameTTL = 60
+
+// parseIPName finds the IP encoded in the labels right before the subdomain
+func parseIPName(name string) net.IP {
+	if !strings.HasSuffix(name, ".flatbo.at.") {
+		return nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, ".flatbo.at."))
+	// the last label is the subdomain
+	if len(labels) < 2 {
+		return nil
+	}
+	labels = labels[:len(labels)-1]
+	if len(labels) >= 4 {
+		dotted := strings.Join(labels[len(labels)-4:], ".")
+		if ip := net.ParseIP(dotted); ip != nil && ip.To4() != nil {
+			return ip
+		}
+	}
+	return parseIPLabel(labels[len(labels)-1])
+}
+
+func parseIPLabel(label string) net.IP {
+	label = strings.ToLower(label)
+	if strings.Count(label, "-") == 3 {
+		if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil {
+			return ip
+		}
+	}
+	if strings.Contains(label, "-") {
+		if ip := net.ParseIP(strings.ReplaceAll(label, "-", ":")); ip != nil {
+			return ip
+		}
+	}
+	if len(label) == 2*net.IPv4len || len(label) == 2*net.IPv6len {
+		if b, err := hex.DecodeString(label); err == nil {
+			return net.IP(b)
+		}
+	}
+	return nil
+}
+
+func ipNameRecords(name string, qtype uint16, ip net.IP) []dns.RR {
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ipNameTTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != dns.TypeA {
+			return []dns.RR{}
+		}
+		hdr.Rrtype = dns.TypeA
+		return []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+	}
+	if qtype != dns.TypeAAAA {
+		return []dns.RR{}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+}
+
+// synthesizedRecords answers for names with an IP in them. The int it
+// returns counts the synthesized name as existing even if there's nothing
+// of the requested type, so that we answer NODATA rather than NXDOMAIN.
+func synthesizedRecords(ctx context.Context, store RecordStore, name string, qtype uint16) ([]dns.RR, int, error) {
+	ip := parseIPName(name)
+	if ip == nil {
+		return nil, 0, nil
+	}
+	settings, err := store.GetSettings(ctx, ExtractSubdomain(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if !settings.IPNames {
+		return nil, 0, nil
+	}
+	return ipNameRecords(name, qtype, ip), 1, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPName(t *testing.T) {
+	for _, name := range []string{
+		"10-0-0-5.alice.flatbo.at.",
+		"10.0.0.5.alice.flatbo.at.",
+		"0a000005.alice.flatbo.at.",
+		"app.10-0-0-5.alice.flatbo.at.",
+		"app.10.0.0.5.alice.flatbo.at.",
+	} {
+		assert.Equal(t, "10.0.0.5", parseIPName(name).String(), name)
+	}
+	assert.Equal(t, "2001:db8::1", parseIPName("2001-db8--1.alice.flatbo.at.").String())
+	assert.Equal(
+		t,
+		"2001:db8::1",
+		parseIPName("20010db8000000000000000000000001.alice.flatbo.at.").String(),
+	)
+
+	assert.Nil(t, parseIPName("alice.flatbo.at."))
+	assert.Nil(t, parseIPName("www.alice.flatbo.at."))
+	assert.Nil(t, parseIPName("10-0-0-5.example.com."))
+	assert.Nil(t, parseIPName("300-0-0-5.alice.flatbo.at."))
+}
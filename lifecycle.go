@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+)
+
+type servers struct {
+	udp  *dns.Server
+	tcp  *dns.Server
+	http *http.Server
+	// metrics
+	admin *http.Server
+}
+
+// start starts all the listeners. Any of them failing ends up on the
+// returned channel.
+func (s *servers) start() <-chan error {
+	errs := make(chan error, 4)
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		srv := srv
+		logger.Info("listening", "net", srv.Net, "addr", srv.Addr)
+		notify := srv.NotifyStartedFunc
+		srv.NotifyStartedFunc = func() {
+			probes.setListening(srv.Net, true)
+			if notify != nil {
+				notify()
+			}
+		}
+		go func() {
+			err := srv.ListenAndServe()
+			probes.setListening(srv.Net, false)
+			if err != nil {
+				errs <- fmt.Errorf("failed to set %s listener: %s", srv.Net, err.Error())
+			}
+		}()
+	}
+	for _, srv := range []*http.Server{s.http, s.admin} {
+		srv := srv
+		logger.Info("listening", "net", "http", "addr", srv.Addr)
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				errs <- fmt.Errorf("failed to start http listener on %s: %s", srv.Addr, err.Error())
+			}
+		}()
+	}
+	return errs
+}
+
+// shutdown stops accepting queries and requests, lets the ones in flight
+// finish (including writing them to the request log), hangs up the request
+// streams, waits for the background loops and closes the database, all
+// within the configured shutdown timeout.
+func shutdown(s *servers, loops *sync.WaitGroup, store Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	probes.setShuttingDown()
+
+	var wg sync.WaitGroup
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				logger.Error("error shutting down listener", "net", srv.Net, "err", err)
+			}
+		}(srv)
+	}
+	for _, srv := range []*http.Server{s.http, s.admin} {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("error shutting down listener", "net", "http", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	// websockets are hijacked, so the http server doesn't wait for them
+	CloseStreams()
+	waitFor(ctx, &streamConns, "request streams")
+	waitFor(ctx, loops, "background loops")
+
+	if err := store.Close(); err != nil {
+		logger.Error("error closing database", "err", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("error flushing traces", "err", err)
+	}
+	sentry.Flush(time.Second * 2)
+	logger.Info("shut down")
+}
+
+func waitFor(ctx context.Context, wg *sync.WaitGroup, what string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("gave up waiting", "for", what)
+	}
+}
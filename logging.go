@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Everything logs through logger: one JSON object per line, with errors
+// also going to Sentry when it's set up.
+
+// LogConfig is how verbose the logs are, what they look like (json or
+// text), and which fields are left out of them, e.g. ["remote", "subdomain"]
+type LogConfig struct {
+	Level  slog.Level `json:"level"`
+	Format string     `json:"format"`
+	Redact []string   `json:"redact"`
+}
+
+const redacted = "[redacted]"
+
+var logger = newLogger(os.Stderr, LogConfig{Level: slog.LevelInfo, Format: "json"})
+
+func newLogger(w io.Writer, config LogConfig) *slog.Logger {
+	redact := make(map[string]bool)
+	for _, field := range config.Redact {
+		redact[field] = true
+	}
+	options := &slog.HandlerOptions{
+		Level: config.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redact[a.Key] {
+				return slog.String(a.Key, redacted)
+			}
+			return a
+		},
+	}
+	var handler slog.Handler
+	if config.Format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	} else {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(&sentryHandler{Handler: handler, redact: redact})
+}
+
+// sentryHandler sends errors to Sentry on their way to the log, with the
+// rest of the fields as tags
+type sentryHandler struct {
+	slog.Handler
+	attrs  []slog.Attr
+	redact map[string]bool
+}
+
+func (h *sentryHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError && sentry.CurrentHub().Client() != nil {
+		h.capture(record)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *sentryHandler) capture(record slog.Record) {
+	var err error
+	tags := make(map[string]string)
+	addTag := func(a slog.Attr) bool {
+		if e, ok := a.Value.Any().(error); ok && err == nil {
+			err = e
+		} else if h.redact[a.Key] {
+			tags[a.Key] = redacted
+		} else {
+			tags[a.Key] = a.Value.String()
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		addTag(a)
+	}
+	record.Attrs(addTag)
+	if err == nil {
+		err = errors.New(record.Message)
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTags(tags)
+		scope.SetExtra("message", record.Message)
+	})
+	hub.CaptureException(err)
+}
+
+func (h *sentryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	all = append(all, h.attrs...)
+	all = append(all, attrs...)
+	return &sentryHandler{Handler: h.Handler.WithAttrs(attrs), attrs: all, redact: h.redact}
+}
+
+func (h *sentryHandler) WithGroup(name string) slog.Handler {
+	return &sentryHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs, redact: h.redact}
+}
+
+func newRequestID() string {
+	return randString(16)
+}
+
+// loggingWriter remembers the status and error of an HTTP response, so we
+// can log the whole request in one line once it's done
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets websockets through
+func (w *loggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response doesn't support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *loggingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func logHTTPRequest(r *http.Request, w *loggingWriter, id string, subdomain string, latency time.Duration) {
+	level := slog.LevelInfo
+	probe := r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+	switch {
+	// probes come every few seconds, and a failing one is for the
+	// orchestrator to act on. It'd be an Error, and so a Sentry event, on
+	// every poll for as long as the database is down.
+	case probe && w.status >= 500:
+		level = slog.LevelWarn
+	case probe:
+		level = slog.LevelDebug
+	case w.status >= 500:
+		level = slog.LevelError
+	case w.err != nil:
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("trace_id", traceID(r.Context())),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("subdomain", subdomain),
+		slog.Int("status", w.status),
+		slog.Duration("latency", latency),
+		slog.String("remote", r.RemoteAddr),
+	}
+	if w.err != nil {
+		attrs = append(attrs, slog.Any("err", w.err))
+	}
+	logger.LogAttrs(context.Background(), level, "http request", attrs...)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, LogConfig{Level: slog.LevelInfo, Format: "json", Redact: []string{"remote"}})
+	log.Info("dns request", "remote", "192.0.2.1", "qname", "example.flatbo.at.")
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "[redacted]", line["remote"])
+	assert.Equal(t, "example.flatbo.at.", line["qname"])
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, LogConfig{Level: slog.LevelWarn, Format: "json"})
+	log.Info("not logged")
+	assert.Equal(t, 0, buf.Len())
+	log.Warn("logged")
+	assert.Contains(t, buf.String(), "logged")
+}
+
+func TestSentrySink(t *testing.T) {
+	events := make([]*sentry.Event, 0)
+	err := sentry.Init(sentry.ClientOptions{
+		BeforeSend: func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+			events = append(events, event)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	defer sentry.CurrentHub().BindClient(nil)
+
+	var buf bytes.Buffer
+	log := newLogger(&buf, LogConfig{Level: slog.LevelInfo, Format: "json", Redact: []string{"subdomain"}})
+	log.Warn("not an error")
+	log.With("subdomain", "orange").Error("error getting records", "err", fmt.Errorf("oh no"), "qname", "a.orange.flatbo.at.")
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "oh no", events[0].Exception[0].Value)
+	assert.Equal(t, "[redacted]", events[0].Tags["subdomain"])
+	assert.Equal(t, "a.orange.flatbo.at.", events[0].Tags["qname"])
+}
+
+func TestReturnErrorLogsOnce(t *testing.T) {
+	lw := &loggingWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	returnError(lw, fmt.Errorf("you must be logged in"), http.StatusUnauthorized)
+	assert.Equal(t, http.StatusUnauthorized, lw.status)
+	assert.EqualError(t, lw.err, "you must be logged in")
+}
+
+func TestFailingProbeIsntAnError(t *testing.T) {
+	var buf bytes.Buffer
+	saved := logger
+	defer func() { logger = saved }()
+	logger = newLogger(&buf, LogConfig{Level: slog.LevelDebug, Format: "json"})
+
+	lw := &loggingWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusServiceUnavailable}
+	logHTTPRequest(httptest.NewRequest("GET", "/readyz", nil), lw, "1", "", 0)
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "WARN", line["level"])
+
+	buf.Reset()
+	logHTTPRequest(httptest.NewRequest("GET", "/records", nil), lw, "2", "", 0)
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "ERROR", line["level"])
+}
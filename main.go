@@ -1,79 +1,151 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
+	// .env is optional, and the real environment wins over it
 	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		panic(fmt.Sprintf("Error loading .env file: %s", err.Error()))
+	}
+	// mess-with-dns migrate [up|down|status] [flags]
+	args := os.Args[1:]
+	migrateCommand := ""
+	migrating := len(args) > 0 && args[0] == "migrate"
+	if migrating {
+		args = args[1:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			migrateCommand, args = args[0], args[1:]
+		}
+	}
+	config, printConfig, err := loadConfig(args, os.LookupEnv)
 	if err != nil {
-		panic("Error loading .env file")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	if printConfig {
+		jsonOutput, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+		fmt.Println(string(jsonOutput))
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%s\n", err)
+		os.Exit(1)
+	}
+	if printConfig {
+		return
+	}
+	cfg = config
+
+	logger = newLogger(os.Stderr, cfg.Log)
+	slog.SetDefault(logger)
 
-	if env := os.Getenv("SENTRY_DSN"); env != "" {
+	if cfg.SentryDSN != "" {
 		err := sentry.Init(sentry.ClientOptions{
-			Dsn: env,
+			Dsn: cfg.SentryDSN,
 		})
 		if err != nil {
-			log.Fatalf("sentry.Init: %s", err)
+			panic(fmt.Sprintf("sentry.Init: %s", err.Error()))
 		}
 	}
-	db, err := connect()
+	identity = cfg.Identity.withDefaults()
+	err = setupTracing(context.Background())
 	if err != nil {
-		panic(fmt.Sprintf("Error connecting to database: %s", err.Error()))
+		panic(fmt.Sprintf("Error setting up tracing: %s", err.Error()))
 	}
-	err = createTables(db)
+	// already checked by Validate
+	reverseZones, _ = parseReverseZones(cfg.ReverseZones)
+	if migrating {
+		store, err := openStore(context.Background(), cfg.DSN, false)
+		if err != nil {
+			panic(fmt.Sprintf("Error opening database: %s", err.Error()))
+		}
+		err = runMigrate(context.Background(), store, migrateCommand, os.Stdout)
+		store.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	store, err := openStore(context.Background(), cfg.DSN, cfg.Migrate)
 	if err != nil {
-		panic(fmt.Sprintf("Error creating tables: %s", err.Error()))
+		panic(fmt.Sprintf("Error opening database: %s", err.Error()))
 	}
-	go cleanup(db)
-	soaSerial, err = GetSerial(db)
+	soaSerial, err = store.GetSerial(context.Background())
 	if err != nil {
 		panic(fmt.Sprintf("Error getting SOA serial: %s", err.Error()))
 	}
-	defer db.Close()
-	ranges, err := ReadRanges()
+	ranges, err := ReadRanges(cfg.ASNv4File, cfg.ASNv6File)
 	if err != nil {
 		panic(fmt.Sprintf("Error reading ranges: %s", err.Error()))
 	}
-	handler := &handler{db: db, ipRanges: &ranges}
-	// udp port command line argument
-	port := ":53"
-	if len(os.Args) > 1 {
-		port = ":" + os.Args[1]
-	}
-	fmt.Println("Listening for UDP on port", port)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var loops sync.WaitGroup
+	loops.Add(2)
 	go func() {
-		srv := &dns.Server{Handler: handler, Addr: port, Net: "udp"}
-		if err := srv.ListenAndServe(); err != nil {
-			panic(fmt.Sprintf("Failed to set udp listener %s\n", err.Error()))
-		}
+		defer loops.Done()
+		cleanup(ctx, store)
 	}()
-	fmt.Println("Listening on :8080")
-	err = (&http.Server{Addr: ":8080", Handler: handler}).ListenAndServe()
-	if err != nil {
-		panic(fmt.Sprintf("Failed to start http listener %s\n", err.Error()))
+	go func() {
+		defer loops.Done()
+		healthCheckLoop(ctx, store)
+	}()
+
+	handler := &handler{records: store, requests: store, ipRanges: &ranges, shutdown: ctx}
+	servers := &servers{
+		udp: &dns.Server{Handler: handler, Addr: cfg.DNSAddr, Net: "udp"},
+		// resolvers retry truncated answers over TCP
+		tcp:   &dns.Server{Handler: handler, Addr: cfg.DNSAddr, Net: "tcp"},
+		http:  &http.Server{Addr: cfg.HTTPAddr, Handler: handler},
+		admin: &http.Server{Addr: cfg.AdminAddr, Handler: adminHandler()},
 	}
+	registerRecordCount(store)
+	errs := servers.start()
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+	case err := <-errs:
+		logger.Error("shutting down after listener failed", "err", err)
+	}
+	// a second signal kills us the usual way
+	stop()
+	shutdown(servers, &loops, store)
 }
 
 type handler struct {
-	db       *sql.DB
+	records  RecordStore
+	requests RequestLog
 	ipRanges *Ranges
+	// done once we start shutting down, so delayed answers stop waiting
+	shutdown context.Context
 }
 
 var soaSerial uint32
@@ -82,14 +154,19 @@ func makeDomain(name string) string {
 	return name + ".flatbo.at."
 }
 
+// returnError sends the error to the client, and hands it to the request's
+// log line, which reports it to Sentry if it's our fault
 func returnError(w http.ResponseWriter, err error, status int) {
-	fmt.Printf("Error [%d]: %s\n", status, err.Error())
-	sentry.CaptureException(err)
+	if lw, ok := w.(*loggingWriter); ok {
+		lw.err = err
+	} else {
+		logger.Error("http error", "status", status, "err", err)
+	}
 	http.Error(w, err.Error(), status)
 }
 
-func deleteRequests(db *sql.DB, name string, w http.ResponseWriter, r *http.Request) {
-	err := DeleteRequestsForDomain(db, name)
+func deleteRequests(requests RequestLog, name string, w http.ResponseWriter, r *http.Request) {
+	err := requests.DeleteRequestsForDomain(r.Context(), name)
 	if err != nil {
 		err := fmt.Errorf("error deleting requests: %s", err.Error())
 		returnError(w, err, http.StatusInternalServerError)
@@ -97,8 +174,8 @@ func deleteRequests(db *sql.DB, name string, w http.ResponseWriter, r *http.Requ
 	}
 }
 
-func getRequests(db *sql.DB, username string, w http.ResponseWriter, r *http.Request) {
-	requests, err := GetRequests(db, username)
+func getRequests(requestLog RequestLog, username string, w http.ResponseWriter, r *http.Request) {
+	requests, err := requestLog.GetRequests(r.Context(), username)
 	if err != nil {
 		err := fmt.Errorf("error getting requests: %s", err.Error())
 		returnError(w, err, http.StatusInternalServerError)
@@ -114,7 +191,17 @@ func getRequests(db *sql.DB, username string, w http.ResponseWriter, r *http.Req
 	w.Write(jsonOutput)
 }
 
-func streamRequests(db *sql.DB, subdomain string, w http.ResponseWriter, r *http.Request) {
+func streamRequests(subdomain string, w http.ResponseWriter, r *http.Request) {
+	// the stream comes first, so that shutting down knows to wait for us
+	// before the connection is hijacked
+	logger.Debug("creating stream", "subdomain", subdomain)
+	stream, ok := openStream(subdomain)
+	if !ok {
+		returnError(w, fmt.Errorf("server shutting down"), http.StatusServiceUnavailable)
+		return
+	}
+	defer streamConns.Done()
+	defer stream.Delete()
 	// create websocket connection
 	upgrader := websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -123,17 +210,22 @@ func streamRequests(db *sql.DB, subdomain string, w http.ResponseWriter, r *http
 		returnError(w, err, http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("creating stream", subdomain)
-	stream := CreateStream(subdomain)
-	defer stream.Delete()
-	c := stream.Get()
-	for {
-		msg := <-c
-		conn.WriteMessage(websocket.TextMessage, msg)
+	defer conn.Close()
+	for msg := range stream.Get() {
+		err := conn.WriteMessage(websocket.TextMessage, msg)
+		if err != nil {
+			return
+		}
 	}
+	// the stream only closes under us when we're shutting down
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+		time.Now().Add(time.Second),
+	)
 }
 
-func createRecord(db *sql.DB, username string, w http.ResponseWriter, r *http.Request) {
+func createRecord(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		err := fmt.Errorf("error reading body: %s", err.Error())
@@ -149,14 +241,23 @@ func createRecord(db *sql.DB, username string, w http.ResponseWriter, r *http.Re
 		}
 		return
 	}
-	if err = validateDomainName(rr.Header().Name, username); err != nil {
+	if err = validateRecordName(r.Context(), store, rr, username); err != nil {
 		returnError(w, err, http.StatusBadRequest)
 		return
 	}
-	InsertRecord(db, rr)
+	options, err := ParseRecordOptions(body)
+	if err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = store.InsertRecord(r.Context(), username, rr, options)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error inserting record: %s", err.Error()), err)
+		return
+	}
 }
 
-func deleteRecord(db *sql.DB, id string, w http.ResponseWriter, r *http.Request) {
+func deleteRecord(store RecordStore, username string, id string, w http.ResponseWriter, r *http.Request) {
 	// parse int from id
 	idInt, err := strconv.Atoi(id)
 	if err != nil {
@@ -164,10 +265,24 @@ func deleteRecord(db *sql.DB, id string, w http.ResponseWriter, r *http.Request)
 		returnError(w, err, http.StatusBadRequest)
 		return
 	}
-	DeleteRecord(db, idInt)
+	err = store.DeleteRecord(r.Context(), username, idInt)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error deleting record: %s", err.Error()), err)
+		return
+	}
 }
 
-func updateRecord(db *sql.DB, username string, id string, w http.ResponseWriter, r *http.Request) {
+// returnRecordError is a 404 for records that aren't the user's, so other
+// people's IDs look the same as ones that don't exist
+func returnRecordError(w http.ResponseWriter, err error, cause error) {
+	if errors.Is(cause, errNotFound) {
+		returnError(w, err, http.StatusNotFound)
+		return
+	}
+	returnError(w, err, http.StatusInternalServerError)
+}
+
+func updateRecord(store RecordStore, username string, id string, w http.ResponseWriter, r *http.Request) {
 	idInt, err := strconv.Atoi(id)
 	if err != nil {
 		returnError(w, fmt.Errorf("error parsing id: %s", err.Error()), http.StatusBadRequest)
@@ -187,15 +302,73 @@ func updateRecord(db *sql.DB, username string, id string, w http.ResponseWriter,
 		returnError(w, fmt.Errorf("error parsing record: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
-	if err = validateDomainName(rr.Header().Name, username); err != nil {
+	if err = validateRecordName(r.Context(), store, rr, username); err != nil {
 		returnError(w, err, http.StatusBadRequest)
 		return
 	}
-	UpdateRecord(db, idInt, rr)
+	options, err := ParseRecordOptions(body)
+	if err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = store.UpdateRecord(r.Context(), username, idInt, rr, options)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error updating record: %s", err.Error()), err)
+		return
+	}
 }
 
-func getDomains(db *sql.DB, username string, w http.ResponseWriter, r *http.Request) {
-	records, err := GetRecordsForName(db, username)
+func getPolicies(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	policies, err := store.GetPolicies(r.Context(), username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting policies: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	jsonOutput, err := json.Marshal(policies)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error marshalling json: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+func setPolicy(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	var policy Policy
+	err := json.NewDecoder(r.Body).Decode(&policy)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing policy: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err = validateDomainName(policy.Name, username); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err = validatePolicy(policy); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = store.SetPolicy(r.Context(), policy)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error saving policy: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+}
+
+func getDomains(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	records, err := store.GetRecordsForName(r.Context(), username)
 	if err != nil {
 		returnError(
 			w,
@@ -217,6 +390,211 @@ func getDomains(db *sql.DB, username string, w http.ResponseWriter, r *http.Requ
 	w.Write(jsonOutput)
 }
 
+func getBehaviors(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	behaviors, err := store.GetBehaviorsForName(r.Context(), username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting behaviors: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	jsonOutput, err := json.Marshal(behaviors)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error marshalling json: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+func createBehavior(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	behavior := Behavior{TTL: defaultBehaviorTTL}
+	err := json.NewDecoder(r.Body).Decode(&behavior)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing behavior: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err = validateDomainName(behavior.Name, username); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err = validateBehavior(&behavior); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = store.InsertBehavior(r.Context(), behavior)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error saving behavior: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+}
+
+func deleteBehavior(store RecordStore, username string, id string, w http.ResponseWriter, r *http.Request) {
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing id: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	err = store.DeleteBehavior(r.Context(), username, idInt)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error deleting behavior: %s", err.Error()), err)
+		return
+	}
+}
+
+func getFaults(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	faults, err := store.GetFaultsForName(r.Context(), username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting faults: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	jsonOutput, err := json.Marshal(faults)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error marshalling json: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+func createFault(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	fault := Fault{Percent: 100}
+	err := json.NewDecoder(r.Body).Decode(&fault)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing fault: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err = validateDomainName(fault.Name, username); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err = validateFault(&fault); err != nil {
+		returnError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = store.InsertFault(r.Context(), fault)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error saving fault: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+}
+
+func deleteFault(store RecordStore, username string, id string, w http.ResponseWriter, r *http.Request) {
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing id: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	err = store.DeleteFault(r.Context(), username, idInt)
+	if err != nil {
+		returnRecordError(w, fmt.Errorf("error deleting fault: %s", err.Error()), err)
+		return
+	}
+}
+
+func getReverseSlices(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	slices, err := userReverseSlices(r.Context(), store, username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting reverse slices: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	writeReverseSlices(slices, w)
+}
+
+func createReverseSlices(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	slices, err := allocateReverseSlices(r.Context(), store, username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error allocating reverse slices: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	writeReverseSlices(slices, w)
+}
+
+func writeReverseSlices(slices []string, w http.ResponseWriter) {
+	jsonOutput, err := json.Marshal(slices)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error marshalling json: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+func getSettings(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	settings, err := store.GetSettings(r.Context(), username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting settings: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	jsonOutput, err := json.Marshal(settings)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error marshalling json: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
+
+func setSettings(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	var settings Settings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		returnError(w, fmt.Errorf("error parsing settings: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	err = store.SetSettings(r.Context(), username, settings)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error saving settings: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+}
+
 func requireLogin(username string, w http.ResponseWriter) bool {
 	w.Header().Set("Cache-Control", "no-store")
 	if username == "" {
@@ -231,68 +609,213 @@ func requireLogin(username string, w http.ResponseWriter) bool {
 }
 
 func (handle *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Request:", r.URL.Path)
+	start := time.Now()
+	id := newRequestID()
+	lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
+	w = lw
+	w.Header().Set("X-Request-Id", id)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
 	username, _ := ReadSessionUsername(r)
 
 	p := strings.Split(r.URL.Path, "/")[1:]
 	n := len(p)
+	// spans are named after the handler's route, e.g. "DELETE /record"
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(
+		ctx,
+		r.Method+" /"+p[0],
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+	r = r.WithContext(ctx)
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", lw.status))
+		if lw.status >= 500 {
+			recordError(span, lw.err)
+		}
+		span.End()
+		logHTTPRequest(r, lw, id, username, time.Since(start))
+	}()
 	switch {
 	// GET /domains: get everything from USERNAME.flatbo.at.
 	case r.Method == "GET" && p[0] == "domains":
 		if !requireLogin(username, w) {
 			return
 		}
-		getDomains(handle.db, username, w, r)
+		getDomains(handle.records, username, w, r)
 	// GET /requests
 	case r.Method == "GET" && p[0] == "requests":
 		if !requireLogin(username, w) {
 			return
 		}
-		getRequests(handle.db, username, w, r)
+		getRequests(handle.requests, username, w, r)
 	// DELETE /requests
 	case r.Method == "DELETE" && p[0] == "requests":
 		if !requireLogin(username, w) {
 			return
 		}
-		deleteRequests(handle.db, username, w, r)
+		deleteRequests(handle.requests, username, w, r)
 	// GET /requeststream
 	case r.Method == "GET" && p[0] == "requeststream":
 		if !requireLogin(username, w) {
 			return
 		}
-		streamRequests(handle.db, username, w, r)
+		streamRequests(username, w, r)
 	// POST /record/new: add a new record
 	case r.Method == "POST" && n == 2 && p[0] == "record" && p[1] == "new":
 		if !requireLogin(username, w) {
 			return
 		}
-		createRecord(handle.db, username, w, r)
+		createRecord(handle.records, username, w, r)
 	// DELETE /record/<ID>:
 	case r.Method == "DELETE" && n == 2 && p[0] == "record":
 		if !requireLogin(username, w) {
 			return
 		}
-		// TODO: don't let people delete other people's records
-		deleteRecord(handle.db, p[1], w, r)
+		deleteRecord(handle.records, username, p[1], w, r)
 	// POST /record/<ID>: updates a record
 	case r.Method == "POST" && n == 2 && p[0] == "record":
 		if !requireLogin(username, w) {
 			return
 		}
-		updateRecord(handle.db, username, p[1], w, r)
+		updateRecord(handle.records, username, p[1], w, r)
+	// POST /records/batch: several changes to records at once
+	case r.Method == "POST" && n == 2 && p[0] == "records" && p[1] == "batch":
+		if !requireLogin(username, w) {
+			return
+		}
+		batchRecords(handle.records, username, w, r)
+	// GET /zone: the user's records as a zone file
+	case r.Method == "GET" && n == 1 && p[0] == "zone":
+		if !requireLogin(username, w) {
+			return
+		}
+		getZone(handle.records, username, w, r)
+	// POST /zone: add the records in a zone file
+	case r.Method == "POST" && n == 1 && p[0] == "zone":
+		if !requireLogin(username, w) {
+			return
+		}
+		postZone(handle.records, username, w, r)
+	// PUT /zone: plan (or, with ?serial=, apply) replacing the user's records with a zone file
+	case r.Method == "PUT" && n == 1 && p[0] == "zone":
+		if !requireLogin(username, w) {
+			return
+		}
+		putZone(handle.records, username, w, r)
+	// GET /history: changes to the user's records, newest first
+	case r.Method == "GET" && n == 1 && p[0] == "history":
+		if !requireLogin(username, w) {
+			return
+		}
+		getHistory(handle.records, username, w, r)
+	// POST /history/restore?at=<time>: put the user's records back the way they were
+	case r.Method == "POST" && n == 2 && p[0] == "history" && p[1] == "restore":
+		if !requireLogin(username, w) {
+			return
+		}
+		restoreHistory(handle.records, username, w, r)
+	// POST /history/<id>/undo: undo one change
+	case r.Method == "POST" && n == 3 && p[0] == "history" && p[2] == "undo":
+		if !requireLogin(username, w) {
+			return
+		}
+		undoHistory(handle.records, username, p[1], w, r)
+	// GET /policies: answer ordering for the user's names
+	case r.Method == "GET" && n == 1 && p[0] == "policies":
+		if !requireLogin(username, w) {
+			return
+		}
+		getPolicies(handle.records, username, w, r)
+	// POST /policy: set the answer ordering for a name
+	case r.Method == "POST" && n == 1 && p[0] == "policy":
+		if !requireLogin(username, w) {
+			return
+		}
+		setPolicy(handle.records, username, w, r)
+	// GET /behaviors: dynamic records in the user's subdomain
+	case r.Method == "GET" && n == 1 && p[0] == "behaviors":
+		if !requireLogin(username, w) {
+			return
+		}
+		getBehaviors(handle.records, username, w, r)
+	// POST /behavior/new
+	case r.Method == "POST" && n == 2 && p[0] == "behavior" && p[1] == "new":
+		if !requireLogin(username, w) {
+			return
+		}
+		createBehavior(handle.records, username, w, r)
+	// DELETE /behavior/<ID>
+	case r.Method == "DELETE" && n == 2 && p[0] == "behavior":
+		if !requireLogin(username, w) {
+			return
+		}
+		deleteBehavior(handle.records, username, p[1], w, r)
+	// GET /faults: fault injection in the user's subdomain
+	case r.Method == "GET" && n == 1 && p[0] == "faults":
+		if !requireLogin(username, w) {
+			return
+		}
+		getFaults(handle.records, username, w, r)
+	// POST /fault/new
+	case r.Method == "POST" && n == 2 && p[0] == "fault" && p[1] == "new":
+		if !requireLogin(username, w) {
+			return
+		}
+		createFault(handle.records, username, w, r)
+	// DELETE /fault/<ID>
+	case r.Method == "DELETE" && n == 2 && p[0] == "fault":
+		if !requireLogin(username, w) {
+			return
+		}
+		deleteFault(handle.records, username, p[1], w, r)
+	// GET /reverse: the user's slices of the reverse zones
+	case r.Method == "GET" && n == 1 && p[0] == "reverse":
+		if !requireLogin(username, w) {
+			return
+		}
+		getReverseSlices(handle.records, username, w, r)
+	// POST /reverse: hands the user a slice of each reverse zone, if they
+	// don't have one yet
+	case r.Method == "POST" && n == 1 && p[0] == "reverse":
+		if !requireLogin(username, w) {
+			return
+		}
+		createReverseSlices(handle.records, username, w, r)
+	// GET /settings
+	case r.Method == "GET" && n == 1 && p[0] == "settings":
+		if !requireLogin(username, w) {
+			return
+		}
+		getSettings(handle.records, username, w, r)
+	// POST /settings
+	case r.Method == "POST" && n == 1 && p[0] == "settings":
+		if !requireLogin(username, w) {
+			return
+		}
+		setSettings(handle.records, username, w, r)
+	// GET /healthz: liveness
+	case r.Method == "GET" && n == 1 && p[0] == "healthz":
+		getHealthz(w, r)
+	// GET /readyz: readiness
+	case r.Method == "GET" && n == 1 && p[0] == "readyz":
+		getReadyz(handle.records, handle.ipRanges, w, r)
 	// POST /login
 	case r.Method == "GET" && n == 1 && p[0] == "login":
 		w.Header().Set("Cache-Control", "no-store")
-		loginRandom(handle.db, w, r)
+		loginRandom(handle.records, w, r)
 	// GET /oauth-callback
 	case r.Method == "GET" && p[0] == "oauth-callback":
 		w.Header().Set("Cache-Control", "no-store")
-		oauthCallback(w, r)
+		oauthCallback(handle.records, w, r)
 	default:
 		// serve static files
+		span.SetName(r.Method + " static")
 		w.Header().Set("Cache-Control", "public, max-age=120")
 		http.ServeFile(w, r, "./frontend/"+r.URL.Path)
 	}
@@ -300,44 +823,152 @@ func (handle *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (handle *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	start := time.Now()
-	fmt.Println("Received request: ", r.Question[0].String())
-	msg := dnsResponse(handle.db, r)
-	w.WriteMsg(msg)
+	remote_addr := remoteIP(w.RemoteAddr())
+	transport := w.LocalAddr().Network()
+	ctx, span := tracer.Start(
+		context.Background(),
+		"ServeDNS",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("dns.qname", r.Question[0].Name),
+			attribute.String("dns.qtype", dns.TypeToString[r.Question[0].Qtype]),
+			attribute.String("network.transport", transport),
+		),
+	)
+	defer span.End()
+	client := newClient(r, remote_addr, handle.ipRanges)
+	msg, inj := handle.respond(ctx, r, client, transport == "udp")
+	shutdown := handle.shutdown
+	if shutdown == nil {
+		shutdown = context.Background()
+	}
+	if !inj.wait(shutdown) {
+		logger.Info("answering early, we're shutting down", "qname", r.Question[0].Name)
+	}
+	if !inj.drop {
+		w.WriteMsg(msg)
+	}
+	// after the faults, so it's what the resolver actually got
+	observeQuery(transport, r, msg, time.Since(start))
+	span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[msg.Rcode]))
 	// everything after this is just logging
-	elapsed := time.Since(start)
-	if len(msg.Answer) > 0 {
-		fmt.Println("Response: ", msg.Answer[0].String(), elapsed)
-	} else {
-		// print elapsed time
-		fmt.Println("Response: (no records found)", elapsed)
+	log := logger.With(
+		"request_id", newRequestID(),
+		"trace_id", traceID(ctx),
+		"subdomain", ExtractSubdomain(r.Question[0].Name),
+		"qname", r.Question[0].Name,
+		"qtype", dns.TypeToString[r.Question[0].Qtype],
+		"rcode", dns.RcodeToString[msg.Rcode],
+		"transport", transport,
+		"remote", remote_addr.String(),
+	)
+	log.Info(
+		"dns request",
+		"answers", len(msg.Answer),
+		"faults", strings.Join(inj.applied, ","),
+		"latency", time.Since(start),
+	)
+	err := LogRequest(
+		ctx,
+		handle.records,
+		handle.requests,
+		r,
+		msg,
+		remote_addr,
+		lookupHost(ctx, handle.ipRanges, remote_addr),
+		client.Subnet,
+		inj.applied,
+	)
+	if err != nil {
+		logRequestFailures.Inc()
+		recordError(span, err)
+		log.Error("error logging request", "err", err)
+	}
+}
 
+// respond works out the answer to the query with the faults applied. The
+// faults come first, so that an answer they replace isn't worked out at all.
+func (handle *handler) respond(ctx context.Context, r *dns.Msg, client *Client, udp bool) (*dns.Msg, injection) {
+	var faults []Fault
+	if strings.HasSuffix(r.Question[0].Name, "flatbo.at.") {
+		var err error
+		faults, err = lookupFaults(ctx, handle.records, r.Question[0].Name)
+		if err != nil {
+			logger.Error("error getting faults", "qname", r.Question[0].Name, "err", err)
+		}
 	}
-	remote_addr := w.RemoteAddr().(*net.UDPAddr).IP
-	err := LogRequest(handle.db, r, msg, remote_addr, lookupHost(handle.ipRanges, remote_addr))
-	if err != nil {
-		fmt.Println("Error logging request:", err)
-		sentry.CaptureException(err)
+	inj := rollFaults(faults)
+	var msg *dns.Msg
+	if inj.replacesAnswer() {
+		// an empty answer for the logs if it's dropped
+		msg = new(dns.Msg).SetReply(r)
+	} else {
+		msg = dnsResponse(ctx, handle.records, r, client)
+	}
+	return inj.apply(r, msg, udp), inj
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
 	}
+	return nil
 }
 
-func cleanup(db *sql.DB) {
+func cleanup(ctx context.Context, store Store) {
 	for {
-		fmt.Println("Deleting old requests...")
-		DeleteOldRequests(db)
-		DeleteOldRecords(db)
-		time.Sleep(time.Minute * 15)
+		logger.Debug("deleting old requests")
+		probes.startCleanup(time.Now())
+		// let a cleanup that's already started finish when we shut down
+		err := store.DeleteOldRequests(context.WithoutCancel(ctx), cfg.Retention.Duration)
+		if err != nil {
+			logger.Error("error deleting old requests", "err", err)
+		}
+		err = store.DeleteOldRecords(context.WithoutCancel(ctx), cfg.Retention.Duration)
+		if err != nil {
+			logger.Error("error deleting old records", "err", err)
+		}
+		err = store.DeleteOldHistory(context.WithoutCancel(ctx), cfg.HistoryRetention.Duration)
+		if err != nil {
+			logger.Error("error deleting old history", "err", err)
+		}
+		cutoff := time.Now().Add(-cfg.Retention.Duration)
+		forgetOldCounts(cutoff)
+		forgetOldRotations(cutoff)
+		probes.finishCleanup(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.CleanupInterval.Duration):
+		}
 	}
 }
 
-func lookupHost(ranges *Ranges, host net.IP) string {
-	names, err := net.LookupAddr(host.String())
+func lookupHost(ctx context.Context, ranges *Ranges, host net.IP) string {
+	ctx, span := tracer.Start(ctx, "lookupHost")
+	defer span.End()
+	names, err := lookupAddr(ctx, host)
 	if err == nil && len(names) > 0 {
+		span.SetAttributes(attribute.String("lookup.source", "rdns"))
 		return names[0]
 	}
 	// otherwise search ASN database
+	span.SetAttributes(attribute.String("lookup.source", "asn"))
 	r, err := ranges.FindASN(host)
 	if err != nil {
 		return ""
 	}
 	return r.Name
 }
+
+// lookupAddr gets its own span since it's often the slow part of a query
+func lookupAddr(ctx context.Context, host net.IP) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "net.LookupAddr", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	names, err := net.DefaultResolver.LookupAddr(ctx, host.String())
+	recordError(span, err)
+	return names, err
+}
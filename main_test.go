@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordOwnership(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	assert.Nil(t, store.InsertSubdomain(ctx, "bob"))
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("www.alice.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	records, err := store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	var id string
+	for recordID := range records {
+		id = strconv.Itoa(recordID)
+	}
+
+	// bob gets the same answer as for a record that doesn't exist
+	body := `{"Hdr":{"Name":"www.bob.flatbo.at.","Rrtype":1,"Class":1,"Ttl":300},"A":"192.0.2.2"}`
+	w := httptest.NewRecorder()
+	updateRecord(store, "bob", id, w, httptest.NewRequest("POST", "/record/"+id, strings.NewReader(body)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	deleteRecord(store, "bob", id, w, httptest.NewRequest("DELETE", "/record/"+id, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	deleteRecord(store, "bob", "12345", w, httptest.NewRequest("DELETE", "/record/12345", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	records, err = store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	w = httptest.NewRecorder()
+	deleteRecord(store, "alice", id, w, httptest.NewRequest("DELETE", "/record/"+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	records, err = store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Len(t, records, 0)
+}
+
+func TestCreateRecordFails(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	// nobody never logged in, so there's nowhere to put the record
+	body := `{"Hdr":{"Name":"www.nobody.flatbo.at.","Rrtype":1,"Class":1,"Ttl":300},"A":"192.0.2.1"}`
+	w := httptest.NewRecorder()
+	createRecord(store, "nobody", w, httptest.NewRequest("POST", "/record/new", strings.NewReader(body)))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	records, err := store.GetRecordsForName(ctx, "nobody")
+	assert.Nil(t, err)
+	assert.Len(t, records, 0)
+}
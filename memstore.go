@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// memoryStore keeps everything in maps, for tests and for trying things out
+// without a database. It's gone when we restart.
+type memoryStore struct {
+	sync.Mutex
+	serial     uint32
+	lastID     int
+	records    map[int]*memoryRecord
+	policies   map[string]Policy
+	behaviors  map[int]*memoryRow[Behavior]
+	faults     map[int]*memoryRow[Fault]
+	slices     map[string]*memoryRow[memorySlice]
+	settings   map[string]Settings
+	subdomains []string
+	requests   []*memoryRow[LoggedRequest]
+	// oldest first
+	history []HistoryEntry
+	// the serial each subdomain's records last changed at
+	zoneSerials map[string]uint32
+}
+
+type memoryRecord struct {
+	Record
+	subdomain string
+	createdAt time.Time
+}
+
+type memoryRow[T any] struct {
+	id        int
+	value     T
+	createdAt time.Time
+}
+
+type memorySlice struct {
+	zone      string
+	subdomain string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		// the same place the SQL stores start
+		serial:    10,
+		records:   make(map[int]*memoryRecord),
+		policies:  make(map[string]Policy),
+		behaviors: make(map[int]*memoryRow[Behavior]),
+		faults:    make(map[int]*memoryRow[Fault]),
+		slices:    make(map[string]*memoryRow[memorySlice]),
+		settings:  make(map[string]Settings),
+
+		zoneSerials: make(map[string]uint32),
+	}
+}
+
+// nextID hands out IDs for every kind of row, so they're never reused
+func (m *memoryStore) nextID() int {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *memoryStore) incrementSerial() {
+	m.serial++
+	soaSerial = m.serial
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) GetSerial(ctx context.Context) (uint32, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.serial, nil
+}
+
+func (m *memoryStore) GetZoneSerial(ctx context.Context, subdomain string) (uint32, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.zoneSerial(subdomain), nil
+}
+
+func (m *memoryStore) zoneSerial(subdomain string) uint32 {
+	return m.zoneSerials[subdomain]
+}
+
+// sortedRecords is the records newest first, which is also the order we
+// answer with when there's no policy
+func (m *memoryStore) sortedRecords(match func(*memoryRecord) bool) []*memoryRecord {
+	var records []*memoryRecord
+	for _, record := range m.records {
+		if match(record) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID > records[j].ID
+	})
+	return records
+}
+
+func (m *memoryStore) GetRecords(ctx context.Context, name string, qtype uint16) ([]dns.RR, int, error) {
+	m.Lock()
+	defer m.Unlock()
+	found := m.sortedRecords(func(record *memoryRecord) bool {
+		return record.RR.Header().Name == name
+	})
+	records := make([]Record, len(found))
+	for i, record := range found {
+		records[i] = Record{ID: record.ID, RR: dns.Copy(record.RR), Weight: record.Weight, Backup: record.Backup}
+	}
+	policy, ok := m.policies[name]
+	if !ok {
+		policy = Policy{Name: name, Ordering: OrderFixed}
+	}
+	return answerRecords(ctx, policy, records, qtype), len(records), nil
+}
+
+func (m *memoryStore) GetRecordsForName(ctx context.Context, subdomain string) (map[int]Record, error) {
+	m.Lock()
+	defer m.Unlock()
+	records := make(map[int]Record)
+	for id, record := range m.records {
+		if record.subdomain == subdomain {
+			copied := record.Record
+			copied.RR = dns.Copy(record.RR)
+			records[id] = copied
+		}
+	}
+	return records, nil
+}
+
+func (m *memoryStore) InsertRecord(ctx context.Context, subdomain string, record dns.RR, options RecordOptions) error {
+	_, err := m.ApplyRecordChanges(ctx, subdomain, []RecordChange{{Op: ChangeCreate, Record: record, Options: options}})
+	return errors.Unwrap(err)
+}
+
+func (m *memoryStore) UpdateRecord(ctx context.Context, subdomain string, id int, record dns.RR, options RecordOptions) error {
+	_, err := m.ApplyRecordChanges(ctx, subdomain, []RecordChange{{Op: ChangeUpdate, ID: id, Record: record, Options: options}})
+	return errors.Unwrap(err)
+}
+
+func (m *memoryStore) DeleteRecord(ctx context.Context, subdomain string, id int) error {
+	_, err := m.ApplyRecordChanges(ctx, subdomain, []RecordChange{{Op: ChangeDelete, ID: id}})
+	return errors.Unwrap(err)
+}
+
+func (m *memoryStore) ApplyRecordChanges(ctx context.Context, subdomain string, changes []RecordChange) ([]int, error) {
+	m.Lock()
+	defer m.Unlock()
+	// the changes go to a copy, so that nothing happens if one fails
+	records := make(map[int]*memoryRecord, len(m.records))
+	for id, record := range m.records {
+		records[id] = record
+	}
+	ids := make([]int, len(changes))
+	var history []HistoryEntry
+	for i, change := range changes {
+		old := make(map[int]Record)
+		for id, record := range records {
+			if record.subdomain == subdomain && (change.Op == ChangeReset || id == change.ID) {
+				old[id] = record.Record
+			}
+		}
+		id, err := m.applyChange(records, subdomain, change)
+		if err != nil {
+			return nil, &changeError{Index: i, Err: err}
+		}
+		ids[i] = id
+		entries, err := historyEntries(subdomain, change, id, old)
+		if err != nil {
+			return nil, &changeError{Index: i, Err: err}
+		}
+		history = append(history, entries...)
+	}
+	if len(changes) > 0 {
+		m.records = records
+		m.incrementSerial()
+		m.addHistory(history)
+	}
+	return ids, nil
+}
+
+// addHistory adds entries for the change that just incremented the serial
+func (m *memoryStore) addHistory(entries []HistoryEntry) {
+	for _, entry := range entries {
+		entry.ID = m.nextID()
+		entry.SerialBefore = m.serial - 1
+		entry.SerialAfter = m.serial
+		entry.CreatedAt = time.Now().UTC()
+		m.history = append(m.history, entry)
+		m.zoneSerials[entry.subdomain] = m.serial
+	}
+}
+
+func (m *memoryStore) GetRecordHistory(ctx context.Context, subdomain string, since time.Time, limit int) ([]HistoryEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	entries := make([]HistoryEntry, 0)
+	for i := len(m.history) - 1; i >= 0; i-- {
+		entry := m.history[i]
+		if !entry.CreatedAt.After(since) || (limit > 0 && len(entries) == limit) {
+			break
+		}
+		if entry.subdomain == subdomain {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) GetHistoryEntry(ctx context.Context, subdomain string, id int) (HistoryEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, entry := range m.history {
+		if entry.ID == id && entry.subdomain == subdomain {
+			return entry, nil
+		}
+	}
+	return HistoryEntry{}, errNotFound
+}
+
+func (m *memoryStore) DeleteOldHistory(ctx context.Context, retention time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	cutoff := time.Now().Add(-retention)
+	kept := make([]HistoryEntry, 0, len(m.history))
+	for _, entry := range m.history {
+		if !entry.CreatedAt.Before(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	countDeleted("dns_record_history", int64(len(m.history)-len(kept)))
+	m.history = kept
+	return nil
+}
+
+func (m *memoryStore) applyChange(records map[int]*memoryRecord, subdomain string, change RecordChange) (int, error) {
+	switch change.Op {
+	case ChangeCreate, ChangeUpdate:
+		if !m.hasSubdomain(subdomain) {
+			return 0, fmt.Errorf("unknown subdomain %s", subdomain)
+		}
+		// only what the SQL stores can store
+		if _, err := FormatRecord(change.Record); err != nil {
+			return 0, err
+		}
+		if change.Op == ChangeCreate {
+			id := m.nextID()
+			records[id] = newMemoryRecord(id, subdomain, change.Record, change.Options, time.Now())
+			return id, nil
+		}
+		existing, ok := records[change.ID]
+		if !ok || existing.subdomain != subdomain {
+			return 0, errNotFound
+		}
+		records[change.ID] = newMemoryRecord(change.ID, subdomain, change.Record, change.Options, existing.createdAt)
+	case ChangeDelete:
+		existing, ok := records[change.ID]
+		if !ok || existing.subdomain != subdomain {
+			return 0, errNotFound
+		}
+		delete(records, change.ID)
+	case ChangeReset:
+		for id, record := range records {
+			if record.subdomain == subdomain {
+				delete(records, id)
+			}
+		}
+	case ChangeCheckZoneSerial:
+		if m.zoneSerial(subdomain) != change.Serial {
+			return 0, errSerialChanged
+		}
+	default:
+		return 0, fmt.Errorf("unknown operation %q", change.Op)
+	}
+	return change.ID, nil
+}
+
+func newMemoryRecord(id int, subdomain string, record dns.RR, options RecordOptions, createdAt time.Time) *memoryRecord {
+	var check *HealthCheck
+	if options.HealthCheck != nil {
+		copied := *options.HealthCheck
+		copied.RecordID = id
+		copied.Name = record.Header().Name
+		copied.Subdomain = subdomain
+		check = &copied
+	}
+	return &memoryRecord{
+		Record: Record{
+			ID:          id,
+			RR:          dns.Copy(record),
+			Weight:      options.Weight,
+			Backup:      options.Backup,
+			HealthCheck: check,
+		},
+		subdomain: subdomain,
+		createdAt: createdAt,
+	}
+}
+
+func (m *memoryStore) CountRecords(ctx context.Context) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.records), nil
+}
+
+func (m *memoryStore) GetHealthChecks(ctx context.Context) ([]HealthCheck, error) {
+	m.Lock()
+	defer m.Unlock()
+	checks := make([]HealthCheck, 0)
+	for _, record := range m.records {
+		if record.HealthCheck != nil {
+			checks = append(checks, *record.HealthCheck)
+		}
+	}
+	return checks, nil
+}
+
+func (m *memoryStore) GetPolicies(ctx context.Context, subdomain string) ([]Policy, error) {
+	m.Lock()
+	defer m.Unlock()
+	policies := make([]Policy, 0)
+	for name, policy := range m.policies {
+		if ExtractSubdomain(name) == subdomain {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
+
+func (m *memoryStore) SetPolicy(ctx context.Context, policy Policy) error {
+	m.Lock()
+	defer m.Unlock()
+	// fixed is what you get without a policy, so there's no need to keep it around
+	if policy.Ordering == OrderFixed && policy.AnswerCount == 0 {
+		delete(m.policies, policy.Name)
+		return nil
+	}
+	m.policies[policy.Name] = policy
+	return nil
+}
+
+func (m *memoryStore) InsertBehavior(ctx context.Context, behavior Behavior) error {
+	m.Lock()
+	defer m.Unlock()
+	id := m.nextID()
+	behavior.ID = id
+	m.behaviors[id] = &memoryRow[Behavior]{id: id, value: behavior, createdAt: time.Now()}
+	m.incrementSerial()
+	return nil
+}
+
+func (m *memoryStore) DeleteBehavior(ctx context.Context, subdomain string, id int) error {
+	m.Lock()
+	defer m.Unlock()
+	row, ok := m.behaviors[id]
+	if !ok || ExtractSubdomain(row.value.Name) != subdomain {
+		return errNotFound
+	}
+	delete(m.behaviors, id)
+	m.incrementSerial()
+	return nil
+}
+
+func (m *memoryStore) GetBehaviors(ctx context.Context, name string) ([]Behavior, error) {
+	m.Lock()
+	defer m.Unlock()
+	return matchingRows(m.behaviors, func(behavior Behavior) bool {
+		return behavior.Name == name
+	}), nil
+}
+
+func (m *memoryStore) GetBehaviorsForName(ctx context.Context, subdomain string) ([]Behavior, error) {
+	m.Lock()
+	defer m.Unlock()
+	return matchingRows(m.behaviors, func(behavior Behavior) bool {
+		return ExtractSubdomain(behavior.Name) == subdomain
+	}), nil
+}
+
+func (m *memoryStore) InsertFault(ctx context.Context, fault Fault) error {
+	m.Lock()
+	defer m.Unlock()
+	id := m.nextID()
+	fault.ID = id
+	m.faults[id] = &memoryRow[Fault]{id: id, value: fault, createdAt: time.Now()}
+	m.incrementSerial()
+	return nil
+}
+
+func (m *memoryStore) DeleteFault(ctx context.Context, subdomain string, id int) error {
+	m.Lock()
+	defer m.Unlock()
+	row, ok := m.faults[id]
+	if !ok || ExtractSubdomain(row.value.Name) != subdomain {
+		return errNotFound
+	}
+	delete(m.faults, id)
+	m.incrementSerial()
+	return nil
+}
+
+func (m *memoryStore) GetFaults(ctx context.Context, name string) ([]Fault, error) {
+	m.Lock()
+	defer m.Unlock()
+	return matchingRows(m.faults, func(fault Fault) bool {
+		return fault.Name == name
+	}), nil
+}
+
+func (m *memoryStore) GetFaultsForName(ctx context.Context, subdomain string) ([]Fault, error) {
+	m.Lock()
+	defer m.Unlock()
+	return matchingRows(m.faults, func(fault Fault) bool {
+		return ExtractSubdomain(fault.Name) == subdomain
+	}), nil
+}
+
+func (m *memoryStore) GetFaultNames(ctx context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, row := range m.faults {
+		if !seen[row.value.Name] {
+			seen[row.value.Name] = true
+			names = append(names, row.value.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// matchingRows is the rows that match, oldest first
+func matchingRows[T any](rows map[int]*memoryRow[T], match func(T) bool) []T {
+	ids := make([]int, 0)
+	for id, row := range rows {
+		if match(row.value) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	values := make([]T, len(ids))
+	for i, id := range ids {
+		values[i] = rows[id].value
+	}
+	return values
+}
+
+func (m *memoryStore) GetReverseSlices(ctx context.Context, zone string) (map[string]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	slices := make(map[string]string)
+	for prefix, row := range m.slices {
+		if row.value.zone == zone {
+			slices[prefix] = row.value.subdomain
+		}
+	}
+	return slices, nil
+}
+
+func (m *memoryStore) GetReverseSliceOwner(ctx context.Context, prefix string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if row, ok := m.slices[prefix]; ok {
+		return row.value.subdomain, nil
+	}
+	return "", nil
+}
+
+func (m *memoryStore) InsertReverseSlice(ctx context.Context, zone string, prefix string, subdomain string) error {
+	m.Lock()
+	defer m.Unlock()
+	if row, ok := m.slices[prefix]; ok {
+		if row.value.subdomain != subdomain {
+			return errSliceTaken
+		}
+		return nil
+	}
+	m.slices[prefix] = &memoryRow[memorySlice]{
+		value:     memorySlice{zone: zone, subdomain: subdomain},
+		createdAt: time.Now(),
+	}
+	return nil
+}
+
+func (m *memoryStore) GetSettings(ctx context.Context, subdomain string) (Settings, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.settings[subdomain], nil
+}
+
+func (m *memoryStore) SetSettings(ctx context.Context, subdomain string, settings Settings) error {
+	m.Lock()
+	defer m.Unlock()
+	m.settings[subdomain] = settings
+	return nil
+}
+
+func (m *memoryStore) GetSubdomains(ctx context.Context, prefix string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	var subdomains []string
+	for _, subdomain := range m.subdomains {
+		if strings.HasPrefix(subdomain, prefix) {
+			subdomains = append(subdomains, subdomain)
+		}
+	}
+	return subdomains, nil
+}
+
+func (m *memoryStore) InsertSubdomain(ctx context.Context, subdomain string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.hasSubdomain(subdomain) {
+		return fmt.Errorf("subdomain %s already exists", subdomain)
+	}
+	m.subdomains = append(m.subdomains, subdomain)
+	return nil
+}
+
+func (m *memoryStore) EnsureSubdomain(ctx context.Context, subdomain string) error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.hasSubdomain(subdomain) {
+		m.subdomains = append(m.subdomains, subdomain)
+	}
+	return nil
+}
+
+// hasSubdomain stands in for the foreign key from records to subdomains
+func (m *memoryStore) hasSubdomain(subdomain string) bool {
+	for _, existing := range m.subdomains {
+		if existing == subdomain {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryStore) DeleteOldRecords(ctx context.Context, retention time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	cutoff := time.Now().Add(-retention)
+	inUse := make(map[string]bool)
+	old := make(map[string]map[int]Record)
+	var deleted, deletedChecks int64
+	for id, record := range m.records {
+		if record.createdAt.Before(cutoff) {
+			delete(m.records, id)
+			deleted++
+			if record.HealthCheck != nil {
+				deletedChecks++
+			}
+			if old[record.subdomain] == nil {
+				old[record.subdomain] = make(map[int]Record)
+			}
+			old[record.subdomain][id] = record.Record
+		} else {
+			inUse[record.subdomain] = true
+		}
+	}
+	if deleted > 0 {
+		m.incrementSerial()
+		subdomains := make([]string, 0, len(old))
+		for subdomain := range old {
+			subdomains = append(subdomains, subdomain)
+		}
+		sort.Strings(subdomains)
+		for _, subdomain := range subdomains {
+			entries, err := deletedEntries(subdomain, actorRetention, old[subdomain])
+			if err != nil {
+				return err
+			}
+			m.addHistory(entries)
+		}
+	}
+	countDeleted("dns_records", deleted)
+	countDeleted("dns_health_checks", deletedChecks)
+	countDeleted("dns_behaviors", deleteOlder(m.behaviors, cutoff, nil))
+	countDeleted("dns_faults", deleteOlder(m.faults, cutoff, nil))
+	// reverse slices go back in the pool once nobody has records in them
+	countDeleted("dns_reverse_slices", deleteOlder(m.slices, cutoff, func(slice memorySlice) bool {
+		return !inUse[slice.subdomain]
+	}))
+	return nil
+}
+
+// deleteOlder deletes the rows made before cutoff that also pass unused, if
+// there is one
+func deleteOlder[K comparable, T any](rows map[K]*memoryRow[T], cutoff time.Time, unused func(T) bool) int64 {
+	var deleted int64
+	for key, row := range rows {
+		if row.createdAt.Before(cutoff) && (unused == nil || unused(row.value)) {
+			delete(rows, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (m *memoryStore) InsertRequest(ctx context.Context, request LoggedRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	m.requests = append(m.requests, &memoryRow[LoggedRequest]{
+		id:        m.nextID(),
+		value:     request,
+		createdAt: time.Now(),
+	})
+	return nil
+}
+
+func (m *memoryStore) GetRequests(ctx context.Context, subdomain string) ([]map[string]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	requests := make([]map[string]interface{}, 0)
+	for i := len(m.requests) - 1; i >= 0 && len(requests) < requestsShown; i-- {
+		row := m.requests[i]
+		if row.value.Subdomain == subdomain {
+			requests = append(requests, requestJSON(row.id, row.createdAt.Unix(), row.value))
+		}
+	}
+	return requests, nil
+}
+
+func (m *memoryStore) DeleteRequestsForDomain(ctx context.Context, subdomain string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.requests = keepRequests(m.requests, func(row *memoryRow[LoggedRequest]) bool {
+		return row.value.Subdomain != subdomain
+	})
+	return nil
+}
+
+func (m *memoryStore) DeleteOldRequests(ctx context.Context, retention time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	cutoff := time.Now().Add(-retention)
+	before := len(m.requests)
+	m.requests = keepRequests(m.requests, func(row *memoryRow[LoggedRequest]) bool {
+		return !row.createdAt.Before(cutoff)
+	})
+	countDeleted("dns_requests", int64(before-len(m.requests)))
+	return nil
+}
+
+func keepRequests(rows []*memoryRow[LoggedRequest], keep func(*memoryRow[LoggedRequest]) bool) []*memoryRow[LoggedRequest] {
+	kept := make([]*memoryRow[LoggedRequest], 0, len(rows))
+	for _, row := range rows {
+		if keep(row) {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
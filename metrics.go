@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	dnsQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_queries_total",
+		Help: "DNS queries answered, by transport, query type and response code.",
+	}, []string{"transport", "qtype", "rcode"})
+
+	dnsResponseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_response_duration_seconds",
+		Help:    "Time spent working out the answer to a DNS query.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"transport"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Time spent in database calls, by call.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"query"})
+
+	openStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "request_streams_open",
+		Help: "Websocket request streams currently open, by subdomain.",
+	}, []string{"subdomain"})
+
+	logRequestFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "log_request_failures_total",
+		Help: "DNS queries we failed to write to the request log.",
+	})
+
+	cleanupDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cleanup_rows_deleted_total",
+		Help: "Rows deleted by the cleanup loop, by table.",
+	}, []string{"table"})
+)
+
+func observeQuery(transport string, request *dns.Msg, msg *dns.Msg, elapsed time.Duration) {
+	dnsQueries.WithLabelValues(
+		transport,
+		dns.TypeToString[request.Question[0].Qtype],
+		dns.RcodeToString[msg.Rcode],
+	).Inc()
+	dnsResponseDuration.WithLabelValues(transport).Observe(elapsed.Seconds())
+}
+
+func countDeleted(table string, n int64) {
+	cleanupDeleted.WithLabelValues(table).Add(float64(n))
+}
+
+// registerRecordCount counts the records when we get scraped
+func registerRecordCount(store RecordStore) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dns_records",
+		Help: "Records currently stored.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		count, err := store.CountRecords(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	}))
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveQuery(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("example.flatbo.at.", dns.TypeA)
+	msg := new(dns.Msg)
+	msg.SetRcode(request, dns.RcodeNameError)
+
+	counter := dnsQueries.WithLabelValues("udp", "A", "NXDOMAIN")
+	before := testutil.ToFloat64(counter)
+	observeQuery("udp", request, msg, 0)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestOpenStreams(t *testing.T) {
+	stream := CreateStream("metrics")
+	assert.Equal(t, 1.0, testutil.ToFloat64(openStreams.WithLabelValues("metrics")))
+	stream.Delete()
+	assert.Equal(t, 0, testutil.CollectAndCount(openStreams, "request_streams_open"))
+}
+
+func TestAdminHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "dns_queries_total")
+}
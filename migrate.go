@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes are numbered migrations in migrations/<dialect>/, each an
+// up and a down file like 0003_index_names.up.sql. schema_version has a row
+// for every one that's been applied. They're applied on startup unless
+// migrate is off in the config, and otherwise with
+//
+//	mess-with-dns migrate [up|down|status]
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// how long an instance waits for another one to finish migrating
+const migrationLockTimeout = 5 * time.Minute
+
+const migrationLockName = "mess-with-dns-migrations"
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version
+(
+    version INT NOT NULL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+)`
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationCode is for data changes SQL can't make. It runs in the same
+// transaction as the migration, after the up statements and before the down
+// ones.
+type migrationCode struct {
+	afterUp    func(ctx context.Context, s *sqlStore, tx *sql.Tx) error
+	beforeDown func(ctx context.Context, s *sqlStore, tx *sql.Tx) error
+}
+
+var migrationsCode = map[int]migrationCode{
+	10: {afterUp: recordsToPresentation, beforeDown: recordsToJSON},
+}
+
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := "migrations/" + dialect
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		direction := "up"
+		if strings.HasSuffix(file, ".down.sql") {
+			direction = "down"
+		} else if !strings.HasSuffix(file, ".up.sql") {
+			return nil, fmt.Errorf("%s/%s isn't a migration", dir, file)
+		}
+		number, name, ok := strings.Cut(strings.TrimSuffix(file, "."+direction+".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s/%s should be named like 0001_name.%s.sql", dir, file, direction)
+		}
+		contents, err := fs.ReadFile(migrationFiles, dir+"/"+file)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("%s: migration %d is missing", dir, i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("%s: migration %d needs both an up and a down", dir, m.version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits SQL on the semicolons between statements, leaving
+// the ones in strings and comments alone
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	var quote rune
+	comment := false
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case comment:
+			if c == '\n' {
+				comment = false
+			}
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			comment = true
+		case c == ';':
+			if statement := strings.TrimSpace(current.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+func schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+// migrate brings the schema to version target, all the way up if it's -1
+func (s *sqlStore) migrate(ctx context.Context, target int) error {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return err
+	}
+	if target < 0 {
+		target = len(migrations)
+	}
+	if target > len(migrations) {
+		return fmt.Errorf("there's no migration %d", target)
+	}
+	// everything happens on one connection, since that's what holds the lock
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	unlock, err := s.dialect.lockMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("error locking migrations: %s", err.Error())
+	}
+	defer unlock()
+	_, err = conn.ExecContext(ctx, schemaVersionTable)
+	if err != nil {
+		return err
+	}
+	// now that we have the lock, nobody else is changing this
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version > current && m.version <= target {
+			logger.Info("applying migration", "version", m.version, "name", m.name)
+			err = s.applyMigration(ctx, conn, m.up, nil, migrationsCode[m.version].afterUp, "INSERT INTO schema_version (version, name) VALUES (?, ?)", m.version, m.name)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %s", m.version, m.name, err.Error())
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= current && m.version > target {
+			logger.Info("reverting migration", "version", m.version, "name", m.name)
+			err = s.applyMigration(ctx, conn, m.down, migrationsCode[m.version].beforeDown, nil, "DELETE FROM schema_version WHERE version = ?", m.version)
+			if err != nil {
+				return fmt.Errorf("reverting migration %d (%s): %s", m.version, m.name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration's statements, with its code before or
+// after, and records it in schema_version. It's one transaction where the
+// database can roll back DDL.
+func (s *sqlStore) applyMigration(
+	ctx context.Context,
+	conn *sql.Conn,
+	script string,
+	before func(ctx context.Context, s *sqlStore, tx *sql.Tx) error,
+	after func(ctx context.Context, s *sqlStore, tx *sql.Tx) error,
+	record string,
+	args ...interface{},
+) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if before != nil {
+		err = before(ctx, s, tx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, statement := range splitStatements(script) {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		err = after(ctx, s, tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.exec(ctx, tx, record, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pendingMigrations is how far behind the schema is
+func (s *sqlStore) pendingMigrations(ctx context.Context) (int, error) {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, schemaVersionTable)
+	if err != nil {
+		return 0, err
+	}
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations) - current, nil
+}
+
+// printMigrations shows which migrations have been applied
+func (s *sqlStore) printMigrations(ctx context.Context, w io.Writer) error {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return err
+	}
+	pending, err := s.pendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "applied"
+		if m.version > len(migrations)-pending {
+			state = "pending"
+		}
+		fmt.Fprintf(w, "%04d %-30s %s\n", m.version, m.name, state)
+	}
+	return nil
+}
+
+// runMigrate is the migrate subcommand: up (the default) applies everything,
+// down reverts the last migration, and status lists them
+func runMigrate(ctx context.Context, store Store, command string, w io.Writer) error {
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return fmt.Errorf("this database doesn't have migrations")
+	}
+	switch command {
+	case "", "up":
+		return s.migrate(ctx, -1)
+	case "down":
+		pending, err := s.pendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		migrations, err := loadMigrations(s.dialect.name)
+		if err != nil {
+			return err
+		}
+		current := len(migrations) - pending
+		if current == 0 {
+			return fmt.Errorf("there's nothing to revert")
+		}
+		return s.migrate(ctx, current-1)
+	case "status":
+		return s.printMigrations(ctx, w)
+	}
+	return fmt.Errorf("unknown migrate command %q, try up, down or status", command)
+}
+
+// recordsToPresentation fills in rr from the JSON that records used to be
+// stored as. If any records can't be read or written in presentation format
+// the migration fails with their IDs, so that someone can fix them by hand
+// instead of losing them.
+func recordsToPresentation(ctx context.Context, s *sqlStore, tx *sql.Tx) error {
+	contents, err := recordColumn(ctx, s, tx, "content")
+	if err != nil {
+		return err
+	}
+	var bad []int
+	for id, content := range contents {
+		var rr string
+		record, err := ParseRecord([]byte(content))
+		if err == nil {
+			rr, err = FormatRecord(record)
+		}
+		if err != nil {
+			logger.Warn("record doesn't parse", "id", id, "error", err)
+			bad = append(bad, id)
+			continue
+		}
+		_, err = s.exec(ctx, tx, "UPDATE dns_records SET rr = ? WHERE id = ?", rr, id)
+		if err != nil {
+			return err
+		}
+	}
+	if len(bad) > 0 {
+		sort.Ints(bad)
+		return fmt.Errorf("records that don't parse, fix or delete them first: %v", bad)
+	}
+	return nil
+}
+
+// recordsToJSON puts the JSON content back when migrating down
+func recordsToJSON(ctx context.Context, s *sqlStore, tx *sql.Tx) error {
+	rrs, err := recordColumn(ctx, s, tx, "rr")
+	if err != nil {
+		return err
+	}
+	for id, rr := range rrs {
+		record, err := ParsePresentation(rr)
+		if err != nil {
+			return fmt.Errorf("record %d: %s", id, err.Error())
+		}
+		content, err := MarshalRecord(record)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(ctx, tx, "UPDATE dns_records SET content = ? WHERE id = ?", string(content), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordColumn reads a column of every record, all before anything gets
+// updated since the rows are on the same connection
+func recordColumn(ctx context.Context, s *sqlStore, tx *sql.Tx, column string) (map[int]string, error) {
+	rows, err := s.query(ctx, tx, "SELECT id, "+column+" FROM dns_records")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var value string
+		err = rows.Scan(&id, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[id] = value
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	var versions []int
+	for _, d := range []dialect{mysqlDialect, sqliteDialect, postgresDialect} {
+		migrations, err := loadMigrations(d.name)
+		assert.Nil(t, err, d.name)
+		assert.NotEmpty(t, migrations, d.name)
+		// every database gets the same migrations
+		if versions == nil {
+			for _, m := range migrations {
+				versions = append(versions, m.version)
+			}
+		}
+		assert.Equal(t, len(versions), len(migrations), d.name)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements(`
+-- a comment; with a semicolon
+CREATE TABLE a (x VARCHAR(10) DEFAULT ';');
+INSERT INTO a VALUES ('it''s; fine');
+`)
+	assert.Equal(t, []string{
+		"-- a comment; with a semicolon\nCREATE TABLE a (x VARCHAR(10) DEFAULT ';')",
+		"INSERT INTO a VALUES ('it''s; fine')",
+	}, statements)
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	ctx := context.Background()
+	store, err := openSQLite(":memory:")
+	assert.Nil(t, err)
+	defer store.Close()
+	migrations, err := loadMigrations("sqlite")
+	assert.Nil(t, err)
+
+	pending, err := store.pendingMigrations(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), pending)
+
+	assert.Nil(t, runMigrate(ctx, store, "up", &bytes.Buffer{}))
+	serial, err := store.GetSerial(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), serial)
+	// running it again doesn't do anything
+	assert.Nil(t, store.migrate(ctx, -1))
+	pending, err = store.pendingMigrations(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pending)
+
+	var status bytes.Buffer
+	assert.Nil(t, runMigrate(ctx, store, "status", &status))
+	assert.Contains(t, status.String(), "0001 create_tables")
+	assert.NotContains(t, status.String(), "pending")
+
+	// all the way down and back up again
+	for range migrations {
+		assert.Nil(t, runMigrate(ctx, store, "down", &bytes.Buffer{}))
+	}
+	assert.ErrorContains(t, runMigrate(ctx, store, "down", &bytes.Buffer{}), "nothing to revert")
+	_, err = store.GetSerial(ctx)
+	assert.NotNil(t, err)
+	assert.Nil(t, store.migrate(ctx, -1))
+	serial, err = store.GetSerial(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), serial)
+
+	assert.ErrorContains(t, runMigrate(ctx, store, "sideways", &bytes.Buffer{}), "unknown migrate command")
+	assert.ErrorContains(t, runMigrate(ctx, newMemoryStore(), "up", &bytes.Buffer{}), "doesn't have migrations")
+}
+
+func TestMigrateOldRecords(t *testing.T) {
+	ctx := context.Background()
+	store, err := openSQLite(":memory:")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.migrate(ctx, 5))
+
+	// the way records were stored before: JSON, rrtype as text and no ttl,
+	// and nothing in subdomains for this one
+	content, err := MarshalRecord(&dns.A{
+		Hdr: dns.RR_Header{Name: "www.old.flatbo.at.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	assert.Nil(t, err)
+	_, err = store.db.Exec(
+		"INSERT INTO dns_records (name, subdomain, rrtype, content) VALUES (?, ?, ?, ?)",
+		"www.old.flatbo.at.", "old", "1", string(content),
+	)
+	assert.Nil(t, err)
+	_, err = store.db.Exec("INSERT INTO dns_requests (subdomain, request) VALUES (?, ?)", "old", "{}")
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.migrate(ctx, -1))
+	var rrtype, ttl int
+	var rr string
+	err = store.db.QueryRow("SELECT rrtype, ttl, rr FROM dns_records WHERE subdomain = 'old'").Scan(&rrtype, &ttl, &rr)
+	assert.Nil(t, err)
+	assert.Equal(t, int(dns.TypeA), rrtype)
+	assert.Equal(t, 300, ttl)
+	assert.Equal(t, "www.old.flatbo.at.\t300\tIN\tA\t192.0.2.1", rr)
+	subdomains, err := store.GetSubdomains(ctx, "old")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"old"}, subdomains)
+	records, err := store.GetRecordsForName(ctx, "old")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	var name string
+	err = store.db.QueryRow("SELECT name FROM dns_requests WHERE subdomain = 'old'").Scan(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	// and back to JSON
+	assert.Nil(t, store.migrate(ctx, 9))
+	err = store.db.QueryRow("SELECT content FROM dns_records WHERE subdomain = 'old'").Scan(&content)
+	assert.Nil(t, err)
+	record, err := ParseRecord(content)
+	assert.Nil(t, err)
+	assert.Equal(t, rr, record.String())
+}
+
+func TestMigrateGithubRecords(t *testing.T) {
+	ctx := context.Background()
+	store, err := openSQLite(":memory:")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.migrate(ctx, 6))
+
+	// GitHub logins never got a row in subdomains
+	content, err := MarshalRecord(&dns.A{
+		Hdr: dns.RR_Header{Name: "www.octocat.flatbo.at.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	assert.Nil(t, err)
+	_, err = store.db.Exec(
+		"INSERT INTO dns_records (name, subdomain, rrtype, content) VALUES (?, ?, ?, ?)",
+		"www.octocat.flatbo.at.", "octocat", "1", string(content),
+	)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.migrate(ctx, -1))
+	subdomains, err := store.GetSubdomains(ctx, "octocat")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"octocat"}, subdomains)
+	records, err := store.GetRecordsForName(ctx, "octocat")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestMigrateBadRecord(t *testing.T) {
+	ctx := context.Background()
+	store, err := openSQLite(":memory:")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.migrate(ctx, 9))
+	assert.Nil(t, store.InsertSubdomain(ctx, "bad"))
+	_, err = store.db.Exec(
+		"INSERT INTO dns_records (id, name, subdomain, rrtype, content) VALUES (?, ?, ?, ?, ?)",
+		42, "www.bad.flatbo.at.", "bad", 1, `{"Hdr":{"Rrtype":1},"A":"not an IP"}`,
+	)
+	assert.Nil(t, err)
+
+	// the record isn't thrown away, the migration stops so someone can look
+	err = store.migrate(ctx, -1)
+	assert.ErrorContains(t, err, "[42]")
+	var version int
+	assert.Nil(t, store.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version))
+	assert.Equal(t, 9, version)
+	var content string
+	assert.Nil(t, store.db.QueryRow("SELECT content FROM dns_records WHERE id = 42").Scan(&content))
+	assert.Equal(t, `{"Hdr":{"Rrtype":1},"A":"not an IP"}`, content)
+}
+
+// createSQL is the schema create.sql made before there were migrations
+const createSQL = `
+CREATE TABLE dns_serials (serial INT);
+CREATE TABLE subdomains (name TEXT);
+CREATE TABLE dns_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    request TEXT,
+    response TEXT,
+    src_ip TEXT,
+    src_host TEXT
+);
+CREATE TABLE dns_records (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    rrtype TEXT,
+    content TEXT
+);
+`
+
+func TestMigrateFromCreateSQL(t *testing.T) {
+	ctx := context.Background()
+	store, err := openSQLite(":memory:")
+	assert.Nil(t, err)
+	defer store.Close()
+	for _, statement := range splitStatements(createSQL) {
+		_, err = store.db.Exec(statement)
+		assert.Nil(t, err)
+	}
+	_, err = store.db.Exec("INSERT INTO dns_serials (serial) VALUES (42)")
+	assert.Nil(t, err)
+	content, err := MarshalRecord(makeA("www.old.flatbo.at.", "192.0.2.1"))
+	assert.Nil(t, err)
+	_, err = store.db.Exec(
+		"INSERT INTO dns_records (name, subdomain, rrtype, content) VALUES (?, ?, ?, ?)",
+		"www.old.flatbo.at.", "old", "1", string(content),
+	)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.migrate(ctx, -1))
+	serial, err := store.GetSerial(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), serial)
+	records, err := store.GetRecordsForName(ctx, "old")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	for _, record := range records {
+		assert.Equal(t, defaultWeight, record.Weight)
+		assert.False(t, record.Backup)
+	}
+
+	// and everything since create.sql works
+	assert.Nil(t, store.InsertRecord(ctx, "old", makeA("api.old.flatbo.at.", "192.0.2.2"), RecordOptions{Weight: 3, Backup: true}))
+	assert.Nil(t, store.InsertRequest(ctx, LoggedRequest{
+		Name:      "www.old.flatbo.at.",
+		Subdomain: "old",
+		Request:   []byte("{}"),
+		Response:  []byte("{}"),
+		ECS:       []byte("{}"),
+		Faults:    "delay",
+		Instance:  "test",
+	}))
+	requests, err := store.GetRequests(ctx, "old")
+	assert.Nil(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestMigrateLockedMySQL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	store := &sqlStore{db: db, dialect: mysqlDialect}
+
+	// someone else held on to it the whole time
+	mock.ExpectQuery("SELECT GET_LOCK").
+		WithArgs(migrationLockName, int(migrationLockTimeout.Seconds())).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(0))
+	err = store.migrate(context.Background(), -1)
+	assert.ErrorContains(t, err, "another instance")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
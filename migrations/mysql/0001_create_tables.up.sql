@@ -1,3 +1,7 @@
+-- the tables in create.sql from before there were migrations. IF NOT EXISTS,
+-- so databases made with it start out at version 1, and the migrations after
+-- this one add what's changed since.
+
 CREATE TABLE IF NOT EXISTS dns_serials
 (
     serial INT
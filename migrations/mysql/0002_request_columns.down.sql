@@ -0,0 +1,4 @@
+ALTER TABLE dns_requests
+    DROP instance,
+    DROP faults,
+    DROP ecs;
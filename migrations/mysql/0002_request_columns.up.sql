@@ -0,0 +1,6 @@
+-- the columns for ECS, faults and the instance that answered
+-- one statement, so that it either all happens or none of it does
+ALTER TABLE dns_requests
+    ADD ecs TEXT,
+    ADD faults TEXT,
+    ADD instance TEXT;
@@ -0,0 +1,5 @@
+-- record weights and backups
+-- one statement, so that it either all happens or none of it does
+ALTER TABLE dns_records
+    ADD weight INT NOT NULL DEFAULT 1,
+    ADD backup BOOL NOT NULL DEFAULT FALSE;
@@ -0,0 +1,53 @@
+-- the tables for health checks, policies, settings, behaviors, faults and
+-- reverse slices
+
+CREATE TABLE IF NOT EXISTS dns_health_checks
+(
+    record_id INT NOT NULL PRIMARY KEY,
+    kind TEXT,
+    target TEXT,
+    interval_seconds INT NOT NULL,
+    threshold INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dns_policies
+(
+    name VARCHAR(255) NOT NULL PRIMARY KEY,
+    subdomain TEXT,
+    ordering TEXT,
+    answer_count INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS dns_settings
+(
+    subdomain VARCHAR(255) NOT NULL PRIMARY KEY,
+    ip_names BOOL NOT NULL DEFAULT FALSE,
+    synthesize_https BOOL NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS dns_behaviors
+(
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    kind TEXT,
+    content TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_faults
+(
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    content TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_reverse_slices
+(
+    prefix VARCHAR(64) NOT NULL PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    zone VARCHAR(64),
+    subdomain TEXT
+);
@@ -0,0 +1,3 @@
+INSERT INTO dns_serials (serial)
+SELECT 10 FROM DUAL
+WHERE NOT EXISTS (SELECT * FROM dns_serials);
@@ -0,0 +1,3 @@
+ALTER TABLE subdomains
+    DROP PRIMARY KEY,
+    MODIFY name TEXT;
@@ -0,0 +1,23 @@
+-- subdomains gets a key so that records can point at their owner. GitHub
+-- logins never got a row, so add any that are missing rather than lose the
+-- records.
+--
+-- MySQL can't roll back a migration halfway through, so this is safe to run
+-- again after it fails: the new table is built from scratch, and swapped in
+-- with one RENAME.
+DROP TABLE IF EXISTS subdomains_new;
+
+DROP TABLE IF EXISTS subdomains_old;
+
+CREATE TABLE subdomains_new
+(
+    name VARCHAR(63) NOT NULL PRIMARY KEY
+);
+
+INSERT IGNORE INTO subdomains_new (name) SELECT name FROM subdomains WHERE name IS NOT NULL;
+
+INSERT IGNORE INTO subdomains_new (name) SELECT subdomain FROM dns_records WHERE subdomain IS NOT NULL;
+
+RENAME TABLE subdomains TO subdomains_old, subdomains_new TO subdomains;
+
+DROP TABLE subdomains_old;
@@ -0,0 +1,10 @@
+ALTER TABLE dns_records DROP FOREIGN KEY dns_records_owner;
+
+ALTER TABLE dns_records
+    DROP INDEX dns_records_name,
+    DROP INDEX dns_records_subdomain,
+    DROP INDEX dns_records_created_at,
+    DROP ttl,
+    MODIFY name TEXT,
+    MODIFY subdomain TEXT,
+    MODIFY rrtype TEXT;
@@ -0,0 +1,24 @@
+-- nobody can see or delete records without an owner
+DELETE FROM dns_records WHERE subdomain IS NULL OR name IS NULL;
+
+-- every owner needs a row before the foreign key goes on
+INSERT IGNORE INTO subdomains (name) SELECT DISTINCT subdomain FROM dns_records;
+
+-- the type and TTL come from the record itself, it's what we answer with.
+-- The TTLs are filled in by the next migration.
+UPDATE dns_records SET rrtype = JSON_EXTRACT(content, '$.Hdr.Rrtype');
+
+-- everything above can run again, and this is one statement, so if it fails
+-- the migration can be run again too.
+--
+-- dns_records_owner needs foreign keys, which PlanetScale only allows once
+-- they're turned on in the database's settings.
+ALTER TABLE dns_records
+    MODIFY name VARCHAR(255) NOT NULL,
+    MODIFY subdomain VARCHAR(63) NOT NULL,
+    MODIFY rrtype SMALLINT UNSIGNED NOT NULL,
+    ADD ttl INT UNSIGNED NOT NULL DEFAULT 0 AFTER rrtype,
+    ADD INDEX dns_records_name (name),
+    ADD INDEX dns_records_subdomain (subdomain, created_at),
+    ADD INDEX dns_records_created_at (created_at),
+    ADD CONSTRAINT dns_records_owner FOREIGN KEY (subdomain) REFERENCES subdomains (name) ON DELETE CASCADE;
@@ -0,0 +1 @@
+UPDATE dns_records SET ttl = 0;
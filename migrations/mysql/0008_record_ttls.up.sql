@@ -0,0 +1 @@
+UPDATE dns_records SET ttl = CAST(JSON_EXTRACT(content, '$.Hdr.Ttl') AS UNSIGNED);
@@ -0,0 +1,8 @@
+ALTER TABLE dns_requests
+    DROP INDEX dns_requests_subdomain,
+    DROP INDEX dns_requests_created_at,
+    MODIFY name TEXT,
+    MODIFY subdomain TEXT,
+    MODIFY src_ip TEXT,
+    MODIFY src_host TEXT,
+    MODIFY instance TEXT;
@@ -0,0 +1,15 @@
+-- names in queries can be anything, and escaping makes them up to 4 times
+-- longer than on the wire
+UPDATE dns_requests SET name = '' WHERE name IS NULL;
+
+UPDATE dns_requests SET subdomain = '' WHERE subdomain IS NULL;
+
+-- one statement, so that if it fails the migration can be run again
+ALTER TABLE dns_requests
+    MODIFY name VARCHAR(1024) NOT NULL,
+    MODIFY subdomain VARCHAR(255) NOT NULL,
+    MODIFY src_ip VARCHAR(45),
+    MODIFY src_host VARCHAR(255),
+    MODIFY instance VARCHAR(64),
+    ADD INDEX dns_requests_subdomain (subdomain, created_at),
+    ADD INDEX dns_requests_created_at (created_at);
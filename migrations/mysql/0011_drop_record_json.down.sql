@@ -0,0 +1,3 @@
+ALTER TABLE dns_records
+    ADD content TEXT AFTER rr,
+    MODIFY rr TEXT;
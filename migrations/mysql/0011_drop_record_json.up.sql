@@ -0,0 +1,3 @@
+ALTER TABLE dns_records
+    DROP content,
+    MODIFY rr TEXT NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE subdomains DROP serial;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS dns_records;
+DROP TABLE IF EXISTS dns_requests;
+DROP TABLE IF EXISTS subdomains;
+DROP TABLE IF EXISTS dns_serials;
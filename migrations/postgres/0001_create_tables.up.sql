@@ -0,0 +1,35 @@
+-- the tables in create.sql from before there were migrations. IF NOT EXISTS,
+-- so databases made with it start out at version 1, and the migrations after
+-- this one add what's changed since.
+
+CREATE TABLE IF NOT EXISTS dns_serials
+(
+    serial BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS subdomains
+(
+    name TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_requests
+(
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    name TEXT,
+    subdomain TEXT,
+    request TEXT,
+    response TEXT,
+    src_ip TEXT,
+    src_host TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_records
+(
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    name TEXT,
+    subdomain TEXT,
+    rrtype TEXT,
+    content JSONB
+);
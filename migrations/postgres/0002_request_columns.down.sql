@@ -0,0 +1,4 @@
+ALTER TABLE dns_requests
+    DROP COLUMN instance,
+    DROP COLUMN faults,
+    DROP COLUMN ecs;
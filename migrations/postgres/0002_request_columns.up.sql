@@ -0,0 +1,5 @@
+-- the columns for ECS, faults and the instance that answered
+ALTER TABLE dns_requests
+    ADD COLUMN ecs TEXT,
+    ADD COLUMN faults TEXT,
+    ADD COLUMN instance TEXT;
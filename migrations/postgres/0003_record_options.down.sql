@@ -0,0 +1,3 @@
+ALTER TABLE dns_records
+    DROP COLUMN backup,
+    DROP COLUMN weight;
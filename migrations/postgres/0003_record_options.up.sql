@@ -0,0 +1,4 @@
+-- record weights and backups
+ALTER TABLE dns_records
+    ADD COLUMN weight INT NOT NULL DEFAULT 1,
+    ADD COLUMN backup BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS dns_reverse_slices;
+DROP TABLE IF EXISTS dns_faults;
+DROP TABLE IF EXISTS dns_behaviors;
+DROP TABLE IF EXISTS dns_settings;
+DROP TABLE IF EXISTS dns_policies;
+DROP TABLE IF EXISTS dns_health_checks;
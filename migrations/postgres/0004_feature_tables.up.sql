@@ -0,0 +1,53 @@
+-- the tables for health checks, policies, settings, behaviors, faults and
+-- reverse slices
+
+CREATE TABLE IF NOT EXISTS dns_health_checks
+(
+    record_id INT NOT NULL PRIMARY KEY,
+    kind TEXT,
+    target TEXT,
+    interval_seconds INT NOT NULL,
+    threshold INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dns_policies
+(
+    name TEXT NOT NULL PRIMARY KEY,
+    subdomain TEXT,
+    ordering TEXT,
+    answer_count INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS dns_settings
+(
+    subdomain TEXT NOT NULL PRIMARY KEY,
+    ip_names BOOLEAN NOT NULL DEFAULT FALSE,
+    synthesize_https BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS dns_behaviors
+(
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    name TEXT,
+    subdomain TEXT,
+    kind TEXT,
+    content JSONB
+);
+
+CREATE TABLE IF NOT EXISTS dns_faults
+(
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    name TEXT,
+    subdomain TEXT,
+    content JSONB
+);
+
+CREATE TABLE IF NOT EXISTS dns_reverse_slices
+(
+    prefix VARCHAR(64) NOT NULL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    zone VARCHAR(64),
+    subdomain TEXT
+);
@@ -0,0 +1,3 @@
+INSERT INTO dns_serials (serial)
+SELECT 10
+WHERE NOT EXISTS (SELECT * FROM dns_serials);
@@ -0,0 +1,4 @@
+ALTER TABLE subdomains
+    DROP CONSTRAINT subdomains_pkey,
+    ALTER COLUMN name TYPE TEXT,
+    ALTER COLUMN name DROP NOT NULL;
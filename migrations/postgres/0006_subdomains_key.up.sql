@@ -0,0 +1,14 @@
+-- subdomains gets a key so that records can point at their owner. GitHub
+-- logins never got a row, so add any that are missing rather than lose the
+-- records.
+DELETE FROM subdomains WHERE name IS NULL;
+
+DELETE FROM subdomains a USING subdomains b WHERE a.name = b.name AND a.ctid < b.ctid;
+
+INSERT INTO subdomains (name)
+SELECT DISTINCT subdomain FROM dns_records
+WHERE subdomain IS NOT NULL AND subdomain NOT IN (SELECT name FROM subdomains);
+
+ALTER TABLE subdomains
+    ALTER COLUMN name TYPE VARCHAR(63),
+    ADD PRIMARY KEY (name);
@@ -0,0 +1,15 @@
+DROP INDEX IF EXISTS dns_records_name;
+
+DROP INDEX IF EXISTS dns_records_subdomain;
+
+DROP INDEX IF EXISTS dns_records_created_at;
+
+ALTER TABLE dns_records
+    DROP CONSTRAINT dns_records_owner,
+    DROP COLUMN ttl,
+    ALTER COLUMN name TYPE TEXT,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN subdomain TYPE TEXT,
+    ALTER COLUMN subdomain DROP NOT NULL,
+    ALTER COLUMN rrtype TYPE TEXT,
+    ALTER COLUMN rrtype DROP NOT NULL;
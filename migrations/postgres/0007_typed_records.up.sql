@@ -0,0 +1,25 @@
+-- nobody can see or delete records without an owner
+DELETE FROM dns_records WHERE subdomain IS NULL OR name IS NULL;
+
+-- every owner needs a row before the foreign key goes on
+INSERT INTO subdomains (name)
+SELECT DISTINCT subdomain FROM dns_records
+WHERE subdomain NOT IN (SELECT name FROM subdomains);
+
+-- the type and TTL come from the record itself, it's what we answer with.
+-- The TTLs are filled in by the next migration.
+ALTER TABLE dns_records
+    ALTER COLUMN name TYPE VARCHAR(255),
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN subdomain TYPE VARCHAR(63),
+    ALTER COLUMN subdomain SET NOT NULL,
+    ALTER COLUMN rrtype TYPE INT USING CAST(content->'Hdr'->>'Rrtype' AS INT),
+    ALTER COLUMN rrtype SET NOT NULL,
+    ADD COLUMN ttl BIGINT NOT NULL DEFAULT 0,
+    ADD CONSTRAINT dns_records_owner FOREIGN KEY (subdomain) REFERENCES subdomains (name) ON DELETE CASCADE;
+
+CREATE INDEX dns_records_name ON dns_records (name);
+
+CREATE INDEX dns_records_subdomain ON dns_records (subdomain, created_at);
+
+CREATE INDEX dns_records_created_at ON dns_records (created_at);
@@ -0,0 +1 @@
+UPDATE dns_records SET ttl = CAST(content->'Hdr'->>'Ttl' AS BIGINT);
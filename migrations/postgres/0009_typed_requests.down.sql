@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS dns_requests_subdomain;
+
+DROP INDEX IF EXISTS dns_requests_created_at;
+
+ALTER TABLE dns_requests
+    ALTER COLUMN name TYPE TEXT,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN subdomain TYPE TEXT,
+    ALTER COLUMN subdomain DROP NOT NULL,
+    ALTER COLUMN src_ip TYPE TEXT,
+    ALTER COLUMN src_host TYPE TEXT,
+    ALTER COLUMN instance TYPE TEXT;
@@ -0,0 +1,18 @@
+-- names in queries can be anything, and escaping makes them up to 4 times
+-- longer than on the wire
+UPDATE dns_requests SET name = '' WHERE name IS NULL;
+
+UPDATE dns_requests SET subdomain = '' WHERE subdomain IS NULL;
+
+ALTER TABLE dns_requests
+    ALTER COLUMN name TYPE VARCHAR(1024),
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN subdomain TYPE VARCHAR(255),
+    ALTER COLUMN subdomain SET NOT NULL,
+    ALTER COLUMN src_ip TYPE VARCHAR(45),
+    ALTER COLUMN src_host TYPE VARCHAR(255),
+    ALTER COLUMN instance TYPE VARCHAR(64);
+
+CREATE INDEX dns_requests_subdomain ON dns_requests (subdomain, created_at);
+
+CREATE INDEX dns_requests_created_at ON dns_requests (created_at);
@@ -0,0 +1,3 @@
+ALTER TABLE dns_records
+    ADD COLUMN content JSONB,
+    ALTER COLUMN rr DROP NOT NULL;
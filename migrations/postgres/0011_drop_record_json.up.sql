@@ -0,0 +1,3 @@
+ALTER TABLE dns_records
+    DROP COLUMN content,
+    ALTER COLUMN rr SET NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE dns_record_history;
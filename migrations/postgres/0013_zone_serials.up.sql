@@ -0,0 +1,3 @@
+-- the serial each subdomain's records last changed at, for checking a plan
+-- or an undo against. The history can't tell, it gets pruned.
+ALTER TABLE subdomains ADD COLUMN serial BIGINT NOT NULL DEFAULT 0;
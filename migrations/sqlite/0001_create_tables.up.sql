@@ -0,0 +1,35 @@
+-- the tables in create.sql from before there were migrations. IF NOT EXISTS,
+-- so databases made with it start out at version 1, and the migrations after
+-- this one add what's changed since.
+
+CREATE TABLE IF NOT EXISTS dns_serials
+(
+    serial INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS subdomains
+(
+    name TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_requests
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    request TEXT,
+    response TEXT,
+    src_ip TEXT,
+    src_host TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_records
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    rrtype TEXT,
+    content TEXT
+);
@@ -0,0 +1,3 @@
+ALTER TABLE dns_requests DROP COLUMN instance;
+ALTER TABLE dns_requests DROP COLUMN faults;
+ALTER TABLE dns_requests DROP COLUMN ecs;
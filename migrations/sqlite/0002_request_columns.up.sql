@@ -0,0 +1,4 @@
+-- the columns for ECS, faults and the instance that answered
+ALTER TABLE dns_requests ADD COLUMN ecs TEXT;
+ALTER TABLE dns_requests ADD COLUMN faults TEXT;
+ALTER TABLE dns_requests ADD COLUMN instance TEXT;
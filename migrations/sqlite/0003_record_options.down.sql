@@ -0,0 +1,2 @@
+ALTER TABLE dns_records DROP COLUMN backup;
+ALTER TABLE dns_records DROP COLUMN weight;
@@ -0,0 +1,3 @@
+-- record weights and backups
+ALTER TABLE dns_records ADD COLUMN weight INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE dns_records ADD COLUMN backup BOOLEAN NOT NULL DEFAULT FALSE;
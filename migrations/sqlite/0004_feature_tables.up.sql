@@ -0,0 +1,53 @@
+-- the tables for health checks, policies, settings, behaviors, faults and
+-- reverse slices
+
+CREATE TABLE IF NOT EXISTS dns_health_checks
+(
+    record_id INTEGER NOT NULL PRIMARY KEY,
+    kind TEXT,
+    target TEXT,
+    interval_seconds INTEGER NOT NULL,
+    threshold INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dns_policies
+(
+    name TEXT NOT NULL PRIMARY KEY,
+    subdomain TEXT,
+    ordering TEXT,
+    answer_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS dns_settings
+(
+    subdomain TEXT NOT NULL PRIMARY KEY,
+    ip_names BOOLEAN NOT NULL DEFAULT FALSE,
+    synthesize_https BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS dns_behaviors
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    kind TEXT,
+    content TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_faults
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    content TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dns_reverse_slices
+(
+    prefix TEXT NOT NULL PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    zone TEXT,
+    subdomain TEXT
+);
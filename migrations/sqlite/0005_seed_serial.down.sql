@@ -0,0 +1 @@
+DELETE FROM dns_serials;
@@ -0,0 +1,10 @@
+CREATE TABLE subdomains_old
+(
+    name TEXT
+);
+
+INSERT INTO subdomains_old (name) SELECT name FROM subdomains;
+
+DROP TABLE subdomains;
+
+ALTER TABLE subdomains_old RENAME TO subdomains;
@@ -0,0 +1,15 @@
+-- SQLite can't change columns, so the table is rebuilt. subdomains gets a
+-- key so that records can point at their owner. GitHub logins never got a
+-- row, so add any that are missing rather than lose the records.
+CREATE TABLE subdomains_new
+(
+    name VARCHAR(63) NOT NULL PRIMARY KEY
+);
+
+INSERT OR IGNORE INTO subdomains_new (name) SELECT name FROM subdomains WHERE name IS NOT NULL;
+
+INSERT OR IGNORE INTO subdomains_new (name) SELECT subdomain FROM dns_records WHERE subdomain IS NOT NULL;
+
+DROP TABLE subdomains;
+
+ALTER TABLE subdomains_new RENAME TO subdomains;
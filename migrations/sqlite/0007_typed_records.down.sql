@@ -0,0 +1,19 @@
+CREATE TABLE dns_records_old
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    rrtype TEXT,
+    content TEXT,
+    weight INTEGER NOT NULL DEFAULT 1,
+    backup BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO dns_records_old (id, created_at, name, subdomain, rrtype, content, weight, backup)
+SELECT id, created_at, name, subdomain, rrtype, content, weight, backup
+FROM dns_records;
+
+DROP TABLE dns_records;
+
+ALTER TABLE dns_records_old RENAME TO dns_records;
@@ -0,0 +1,34 @@
+-- the type and TTL come from the record itself, it's what we answer with,
+-- and the TTLs are filled in by the next migration. Nobody can see or
+-- delete records without an owner, so they're left behind.
+-- every owner needs a row before the foreign key goes on
+INSERT OR IGNORE INTO subdomains (name)
+SELECT DISTINCT subdomain FROM dns_records WHERE subdomain IS NOT NULL;
+
+CREATE TABLE dns_records_new
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name VARCHAR(255) NOT NULL,
+    subdomain VARCHAR(63) NOT NULL REFERENCES subdomains (name) ON DELETE CASCADE,
+    rrtype INTEGER NOT NULL,
+    ttl INTEGER NOT NULL DEFAULT 0,
+    content TEXT,
+    weight INTEGER NOT NULL DEFAULT 1,
+    backup BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO dns_records_new (id, created_at, name, subdomain, rrtype, content, weight, backup)
+SELECT id, created_at, name, subdomain, json_extract(content, '$.Hdr.Rrtype'), content, weight, backup
+FROM dns_records
+WHERE subdomain IS NOT NULL AND name IS NOT NULL;
+
+DROP TABLE dns_records;
+
+ALTER TABLE dns_records_new RENAME TO dns_records;
+
+CREATE INDEX dns_records_name ON dns_records (name);
+
+CREATE INDEX dns_records_subdomain ON dns_records (subdomain, created_at);
+
+CREATE INDEX dns_records_created_at ON dns_records (created_at);
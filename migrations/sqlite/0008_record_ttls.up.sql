@@ -0,0 +1 @@
+UPDATE dns_records SET ttl = json_extract(content, '$.Hdr.Ttl');
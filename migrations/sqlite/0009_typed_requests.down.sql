@@ -0,0 +1,20 @@
+CREATE TABLE dns_requests_old
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name TEXT,
+    subdomain TEXT,
+    request TEXT,
+    response TEXT,
+    src_ip TEXT,
+    src_host TEXT,
+    ecs TEXT,
+    faults TEXT,
+    instance TEXT
+);
+
+INSERT INTO dns_requests_old SELECT * FROM dns_requests;
+
+DROP TABLE dns_requests;
+
+ALTER TABLE dns_requests_old RENAME TO dns_requests;
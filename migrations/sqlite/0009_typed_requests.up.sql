@@ -0,0 +1,29 @@
+-- names in queries can be anything, and escaping makes them up to 4 times
+-- longer than on the wire. SQLite can't change columns, so the table is
+-- rebuilt.
+CREATE TABLE dns_requests_new
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name VARCHAR(1024) NOT NULL,
+    subdomain VARCHAR(255) NOT NULL,
+    request TEXT,
+    response TEXT,
+    src_ip VARCHAR(45),
+    src_host VARCHAR(255),
+    ecs TEXT,
+    faults TEXT,
+    instance VARCHAR(64)
+);
+
+INSERT INTO dns_requests_new (id, created_at, name, subdomain, request, response, src_ip, src_host, ecs, faults, instance)
+SELECT id, created_at, COALESCE(name, ''), COALESCE(subdomain, ''), request, response, src_ip, src_host, ecs, faults, instance
+FROM dns_requests;
+
+DROP TABLE dns_requests;
+
+ALTER TABLE dns_requests_new RENAME TO dns_requests;
+
+CREATE INDEX dns_requests_subdomain ON dns_requests (subdomain, created_at);
+
+CREATE INDEX dns_requests_created_at ON dns_requests (created_at);
@@ -0,0 +1 @@
+ALTER TABLE dns_records DROP COLUMN rr;
@@ -0,0 +1,3 @@
+-- records in presentation format, filled in from content by
+-- recordsToPresentation in migrate.go
+ALTER TABLE dns_records ADD COLUMN rr TEXT;
@@ -0,0 +1 @@
+ALTER TABLE dns_records ADD COLUMN content TEXT;
@@ -0,0 +1,27 @@
+-- SQLite can't make a column NOT NULL, so the table is rebuilt
+CREATE TABLE dns_records_new
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    name VARCHAR(255) NOT NULL,
+    subdomain VARCHAR(63) NOT NULL REFERENCES subdomains (name) ON DELETE CASCADE,
+    rrtype INTEGER NOT NULL,
+    ttl INTEGER NOT NULL,
+    rr TEXT NOT NULL,
+    weight INTEGER NOT NULL DEFAULT 1,
+    backup BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO dns_records_new (id, created_at, name, subdomain, rrtype, ttl, rr, weight, backup)
+SELECT id, created_at, name, subdomain, rrtype, ttl, rr, weight, backup
+FROM dns_records;
+
+DROP TABLE dns_records;
+
+ALTER TABLE dns_records_new RENAME TO dns_records;
+
+CREATE INDEX dns_records_name ON dns_records (name);
+
+CREATE INDEX dns_records_subdomain ON dns_records (subdomain, created_at);
+
+CREATE INDEX dns_records_created_at ON dns_records (created_at);
@@ -0,0 +1,19 @@
+-- every change to dns_records, for GET /history, undo and restore. Rows are
+-- only ever added, until they're older than the history retention.
+CREATE TABLE dns_record_history
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    subdomain VARCHAR(63) NOT NULL,
+    record_id INTEGER NOT NULL,
+    op VARCHAR(16) NOT NULL,
+    actor VARCHAR(63) NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    serial_before BIGINT NOT NULL,
+    serial_after BIGINT NOT NULL
+);
+
+CREATE INDEX dns_record_history_subdomain ON dns_record_history (subdomain, id);
+
+CREATE INDEX dns_record_history_created_at ON dns_record_history (created_at);
@@ -0,0 +1 @@
+UPDATE subdomains SET serial = 0;
@@ -0,0 +1,3 @@
+-- nobody knows when zones last changed, so say it was now. Plans made before
+-- this had history IDs for serials, and have to be made again.
+UPDATE subdomains SET serial = (SELECT serial FROM dns_serials);
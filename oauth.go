@@ -2,11 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/gorilla/securecookie"
 	"golang.org/x/oauth2"
@@ -21,26 +19,19 @@ type GithubUser struct {
 }
 
 func getSecureCookie() *securecookie.SecureCookie {
-	decoded, err := base64.StdEncoding.DecodeString(os.Getenv("HASH_KEY"))
+	// the config was validated at startup
+	hashKey, err := decodeKey(cfg.HashKey)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprintf("hash_key %s", err.Error()))
 	}
-	hashKey := decoded
-	if len(hashKey) != 32 {
-		panic("HASH_KEY must be 32 bytes")
-	}
-	decoded, err = base64.StdEncoding.DecodeString(os.Getenv("BLOCK_KEY"))
+	blockKey, err := decodeKey(cfg.BlockKey)
 	if err != nil {
-		panic(err)
-	}
-	blockKey := decoded
-	if len(blockKey) != 32 {
-		panic("BLOCK_KEY must be 32 bytes")
+		panic(fmt.Sprintf("block_key %s", err.Error()))
 	}
 	return securecookie.New(hashKey, blockKey)
 }
 
-func oauthCallback(w http.ResponseWriter, r *http.Request) {
+func oauthCallback(store RecordStore, w http.ResponseWriter, r *http.Request) {
 	// get code from query
 	code := r.URL.Query().Get("code")
 	if code == "" {
@@ -69,12 +60,22 @@ func oauthCallback(w http.ResponseWriter, r *http.Request) {
 		returnError(w, err, http.StatusInternalServerError)
 		return
 	}
+	loginGithub(store, user.Login, w, r)
+}
+
+// loginGithub logs in as the GitHub user's own subdomain, which has to
+// exist before they can make records in it
+func loginGithub(store RecordStore, login string, w http.ResponseWriter, r *http.Request) {
+	err := store.EnsureSubdomain(r.Context(), login)
+	if err != nil {
+		returnError(w, err, http.StatusInternalServerError)
+		return
+	}
 	// create a secure cookie
-	setCookie(w, r, user.Login)
+	setCookie(w, r, login)
 
 	// redirect to index
 	http.Redirect(w, r, "/", http.StatusFound)
-
 }
 
 func setCookie(w http.ResponseWriter, r *http.Request, subdomain string) {
@@ -108,26 +109,25 @@ func setCookie(w http.ResponseWriter, r *http.Request, subdomain string) {
 }
 
 func ReadSessionUsername(r *http.Request) (string, error) {
-	sc := getSecureCookie()
 	var user UserCookie
 	// get session cookie
 	cookie, err := r.Cookie("session")
 	if err != nil {
 		return "", err
 	}
+	sc := getSecureCookie()
 	err = sc.Decode("session", cookie.Value, &user)
 	if err != nil {
 		return "", err
 	}
-	fmt.Println("user:", user.User)
 	return user.User, nil
 }
 
 func oauthConfig() *oauth2.Config {
-	clientID := os.Getenv("GITHUB_CLIENT_ID")
-	clientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
+	clientID := cfg.GitHubClientID
+	clientSecret := cfg.GitHubClientSecret
 	if clientID == "" || clientSecret == "" {
-		panic("GITHUB_CLIENT_ID or GITHUB_CLIENT_SECRET not found")
+		panic("github_client_id or github_client_secret not configured")
 	}
 	return &oauth2.Config{
 		ClientID:     clientID,
@@ -1,15 +1,45 @@
 package main
 
 import (
-	"os"
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSecureCookie(t *testing.T) {
 	// not the real key
 	base64Hash := "/JLayjTcQf0wl/YifN7WqyP6U1+y/qnxxNzhbQ1Falk="
 	base64Block := "SaJ+upj49i3BzLP46bUh5g860DgB+V5z4zuTlevI9ug="
-	os.Setenv("HASH_KEY", base64Hash)
-	os.Setenv("BLOCK_KEY", base64Block)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.HashKey = base64Hash
+	cfg.BlockKey = base64Block
 	getSecureCookie()
 }
+
+func TestGithubUserRecords(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.HashKey = "/JLayjTcQf0wl/YifN7WqyP6U1+y/qnxxNzhbQ1Falk="
+	cfg.BlockKey = "SaJ+upj49i3BzLP46bUh5g860DgB+V5z4zuTlevI9ug="
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// GitHub users never go through loginRandom, and can log in
+			// more than once
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				loginGithub(store, "octocat", w, httptest.NewRequest("GET", "/oauth-callback", nil))
+				assert.Equal(t, http.StatusFound, w.Code)
+			}
+			err := store.InsertRecord(ctx, "octocat", makeA("www.octocat.flatbo.at.", "192.0.2.1"), defaultOptions())
+			assert.Nil(t, err)
+			records, err := store.GetRecordsForName(ctx, "octocat")
+			assert.Nil(t, err)
+			assert.Len(t, records, 1)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How the answers for a name are ordered. Fixed is the default: newest
+// record first, every time.
+const (
+	OrderFixed      = "fixed"
+	OrderRoundRobin = "round-robin"
+	OrderRandom     = "random"
+	OrderWeighted   = "weighted"
+)
+
+var orderings = map[string]bool{
+	OrderFixed:      true,
+	OrderRoundRobin: true,
+	OrderRandom:     true,
+	OrderWeighted:   true,
+}
+
+const defaultWeight = 1
+
+// Policy is the answer ordering for a name.
+type Policy struct {
+	Name     string `json:"name"`
+	Ordering string `json:"ordering"`
+	// AnswerCount limits how many records we answer with, 0 means all of them
+	AnswerCount int `json:"answer_count"`
+}
+
+func validatePolicy(policy Policy) error {
+	if _, ok := orderings[policy.Ordering]; !ok {
+		return fmt.Errorf("unknown ordering '%s'", policy.Ordering)
+	}
+	if policy.AnswerCount < 0 {
+		return fmt.Errorf("answer count can't be negative")
+	}
+	return nil
+}
+
+func validateWeight(weight int) error {
+	if weight < 0 || weight > 1000 {
+		return fmt.Errorf("weight must be between 0 and 1000")
+	}
+	return nil
+}
+
+type rotation struct {
+	n        int
+	lastUsed time.Time
+}
+
+var rotations = struct {
+	sync.Mutex
+	m map[string]*rotation
+}{m: make(map[string]*rotation)}
+
+// nextRotation returns how far to rotate the answers for name this time
+func nextRotation(name string) int {
+	rotations.Lock()
+	defer rotations.Unlock()
+	r, ok := rotations.m[name]
+	if !ok {
+		r = &rotation{}
+		rotations.m[name] = r
+	}
+	n := r.n
+	r.n++
+	r.lastUsed = time.Now()
+	return n
+}
+
+func currentRotation(name string) int {
+	rotations.Lock()
+	defer rotations.Unlock()
+	if r, ok := rotations.m[name]; ok {
+		return r.n
+	}
+	return 0
+}
+
+// forgetOldRotations drops the rotations of names that haven't been asked
+// for since cutoff. By then their records are gone, so the next records
+// start from the top anyway.
+func forgetOldRotations(cutoff time.Time) {
+	rotations.Lock()
+	defer rotations.Unlock()
+	for name, r := range rotations.m {
+		if r.lastUsed.Before(cutoff) {
+			delete(rotations.m, name)
+		}
+	}
+}
+
+func (policy Policy) Order(records []Record) []dns.RR {
+	return policy.order(records, nextRotation)
+}
+
+// Peek is Order without moving the rotation on
+func (policy Policy) Peek(records []Record) []dns.RR {
+	return policy.order(records, currentRotation)
+}
+
+func (policy Policy) order(records []Record, rotation func(name string) int) []dns.RR {
+	ordered := make([]Record, len(records))
+	copy(ordered, records)
+	switch policy.Ordering {
+	case OrderRoundRobin:
+		if len(ordered) > 0 {
+			n := rotation(policy.Name) % len(ordered)
+			ordered = append(ordered[n:], ordered[:n]...)
+		}
+	case OrderRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case OrderWeighted:
+		ordered = weightedShuffle(ordered)
+	}
+	if policy.AnswerCount > 0 && policy.AnswerCount < len(ordered) {
+		ordered = ordered[:policy.AnswerCount]
+	}
+	result := make([]dns.RR, 0, len(ordered))
+	for _, record := range ordered {
+		result = append(result, record.RR)
+	}
+	return result
+}
+
+// weightedShuffle picks records one at a time, each with a probability
+// proportional to its weight. Records with weight 0 are left out unless
+// nothing else is left.
+func weightedShuffle(records []Record) []Record {
+	remaining := make([]Record, len(records))
+	copy(remaining, records)
+	shuffled := make([]Record, 0, len(records))
+	for len(remaining) > 0 {
+		total := 0
+		for _, record := range remaining {
+			total += record.Weight
+		}
+		if total == 0 {
+			break
+		}
+		n := rand.Intn(total)
+		for i, record := range remaining {
+			if n < record.Weight {
+				shuffled = append(shuffled, record)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			n -= record.Weight
+		}
+	}
+	if len(shuffled) == 0 {
+		return remaining
+	}
+	return shuffled
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeWeighted(weights ...int) []Record {
+	records := make([]Record, 0)
+	for i, weight := range weights {
+		ip := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}[i]
+		records = append(records, Record{RR: makeA("test.flatbo.at.", ip), Weight: weight})
+	}
+	return records
+}
+
+func TestRoundRobin(t *testing.T) {
+	policy := Policy{Name: randString(10) + ".flatbo.at.", Ordering: OrderRoundRobin}
+	records := makeWeighted(1, 1, 1)
+	assert.Equal(t, records[0].RR, policy.Order(records)[0])
+	assert.Equal(t, records[1].RR, policy.Order(records)[0])
+	assert.Equal(t, records[2].RR, policy.Order(records)[0])
+	assert.Equal(t, records[0].RR, policy.Order(records)[0])
+	assert.Equal(t, records[1].RR, policy.Peek(records)[0])
+
+	// once the name hasn't been asked for in a while it starts over
+	forgetOldRotations(time.Now().Add(-time.Hour))
+	assert.Equal(t, records[1].RR, policy.Order(records)[0])
+	forgetOldRotations(time.Now().Add(time.Hour))
+	assert.Equal(t, records[0].RR, policy.Order(records)[0])
+}
+
+func TestWeighted(t *testing.T) {
+	policy := Policy{Ordering: OrderWeighted, AnswerCount: 1}
+	records := makeWeighted(0, 5, 0)
+	for i := 0; i < 20; i++ {
+		answers := policy.Order(records)
+		assert.Equal(t, 1, len(answers))
+		assert.Equal(t, records[1].RR, answers[0])
+	}
+	// with nothing weighted, everything is fair game
+	assert.Equal(t, 2, len(Policy{Ordering: OrderWeighted}.Order(makeWeighted(0, 0))))
+}
+
+func TestParseWeight(t *testing.T) {
+	options, err := ParseRecordOptions([]byte(`{"Hdr":{"Name":"a.test.flatbo.at."}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultWeight, options.Weight)
+
+	options, err = ParseRecordOptions([]byte(`{"Weight":0}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, options.Weight)
+
+	_, err = ParseRecordOptions([]byte(`{"Weight":-1}`))
+	assert.NotNil(t, err)
+}
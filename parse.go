@@ -26,6 +26,49 @@ func ParseRecord(jsonString []byte) (dns.RR, error) {
 	return rr, nil
 }
 
+// FormatRecord is how records are stored: one line of RFC 1035 presentation
+// format, like "www.example.com. 300 IN A 192.0.2.1", which doesn't change
+// when the dns library's structs do. Some types (ANY, OPT, ...) have no
+// presentation format we can read back, so those are an error.
+func FormatRecord(rr dns.RR) (string, error) {
+	text := rr.String()
+	_, err := ParsePresentation(text)
+	if err != nil {
+		return "", fmt.Errorf("can't store %s record: %s", dns.TypeToString[rr.Header().Rrtype], err.Error())
+	}
+	return text, nil
+}
+
+// ParsePresentation reads a record written by FormatRecord
+func ParsePresentation(text string) (dns.RR, error) {
+	rr, err := dns.NewRR(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RR: %s", err.Error())
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("invalid RR: %q is empty", text)
+	}
+	return rr, nil
+}
+
+// ParseRecordOptions reads the settings that can be sent along with a record
+func ParseRecordOptions(jsonString []byte) (RecordOptions, error) {
+	options := RecordOptions{Weight: defaultWeight}
+	err := json.Unmarshal(jsonString, &options)
+	if err != nil {
+		return RecordOptions{}, err
+	}
+	if err := validateWeight(options.Weight); err != nil {
+		return RecordOptions{}, err
+	}
+	if options.HealthCheck != nil {
+		if err := validateHealthCheck(options.HealthCheck); err != nil {
+			return RecordOptions{}, err
+		}
+	}
+	return options, nil
+}
+
 func parseRecord(jsonString []byte) (dns.RR, error) {
 	var unknown UnknownRequest
 	err := json.Unmarshal([]byte(jsonString), &unknown)
@@ -219,12 +262,7 @@ func parseRecord(jsonString []byte) (dns.RR, error) {
 		return &hip, nil
 
 	case dns.TypeHTTPS:
-		var https dns.HTTPS
-		err = json.Unmarshal([]byte(jsonString), &https)
-		if err != nil {
-			return nil, err
-		}
-		return &https, nil
+		return parseSVCB(jsonString)
 
 	case dns.TypeKEY:
 		var key dns.KEY
@@ -515,12 +553,7 @@ func parseRecord(jsonString []byte) (dns.RR, error) {
 		return &sshfp, nil
 
 	case dns.TypeSVCB:
-		var svcb dns.SVCB
-		err = json.Unmarshal([]byte(jsonString), &svcb)
-		if err != nil {
-			return nil, err
-		}
-		return &svcb, nil
+		return parseSVCB(jsonString)
 
 	case dns.TypeTA:
 		var ta dns.TA
@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,6 +14,27 @@ func TestParseMX(t *testing.T) {
 	assert.Equal(t, x.String(), "example.com.	3600	IN	MX	10 mail.example.com.")
 }
 
+func TestPresentationFormat(t *testing.T) {
+	for _, text := range []string{
+		"example.com.	3600	IN	MX	10 mail.example.com.",
+		"example.com.	300	IN	TXT	\"v=spf1 -all\" \"has \\\"quotes\\\" and; semicolons\"",
+		"example.com.	300	IN	CAA	0 issue \"letsencrypt.org\"",
+		"_sip._tcp.example.com.	300	IN	SRV	10 60 5060 sip.example.com.",
+		"example.com.	300	IN	HTTPS	1 . alpn=\"h2,h3\" ipv4hint=\"192.0.2.1\"",
+	} {
+		rr, err := ParsePresentation(text)
+		assert.Nil(t, err, text)
+		formatted, err := FormatRecord(rr)
+		assert.Nil(t, err, text)
+		assert.Equal(t, text, formatted)
+	}
+
+	_, err := FormatRecord(&dns.ANY{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeANY, Class: dns.ClassINET}})
+	assert.ErrorContains(t, err, "can't store ANY record")
+	_, err = ParsePresentation("")
+	assert.NotNil(t, err)
+}
+
 func TestInvalidFqdn(t *testing.T) {
 	jsonString := `{"Hdr":{"Name":"example.com.","Rrtype":15,"Class":1,"Ttl":3600,"Rdlength":0},"Preference":10,"Mx":"mail.example.com"}`
 	_, err := ParseRecord([]byte(jsonString))
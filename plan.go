@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PUT /zone takes the whole zone the user wants, as a master file like the
+// one GET /zone returns, and works out what it would take to get there:
+//
+//	PUT /zone            returns the plan and changes nothing
+//	PUT /zone?serial=N   applies the plan, if the zone's serial is still N
+//
+// The plan has the serial it was made at, so applying it is the same PUT
+// with that serial. That's the serial of just the user's zone, not the SOA
+// serial, so other users' changes don't get in the way. If the user's
+// records changed in between the apply fails with 409 and nothing happens.
+// Records that stay or only change keep their weights, backups and health
+// checks.
+
+// PlanEntry is one record in a plan. Changes have both the old and new
+// values.
+type PlanEntry struct {
+	ID     int    `json:"id,omitempty"`
+	Record string `json:"record,omitempty"`
+	Old    string `json:"old,omitempty"`
+}
+
+type ZonePlan struct {
+	Serial   uint32      `json:"serial"`
+	Add      []PlanEntry `json:"add"`
+	Change   []PlanEntry `json:"change"`
+	Delete   []PlanEntry `json:"delete"`
+	Warnings []string    `json:"warnings"`
+
+	changes []RecordChange
+}
+
+// planZone compares the records the user has with the ones they want. A
+// record with the same data is kept, then the rest are paired up by name
+// and type to be changed, and anything left over is added or deleted.
+func planZone(serial uint32, current map[int]Record, desired []dns.RR) *ZonePlan {
+	plan := &ZonePlan{
+		Serial:   serial,
+		Add:      []PlanEntry{},
+		Change:   []PlanEntry{},
+		Delete:   []PlanEntry{},
+		Warnings: []string{},
+	}
+	ids := make([]int, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var wanted []dns.RR
+	for _, rr := range desired {
+		duplicate := false
+		for _, other := range wanted {
+			if dns.IsDuplicate(rr, other) {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s is in the zone more than once", rr.String()))
+			continue
+		}
+		wanted = append(wanted, rr)
+	}
+	plan.Warnings = append(plan.Warnings, cnameWarnings(wanted)...)
+
+	matched := make([]int, len(wanted))
+	used := make(map[int]bool)
+	match := func(same func(have dns.RR, want dns.RR) bool) {
+		for i, rr := range wanted {
+			if matched[i] != 0 {
+				continue
+			}
+			for _, id := range ids {
+				if !used[id] && same(current[id].RR, rr) {
+					matched[i] = id
+					used[id] = true
+					break
+				}
+			}
+		}
+	}
+	match(func(have dns.RR, want dns.RR) bool {
+		return dns.IsDuplicate(have, want) && have.Header().Ttl == want.Header().Ttl
+	})
+	unchanged := make(map[int]bool, len(used))
+	for id := range used {
+		unchanged[id] = true
+	}
+	match(dns.IsDuplicate)
+	match(func(have dns.RR, want dns.RR) bool {
+		return strings.EqualFold(have.Header().Name, want.Header().Name) && have.Header().Rrtype == want.Header().Rrtype
+	})
+
+	for _, id := range ids {
+		if used[id] {
+			continue
+		}
+		record := current[id]
+		plan.Delete = append(plan.Delete, PlanEntry{ID: id, Old: record.RR.String()})
+		plan.changes = append(plan.changes, RecordChange{Op: ChangeDelete, ID: id})
+		if record.HealthCheck != nil {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("deleting %s deletes its health check too", record.RR.String()))
+		}
+	}
+	for i, rr := range wanted {
+		id := matched[i]
+		switch {
+		case id == 0:
+			plan.Add = append(plan.Add, PlanEntry{Record: rr.String()})
+			plan.changes = append(plan.changes, RecordChange{Op: ChangeCreate, Record: rr, Options: RecordOptions{Weight: defaultWeight}})
+		case !unchanged[id]:
+			record := current[id]
+			plan.Change = append(plan.Change, PlanEntry{ID: id, Record: rr.String(), Old: record.RR.String()})
+			plan.changes = append(plan.changes, RecordChange{
+				Op:      ChangeUpdate,
+				ID:      id,
+				Record:  rr,
+				Options: RecordOptions{Weight: record.Weight, Backup: record.Backup, HealthCheck: record.HealthCheck},
+			})
+		}
+	}
+	if len(wanted) == 0 && len(current) > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("this deletes all %d of your records", len(current)))
+	}
+	return plan
+}
+
+// cnameWarnings finds names with a CNAME and anything else, which resolvers
+// won't expect
+func cnameWarnings(records []dns.RR) []string {
+	types := make(map[string][]uint16)
+	var names []string
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		if _, ok := types[name]; !ok {
+			names = append(names, name)
+		}
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+	var warnings []string
+	for _, name := range names {
+		cnames := 0
+		for _, rrtype := range types[name] {
+			if rrtype == dns.TypeCNAME {
+				cnames++
+			}
+		}
+		if cnames > 0 && len(types[name]) > 1 {
+			warnings = append(warnings, fmt.Sprintf("%s has a CNAME and other records", name))
+		}
+	}
+	return warnings
+}
+
+func putZone(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error reading body: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	desired, errs := parseZone(r, store, username, string(body))
+	if len(errs) > 0 {
+		writeZoneErrors(w, errs)
+		return
+	}
+	// the serial goes first, so that a change while the records are being
+	// read makes the plan out of date rather than wrong
+	serial, err := store.GetZoneSerial(r.Context(), username)
+	if err != nil {
+		returnError(w, fmt.Errorf("error getting serial: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	current, err := store.GetRecordsForName(r.Context(), username)
+	if err != nil {
+		returnError(w, fmt.Errorf("error getting records: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	plan := planZone(serial, current, desired)
+
+	if value := r.URL.Query().Get("serial"); value != "" {
+		expected, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			returnError(w, fmt.Errorf("invalid serial: %s", value), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case plan.Serial != uint32(expected):
+			err = errSerialChanged
+		case len(plan.changes) > 0:
+			// checked again in the transaction, in case it changed just now
+			changes := append([]RecordChange{{Op: ChangeCheckZoneSerial, Serial: plan.Serial}}, plan.changes...)
+			_, err = store.ApplyRecordChanges(r.Context(), username, changes)
+		}
+		if errors.Is(err, errSerialChanged) {
+			returnError(w, fmt.Errorf("the zone has changed since serial %d, make a new plan", expected), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			returnError(w, fmt.Errorf("error applying plan: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	jsonOutput, err := json.Marshal(plan)
+	if err != nil {
+		returnError(w, fmt.Errorf("error marshalling json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+}
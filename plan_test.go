@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanZone(t *testing.T) {
+	current := map[int]Record{
+		1: {ID: 1, RR: makeA("www.alice.flatbo.at.", "192.0.2.1")},
+		2: {ID: 2, RR: makeA("api.alice.flatbo.at.", "192.0.2.2"), Weight: 5},
+		3: {ID: 3, RR: makeA("old.alice.flatbo.at.", "192.0.2.3"), HealthCheck: &HealthCheck{Kind: "tcp"}},
+		4: {ID: 4, RR: makeCNAME("docs.alice.flatbo.at.", "example.com.")},
+	}
+	desired := []dns.RR{
+		makeA("www.alice.flatbo.at.", "192.0.2.1"),
+		makeA("API.alice.flatbo.at.", "192.0.2.9"),
+		makeA("new.alice.flatbo.at.", "192.0.2.4"),
+		makeA("new.alice.flatbo.at.", "192.0.2.4"),
+		makeCNAME("docs.alice.flatbo.at.", "example.com."),
+		makeA("docs.alice.flatbo.at.", "192.0.2.5"),
+	}
+	desired[4].Header().Ttl = 60
+
+	plan := planZone(42, current, desired)
+	assert.Equal(t, uint32(42), plan.Serial)
+	assert.Equal(t, []PlanEntry{
+		{Record: desired[2].String()},
+		{Record: desired[5].String()},
+	}, plan.Add)
+	assert.Equal(t, []PlanEntry{
+		{ID: 2, Record: desired[1].String(), Old: current[2].RR.String()},
+		{ID: 4, Record: desired[4].String(), Old: current[4].RR.String()},
+	}, plan.Change)
+	assert.Equal(t, []PlanEntry{{ID: 3, Old: current[3].RR.String()}}, plan.Delete)
+	assert.Len(t, plan.Warnings, 3)
+	assert.Contains(t, plan.Warnings[0], "more than once")
+	assert.Contains(t, plan.Warnings[1], "docs.alice.flatbo.at. has a CNAME and other records")
+	assert.Contains(t, plan.Warnings[2], "health check")
+	// a changed record keeps its weight
+	for _, change := range plan.changes {
+		if change.ID == 2 {
+			assert.Equal(t, 5, change.Options.Weight)
+		}
+	}
+
+	plan = planZone(42, current, nil)
+	assert.Len(t, plan.Delete, 4)
+	assert.Contains(t, plan.Warnings, "this deletes all 4 of your records")
+}
+
+func TestStoreCheckZoneSerial(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			zoneSerial, err := store.GetZoneSerial(ctx, "store")
+			assert.Nil(t, err)
+			www := RecordChange{Op: ChangeCreate, Record: makeA("www.store.flatbo.at.", "192.0.2.1"), Options: defaultOptions()}
+
+			_, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{{Op: ChangeCheckZoneSerial, Serial: zoneSerial + 1}, www})
+			assert.ErrorIs(t, err, errSerialChanged)
+			count, err := store.CountRecords(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, count)
+
+			// someone else's changes don't count
+			assert.Nil(t, store.InsertSubdomain(ctx, "other"))
+			assert.Nil(t, store.InsertRecord(ctx, "other", makeA("www.other.flatbo.at.", "192.0.2.1"), defaultOptions()))
+			serial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			_, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{{Op: ChangeCheckZoneSerial, Serial: zoneSerial}, www})
+			assert.Nil(t, err)
+			count, err = store.CountRecords(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, count)
+			// one increment, not two
+			newSerial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, serial+1, newSerial)
+
+			// but the user's own do
+			newZoneSerial, err := store.GetZoneSerial(ctx, "store")
+			assert.Nil(t, err)
+			assert.NotEqual(t, zoneSerial, newZoneSerial)
+			_, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{{Op: ChangeCheckZoneSerial, Serial: zoneSerial}, www})
+			assert.ErrorIs(t, err, errSerialChanged)
+
+			// and pruning the history doesn't take the zone serial back
+			assert.Nil(t, store.DeleteOldHistory(ctx, -time.Hour))
+			prunedZoneSerial, err := store.GetZoneSerial(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, newZoneSerial, prunedZoneSerial)
+			_, err = store.ApplyRecordChanges(ctx, "store", []RecordChange{{Op: ChangeCheckZoneSerial, Serial: zoneSerial}, www})
+			assert.ErrorIs(t, err, errSerialChanged)
+		})
+	}
+}
+
+func TestPutZone(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("www.alice.flatbo.at.", "192.0.2.1"), RecordOptions{Weight: 3}))
+	put := func(query string, zone string) (int, ZonePlan) {
+		w := httptest.NewRecorder()
+		putZone(store, "alice", w, httptest.NewRequest("PUT", "/zone"+query, strings.NewReader(zone)))
+		var plan ZonePlan
+		if w.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &plan))
+		}
+		return w.Code, plan
+	}
+	zone := "www 300 IN A 192.0.2.2\napi 300 IN A 192.0.2.3\n"
+
+	// a plan doesn't change anything
+	status, plan := put("", zone)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, plan.Add, 1)
+	assert.Len(t, plan.Change, 1)
+	assert.Len(t, plan.Delete, 0)
+	count, err := store.CountRecords(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// applying it once the zone has changed doesn't either
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("mail.alice.flatbo.at.", "192.0.2.4"), defaultOptions()))
+	status, _ = put("?serial="+strconv.Itoa(int(plan.Serial)), zone)
+	assert.Equal(t, http.StatusConflict, status)
+	records, err := store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	// but someone else's changes don't get in the way
+	status, plan = put("", zone)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, store.InsertSubdomain(ctx, "bob"))
+	assert.Nil(t, store.InsertRecord(ctx, "bob", makeA("www.bob.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	status, _ = put("?serial="+strconv.Itoa(int(plan.Serial)), zone)
+	assert.Equal(t, http.StatusOK, status)
+	records, err = store.GetRecordsForName(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	for _, record := range records {
+		if record.RR.Header().Name == "www.alice.flatbo.at." {
+			assert.Equal(t, "192.0.2.2", record.RR.(*dns.A).A.String())
+			assert.Equal(t, 3, record.Weight)
+		}
+	}
+
+	// and now there's nothing left to do
+	status, plan = put("", zone)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, plan.Add)
+	assert.Empty(t, plan.Change)
+	assert.Empty(t, plan.Delete)
+
+	status, _ = put("?serial=abc", zone)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
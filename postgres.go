@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+var postgresDialect = dialect{
+	name:      "postgres",
+	driver:    "postgres",
+	system:    semconv.DBSystemPostgreSQL,
+	olderThan: "created_at < NOW() - CAST(? AS INTEGER) * INTERVAL '1 second'",
+	unixTime: func(column string) string {
+		return "EXTRACT(EPOCH FROM " + column + ")"
+	},
+	// Postgres reads uncommitted as read committed anyway
+	readIsolation: sql.LevelReadCommitted,
+	upsert: func(key string, columns ...string) string {
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + " = EXCLUDED." + column
+		}
+		return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(updates, ", ")
+	},
+	numbered:       true,
+	returning:      true,
+	lockMigrations: lockPostgres,
+}
+
+// openPostgres takes a postgres:// URL
+func openPostgres(dsn string) (*sqlStore, error) {
+	db, err := sql.Open(postgresDialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: postgresDialect}, nil
+}
+
+// lockPostgres uses an advisory lock, which goes away with the session if
+// we die holding it. Waiting for it is bounded by migrationLockTimeout.
+func lockPostgres(ctx context.Context, conn *sql.Conn) (func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+	defer cancel()
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", migrationLockName)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", migrationLockName)
+	}, nil
+}
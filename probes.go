@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /healthz is liveness: whether we need restarting. /readyz is readiness:
+// whether we can answer queries and requests right now.
+
+// how long a cleanup run can take before we call it stuck
+const cleanupStuckAfter = 10 * time.Minute
+
+const readyTimeout = 2 * time.Second
+
+type probeState struct {
+	sync.Mutex
+	listening       map[string]bool
+	shuttingDown    bool
+	cleanupStarted  time.Time
+	cleanupFinished time.Time
+}
+
+var probes = &probeState{listening: map[string]bool{}}
+
+func (p *probeState) setListening(net string, listening bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.listening[net] = listening
+}
+
+func (p *probeState) setShuttingDown() {
+	p.Lock()
+	defer p.Unlock()
+	p.shuttingDown = true
+}
+
+func (p *probeState) startCleanup(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.cleanupStarted = now
+}
+
+func (p *probeState) finishCleanup(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.cleanupFinished = now
+}
+
+// checkCleanup fails if a cleanup run has been going for too long, or if
+// the loop has stopped coming back around
+func (p *probeState) checkCleanup(now time.Time) error {
+	p.Lock()
+	defer p.Unlock()
+	running := p.cleanupStarted.After(p.cleanupFinished)
+	if running && now.Sub(p.cleanupStarted) > cleanupStuckAfter {
+		return fmt.Errorf("cleanup has been running since %s", p.cleanupStarted.Format(time.RFC3339))
+	}
+	if !running && !p.cleanupFinished.IsZero() &&
+		now.Sub(p.cleanupFinished) > cfg.CleanupInterval.Duration+cleanupStuckAfter {
+		return fmt.Errorf("cleanup hasn't run since %s", p.cleanupFinished.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (p *probeState) checkListeners() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.shuttingDown {
+		return fmt.Errorf("shutting down")
+	}
+	for _, net := range []string{"udp", "tcp"} {
+		if !p.listening[net] {
+			return fmt.Errorf("%s listener isn't bound", net)
+		}
+	}
+	return nil
+}
+
+func checkRanges(ranges *Ranges) error {
+	if ranges == nil || len(ranges.IPv4Ranges) == 0 || len(ranges.IPv6Ranges) == 0 {
+		return fmt.Errorf("ip2asn ranges aren't loaded")
+	}
+	return nil
+}
+
+func checkSerial() error {
+	if soaSerial == 0 {
+		return fmt.Errorf("SOA serial isn't initialized")
+	}
+	return nil
+}
+
+func checkDatabase(ctx context.Context, store RecordStore) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	return store.Ping(ctx)
+}
+
+// writeChecks responds 200 if every check passed and 503 otherwise, with
+// what each check found
+func writeChecks(w http.ResponseWriter, checks map[string]error) {
+	status := http.StatusOK
+	results := make(map[string]string)
+	for name, err := range checks {
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+	jsonOutput, err := json.Marshal(results)
+	if err != nil {
+		err := fmt.Errorf("error marshalling json: %s", err.Error())
+		returnError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonOutput)
+}
+
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, map[string]error{
+		"cleanup": probes.checkCleanup(time.Now()),
+	})
+}
+
+func getReadyz(store RecordStore, ranges *Ranges, w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, map[string]error{
+		"database":  checkDatabase(r.Context(), store),
+		"ranges":    checkRanges(ranges),
+		"listeners": probes.checkListeners(),
+		"serial":    checkSerial(),
+	})
+}
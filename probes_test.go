@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCleanup(t *testing.T) {
+	p := &probeState{listening: map[string]bool{}}
+	now := time.Now()
+	assert.Nil(t, p.checkCleanup(now))
+
+	p.startCleanup(now)
+	assert.Nil(t, p.checkCleanup(now.Add(time.Minute)))
+	assert.NotNil(t, p.checkCleanup(now.Add(cleanupStuckAfter+time.Minute)))
+
+	p.finishCleanup(now.Add(time.Minute))
+	assert.Nil(t, p.checkCleanup(now.Add(cfg.CleanupInterval.Duration)))
+	// the loop never came back around
+	assert.NotNil(t, p.checkCleanup(now.Add(cfg.CleanupInterval.Duration+cleanupStuckAfter+2*time.Minute)))
+}
+
+func TestReadyz(t *testing.T) {
+	store := newMemoryStore()
+	serial := soaSerial
+	soaSerial = 10
+	defer func() { soaSerial = serial }()
+	ranges := &Ranges{
+		IPv4Ranges: []IPRange{{StartIP: net.ParseIP("1.0.0.0"), EndIP: net.ParseIP("1.0.0.255")}},
+		IPv6Ranges: []IPRange{{StartIP: net.ParseIP("2001:db8::"), EndIP: net.ParseIP("2001:db8::ffff")}},
+	}
+	saved := probes
+	probes = &probeState{listening: map[string]bool{"udp": true}}
+	defer func() { probes = saved }()
+
+	w := httptest.NewRecorder()
+	getReadyz(store, ranges, w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var results map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+	assert.Equal(t, "ok", results["database"])
+	assert.Equal(t, "tcp listener isn't bound", results["listeners"])
+
+	probes.setListening("tcp", true)
+	w = httptest.NewRecorder()
+	getReadyz(store, ranges, w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealthzRoute(t *testing.T) {
+	handler := &handler{}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"cleanup": "ok"}`, w.Body.String())
+}
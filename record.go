@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/miekg/dns"
+)
+
+// Record is a stored RR along with the settings that aren't part of the RR
+// itself.
+type Record struct {
+	ID          int
+	RR          dns.RR
+	Weight      int
+	Backup      bool
+	HealthCheck *HealthCheck
+}
+
+// RecordOptions are the settings that can be sent along with a record in
+// the same JSON object
+type RecordOptions struct {
+	Weight      int
+	Backup      bool
+	HealthCheck *HealthCheck
+}
+
+// MarshalJSON adds the record's settings to its usual JSON, so the API keeps
+// returning the same fields it always has.
+func (record Record) MarshalJSON() ([]byte, error) {
+	jsonString, err := MarshalRecord(record.RR)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(jsonString, &fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["Weight"] = record.Weight
+	fields["Backup"] = record.Backup
+	if record.HealthCheck != nil {
+		fields["HealthCheck"] = record.HealthCheck
+		fields["Healthy"] = isHealthy(record.ID)
+	}
+	return json.Marshal(fields)
+}
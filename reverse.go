@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// We serve a few reverse zones, and each user gets a slice of each one to
+// put PTR records in. Slices are handed out when the user asks for them
+// with POST /reverse, and go back in the pool once they've been unused for
+// a day, like everything else.
+
+// ReverseZone is a reverse zone we serve, cut up into slices of SliceBits.
+type ReverseZone struct {
+	Prefix    *net.IPNet
+	SliceBits int
+}
+
+// documentation prefixes, so nobody's real reverse DNS gets confused
+const defaultReverseZones = "192.0.2.0/24=29,2001:db8::/48=64"
+
+var reverseZones []ReverseZone
+
+// parseReverseZones parses zones in the form prefix=slice,prefix=slice, e.g.
+// 192.0.2.0/24=29 gives every user 8 addresses out of 192.0.2.0/24.
+func parseReverseZones(config string) ([]ReverseZone, error) {
+	zones := make([]ReverseZone, 0)
+	for _, zone := range strings.Split(config, ",") {
+		zone = strings.TrimSpace(zone)
+		if zone == "" {
+			continue
+		}
+		prefix, slice, found := strings.Cut(zone, "=")
+		if !found {
+			return nil, fmt.Errorf("reverse zone %s must look like prefix=slice", zone)
+		}
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		sliceBits, err := strconv.Atoi(slice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slice size in reverse zone %s", zone)
+		}
+		ones, bits := network.Mask.Size()
+		// the zone has to start on a label boundary
+		labelBits := 8
+		if bits == 8*net.IPv6len {
+			labelBits = 4
+		}
+		if ones%labelBits != 0 {
+			return nil, fmt.Errorf("reverse zone %s must be a multiple of %d bits", zone, labelBits)
+		}
+		if sliceBits < ones || sliceBits > bits {
+			return nil, fmt.Errorf("slice size in reverse zone %s must be between %d and %d", zone, ones, bits)
+		}
+		zones = append(zones, ReverseZone{Prefix: network, SliceBits: sliceBits})
+	}
+	return zones, nil
+}
+
+// Apex is the zone's name, e.g. 2.0.192.in-addr.arpa.
+func (zone ReverseZone) Apex() string {
+	ones, bits := zone.Prefix.Mask.Size()
+	labels := dns.SplitDomainName(reverseName(zone.Prefix.IP))
+	if bits == 8*net.IPv4len {
+		return dns.Fqdn(strings.Join(labels[(bits-ones)/8:], "."))
+	}
+	return dns.Fqdn(strings.Join(labels[(bits-ones)/4:], "."))
+}
+
+func (zone ReverseZone) slices() *big.Int {
+	ones, _ := zone.Prefix.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(zone.SliceBits-ones))
+}
+
+// Slice is the n-th slice of the zone
+func (zone ReverseZone) Slice(n *big.Int) *net.IPNet {
+	_, bits := zone.Prefix.Mask.Size()
+	offset := new(big.Int).Lsh(n, uint(bits-zone.SliceBits))
+	start := new(big.Int).SetBytes(zone.Prefix.IP)
+	start.Add(start, offset)
+	ip := make(net.IP, bits/8)
+	start.FillBytes(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(zone.SliceBits, bits)}
+}
+
+// SliceFor is the slice an address falls in
+func (zone ReverseZone) SliceFor(ip net.IP) *net.IPNet {
+	_, bits := zone.Prefix.Mask.Size()
+	mask := net.CIDRMask(zone.SliceBits, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func reverseName(ip net.IP) string {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func isReverseName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
+
+// reverseNameToIP turns a full reverse name like 5.2.0.192.in-addr.arpa.
+// back into the address it's for
+func reverseNameToIP(name string) net.IP {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			b.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteString(":")
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// findReverseZone finds the zone a name is in, whether it's an address or
+// somewhere between the apex and an address
+func findReverseZone(name string) (ReverseZone, bool) {
+	name = strings.ToLower(name)
+	for _, zone := range reverseZones {
+		apex := zone.Apex()
+		if name == apex || strings.HasSuffix(name, "."+apex) {
+			return zone, true
+		}
+	}
+	return ReverseZone{}, false
+}
+
+func inReverseZone(name string) bool {
+	_, ok := findReverseZone(name)
+	return ok
+}
+
+// reverseSlice finds the slice that a full reverse name belongs to
+func reverseSlice(name string) (*net.IPNet, error) {
+	ip := reverseNameToIP(name)
+	if ip == nil {
+		return nil, fmt.Errorf("%s isn't the reverse name of an address", name)
+	}
+	zone, ok := findReverseZone(name)
+	if !ok || !zone.Prefix.Contains(ip) {
+		return nil, fmt.Errorf("%s isn't in a reverse zone we serve", name)
+	}
+	return zone.SliceFor(ip), nil
+}
+
+func validateReverseName(ctx context.Context, store RecordStore, name string, username string) error {
+	if !strings.HasSuffix(name, ".") {
+		return fmt.Errorf("domain must end with a period")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid domain name: %s", name)
+	}
+	slice, err := reverseSlice(name)
+	if err != nil {
+		return err
+	}
+	owner, err := store.GetReverseSliceOwner(ctx, slice.String())
+	if err != nil {
+		return err
+	}
+	if owner != username {
+		return fmt.Errorf("%s isn't in one of your reverse DNS slices", name)
+	}
+	return nil
+}
+
+// reverseOwner is the subdomain that owns a reverse name, for routing
+// requests to the right stream
+func reverseOwner(ctx context.Context, store RecordStore, name string) string {
+	slice, err := reverseSlice(name)
+	if err != nil {
+		return ""
+	}
+	owner, err := store.GetReverseSliceOwner(ctx, slice.String())
+	if err != nil {
+		return ""
+	}
+	return owner
+}
+
+// userReverseSlices lists the slices the user has, without handing out any
+func userReverseSlices(ctx context.Context, store RecordStore, subdomain string) ([]string, error) {
+	slices := make([]string, 0)
+	for _, zone := range reverseZones {
+		existing, err := store.GetReverseSlices(ctx, zone.Prefix.String())
+		if err != nil {
+			return nil, err
+		}
+		for prefix, owner := range existing {
+			if owner == subdomain {
+				slices = append(slices, prefix)
+			}
+		}
+	}
+	return slices, nil
+}
+
+// allocateReverseSlices makes sure the user has a slice of every zone
+func allocateReverseSlices(ctx context.Context, store RecordStore, subdomain string) ([]string, error) {
+	slices := make([]string, 0)
+	for _, zone := range reverseZones {
+		slice, err := allocateReverseSlice(ctx, store, zone, subdomain)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, slice)
+	}
+	return slices, nil
+}
+
+func allocateReverseSlice(ctx context.Context, store RecordStore, zone ReverseZone, subdomain string) (string, error) {
+	existing, err := store.GetReverseSlices(ctx, zone.Prefix.String())
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool)
+	for prefix, owner := range existing {
+		if owner == subdomain {
+			return prefix, nil
+		}
+		taken[prefix] = true
+	}
+	// take the first free slice. Someone else might take it first, in which
+	// case we move on to the next one.
+	for n := big.NewInt(0); n.Cmp(zone.slices()) < 0; n.Add(n, big.NewInt(1)) {
+		slice := zone.Slice(n).String()
+		if taken[slice] {
+			continue
+		}
+		err = store.InsertReverseSlice(ctx, zone.Prefix.String(), slice, subdomain)
+		if errors.Is(err, errSliceTaken) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return slice, nil
+	}
+	return "", fmt.Errorf("no reverse DNS slices left in %s, try again tomorrow", zone.Prefix)
+}
+
+func reverseSOA(zone ReverseZone, serial uint32) *dns.SOA {
+	soa := getSOA(serial)
+	soa.Hdr.Name = zone.Apex()
+	return soa
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseZones(t *testing.T) {
+	zones, err := parseReverseZones(defaultReverseZones)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(zones))
+
+	v4, v6 := zones[0], zones[1]
+	assert.Equal(t, "2.0.192.in-addr.arpa.", v4.Apex())
+	assert.Equal(t, "0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", v6.Apex())
+
+	assert.Equal(t, "192.0.2.0/29", v4.Slice(big.NewInt(0)).String())
+	assert.Equal(t, "192.0.2.8/29", v4.Slice(big.NewInt(1)).String())
+	assert.Equal(t, "2001:db8:0:1::/64", v6.Slice(big.NewInt(1)).String())
+
+	_, err = parseReverseZones("192.0.2.0/25=29")
+	assert.NotNil(t, err, "not on a label boundary")
+	_, err = parseReverseZones("192.0.2.0/24=16")
+	assert.NotNil(t, err, "slice bigger than the zone")
+}
+
+func TestReverseSlice(t *testing.T) {
+	zones, _ := parseReverseZones(defaultReverseZones)
+	reverseZones = zones
+	defer func() { reverseZones = nil }()
+
+	slice, err := reverseSlice("13.2.0.192.in-addr.arpa.")
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.8/29", slice.String())
+
+	slice, err = reverseSlice(reverseName(reverseNameToIP(
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.5.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	)))
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:0:5::/64", slice.String())
+
+	_, err = reverseSlice("2.0.192.in-addr.arpa.")
+	assert.NotNil(t, err, "not a full address")
+	_, err = reverseSlice("1.2.0.10.in-addr.arpa.")
+	assert.NotNil(t, err, "not a zone we serve")
+
+	assert.True(t, inReverseZone("2.0.192.in-addr.arpa."))
+	assert.False(t, inReverseZone("3.0.192.in-addr.arpa."))
+}
+
+// racingStore lets someone else take the slice we're about to take
+type racingStore struct {
+	RecordStore
+	raced bool
+}
+
+func (s *racingStore) InsertReverseSlice(ctx context.Context, zone string, prefix string, subdomain string) error {
+	if !s.raced {
+		s.raced = true
+		if err := s.RecordStore.InsertReverseSlice(ctx, zone, prefix, "other"); err != nil {
+			return err
+		}
+	}
+	return s.RecordStore.InsertReverseSlice(ctx, zone, prefix, subdomain)
+}
+
+func TestAllocateReverseSlices(t *testing.T) {
+	zones, _ := parseReverseZones(defaultReverseZones)
+	reverseZones = zones
+	defer func() { reverseZones = nil }()
+	ctx := context.Background()
+	store := &racingStore{RecordStore: newMemoryStore()}
+
+	// looking doesn't hand anything out
+	slices, err := userReverseSlices(ctx, store, "alice")
+	assert.Nil(t, err)
+	assert.Empty(t, slices)
+
+	slices, err = allocateReverseSlices(ctx, store, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.8/29", "2001:db8::/64"}, slices)
+	owner, err := store.GetReverseSliceOwner(ctx, "192.0.2.0/29")
+	assert.Nil(t, err)
+	assert.Equal(t, "other", owner)
+
+	// and asking again gets the same ones
+	again, err := allocateReverseSlices(ctx, store, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, slices, again)
+	mine, err := userReverseSlices(ctx, store, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, slices, mine)
+}
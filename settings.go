@@ -0,0 +1,11 @@
+package main
+
+// Settings are per-subdomain switches for features that change how we
+// answer for the whole subdomain
+type Settings struct {
+	// answer for names with an IP in them, see ipnames.go
+	IPNames bool `json:"ip_names"`
+	// answer HTTPS queries for names without HTTPS records with one made
+	// out of their A and AAAA records, see svcb.go
+	SynthesizeHTTPS bool `json:"synthesize_https"`
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+var sqliteDialect = dialect{
+	name:      "sqlite",
+	driver:    "sqlite3",
+	system:    semconv.DBSystemSqlite,
+	olderThan: "created_at < datetime('now', (-?) || ' seconds')",
+	unixTime: func(column string) string {
+		return "CAST(strftime('%s', " + column + ") AS INTEGER)"
+	},
+	// SQLite transactions are serializable no matter what we ask for
+	readIsolation: sql.LevelDefault,
+	upsert: func(key string, columns ...string) string {
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + " = excluded." + column
+		}
+		return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(updates, ", ")
+	},
+	// only one process can write to the file at a time and each migration
+	// is a transaction, so there's nothing to lock
+	lockMigrations: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		return func() {}, nil
+	},
+}
+
+// openSQLite opens (or creates) the database file at path
+func openSQLite(path string) (*sqlStore, error) {
+	// SQLite only checks foreign keys when it's asked to, per connection
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open(sqliteDialect.driver, path+separator+"_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer anyway, and this way ":memory:" is one
+	// database instead of one per connection
+	db.SetMaxOpenConns(1)
+	return &sqlStore{db: db, dialect: sqliteDialect}, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The handler only talks to storage through RecordStore and RequestLog. The
+// implementation is picked by the DSN's scheme:
+//
+//	memory                     in-memory, for tests and dev, gone on restart
+//	sqlite:/var/lib/dns.db     embedded SQLite, for a single binary
+//	postgres://user:pw@host/x  PostgreSQL (postgresql:// works too)
+//	mysql://user:pw@tcp(...)/x MySQL (a DSN without a scheme is MySQL too)
+
+// RecordStore is everything users set up: records and the options that go
+// with them, plus the SOA serial that changes whenever they do
+type RecordStore interface {
+	GetSerial(ctx context.Context) (uint32, error)
+	// GetZoneSerial is the serial of just subdomain's zone: the ID of the
+	// latest change to its records in the history, or 0 if there isn't one
+	GetZoneSerial(ctx context.Context, subdomain string) (uint32, error)
+
+	// GetRecords answers a query: the records for a name that match qtype,
+	// ordered by the name's policy, and how many records the name has at all
+	GetRecords(ctx context.Context, name string, qtype uint16) ([]dns.RR, int, error)
+	GetRecordsForName(ctx context.Context, subdomain string) (map[int]Record, error)
+	InsertRecord(ctx context.Context, subdomain string, record dns.RR, options RecordOptions) error
+	// UpdateRecord and DeleteRecord only touch subdomain's own records, and
+	// return errNotFound for anyone else's
+	UpdateRecord(ctx context.Context, subdomain string, id int, record dns.RR, options RecordOptions) error
+	DeleteRecord(ctx context.Context, subdomain string, id int) error
+	// ApplyRecordChanges makes all of the changes to subdomain's records with
+	// one serial bump, or none of them. It returns each change's record ID.
+	ApplyRecordChanges(ctx context.Context, subdomain string, changes []RecordChange) ([]int, error)
+	// GetRecordHistory gets the changes to subdomain's records made after
+	// since, newest first, and at most limit of them if limit isn't 0
+	GetRecordHistory(ctx context.Context, subdomain string, since time.Time, limit int) ([]HistoryEntry, error)
+	GetHistoryEntry(ctx context.Context, subdomain string, id int) (HistoryEntry, error)
+	CountRecords(ctx context.Context) (int, error)
+	GetHealthChecks(ctx context.Context) ([]HealthCheck, error)
+
+	GetPolicies(ctx context.Context, subdomain string) ([]Policy, error)
+	SetPolicy(ctx context.Context, policy Policy) error
+
+	InsertBehavior(ctx context.Context, behavior Behavior) error
+	DeleteBehavior(ctx context.Context, subdomain string, id int) error
+	GetBehaviors(ctx context.Context, name string) ([]Behavior, error)
+	GetBehaviorsForName(ctx context.Context, subdomain string) ([]Behavior, error)
+
+	InsertFault(ctx context.Context, fault Fault) error
+	DeleteFault(ctx context.Context, subdomain string, id int) error
+	GetFaults(ctx context.Context, name string) ([]Fault, error)
+	GetFaultsForName(ctx context.Context, subdomain string) ([]Fault, error)
+	// GetFaultNames lists the names that have any faults
+	GetFaultNames(ctx context.Context) ([]string, error)
+
+	GetReverseSlices(ctx context.Context, zone string) (map[string]string, error)
+	GetReverseSliceOwner(ctx context.Context, prefix string) (string, error)
+	// InsertReverseSlice gives subdomain the slice, unless someone else
+	// already has it, which is errSliceTaken
+	InsertReverseSlice(ctx context.Context, zone string, prefix string, subdomain string) error
+
+	GetSettings(ctx context.Context, subdomain string) (Settings, error)
+	SetSettings(ctx context.Context, subdomain string, settings Settings) error
+
+	// GetSubdomains lists the subdomains handed out so far that start with prefix
+	GetSubdomains(ctx context.Context, prefix string) ([]string, error)
+	InsertSubdomain(ctx context.Context, subdomain string) error
+	// EnsureSubdomain adds subdomain if it isn't there already, for logins
+	// that bring their own name
+	EnsureSubdomain(ctx context.Context, subdomain string) error
+
+	// DeleteOldRecords deletes everything users made more than retention ago
+	DeleteOldRecords(ctx context.Context, retention time.Duration) error
+	DeleteOldHistory(ctx context.Context, retention time.Duration) error
+	Ping(ctx context.Context) error
+}
+
+// RequestLog is the history of the queries we answered
+type RequestLog interface {
+	InsertRequest(ctx context.Context, request LoggedRequest) error
+	// GetRequests gets the latest requests for a subdomain, newest first
+	GetRequests(ctx context.Context, subdomain string) ([]map[string]interface{}, error)
+	DeleteRequestsForDomain(ctx context.Context, subdomain string) error
+	DeleteOldRequests(ctx context.Context, retention time.Duration) error
+}
+
+// Store is a backend that keeps both
+type Store interface {
+	RecordStore
+	RequestLog
+	Close() error
+}
+
+// LoggedRequest is one row of the request log, with the messages as JSON
+type LoggedRequest struct {
+	Name      string
+	Subdomain string
+	Request   []byte
+	Response  []byte
+	SrcIP     string
+	SrcHost   string
+	ECS       []byte
+	Faults    string
+	Instance  string
+}
+
+// errNotFound is for a record, behavior or fault that doesn't exist, or
+// isn't the caller's
+var errNotFound = errors.New("record not found")
+
+// errSliceTaken is for a reverse slice that belongs to someone else
+var errSliceTaken = errors.New("reverse slice is already taken")
+
+// errSerialChanged is for a ChangeCheckZoneSerial that's out of date
+var errSerialChanged = errors.New("the zone has changed since the serial")
+
+// how many requests GetRequests returns
+const requestsShown = 30
+
+// openStore connects to the DSN's database. With migrate set it brings the
+// schema up to date first, otherwise it only warns if the schema is behind.
+func openStore(ctx context.Context, dsn string, migrate bool) (Store, error) {
+	var store *sqlStore
+	var err error
+	switch {
+	case dsn == "memory":
+		return newMemoryStore(), nil
+	case strings.HasPrefix(dsn, "sqlite:"):
+		store, err = openSQLite(strings.TrimPrefix(dsn, "sqlite:"))
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		store, err = openPostgres(dsn)
+	default:
+		store, err = openMySQL(strings.TrimPrefix(dsn, "mysql://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if migrate {
+		err = store.migrate(ctx, -1)
+	} else {
+		var pending int
+		pending, err = store.pendingMigrations(ctx)
+		if pending > 0 {
+			logger.Warn("database schema is behind, run the migrate command", "pending", pending)
+		}
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func LogRequest(
+	ctx context.Context,
+	records RecordStore,
+	requests RequestLog,
+	request *dns.Msg,
+	response *dns.Msg,
+	src_ip net.IP,
+	src_host string,
+	ecs *ClientSubnet,
+	faults []string,
+) error {
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	jsonECS, err := marshalClientSubnet(ecs)
+	if err != nil {
+		return err
+	}
+	name := request.Question[0].Name
+	subdomain := ExtractSubdomain(name)
+	if isReverseName(name) {
+		subdomain = reverseOwner(ctx, records, name)
+	}
+	appliedFaults := strings.Join(faults, ",")
+	err = StreamRequest(
+		subdomain,
+		jsonRequest,
+		jsonResponse,
+		src_ip.String(),
+		src_host,
+		jsonECS,
+		appliedFaults,
+	)
+	if err != nil {
+		return err
+	}
+	return requests.InsertRequest(ctx, LoggedRequest{
+		Name:      name,
+		Subdomain: subdomain,
+		Request:   jsonRequest,
+		Response:  jsonResponse,
+		SrcIP:     src_ip.String(),
+		SrcHost:   src_host,
+		ECS:       jsonECS,
+		Faults:    appliedFaults,
+		Instance:  identity.ID,
+	})
+}
+
+func StreamRequest(
+	subdomain string,
+	request []byte,
+	response []byte,
+	src_ip string,
+	src_host string,
+	ecs []byte,
+	faults string,
+) error {
+	logger.Debug("streaming request", "subdomain", subdomain)
+	// get base domain
+	x := map[string]interface{}{
+		"created_at": time.Now().Unix(),
+		"request":    string(request),
+		"response":   string(response),
+		"src_ip":     src_ip,
+		"src_host":   src_host,
+		"ecs":        string(ecs),
+		"faults":     faults,
+		"instance":   identity.ID,
+	}
+	jsonString, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	WriteToStreams(subdomain, jsonString)
+	return nil
+}
+
+// marshalClientSubnet turns the client subnet into the JSON we keep in the
+// request log, or nil if the resolver didn't send one
+func marshalClientSubnet(ecs *ClientSubnet) ([]byte, error) {
+	if ecs == nil {
+		return nil, nil
+	}
+	return json.Marshal(map[string]interface{}{
+		"subnet":  ecs.String(),
+		"asn":     ecs.ASN,
+		"as_name": ecs.ASName,
+		"country": ecs.Country,
+	})
+}
+
+// requestJSON is how the API shows a logged request
+func requestJSON(id int, createdAt int64, request LoggedRequest) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         id,
+		"created_at": createdAt,
+		"request":    string(request.Request),
+		"response":   string(request.Response),
+		"src_ip":     request.SrcIP,
+		"src_host":   request.SrcHost,
+		"ecs":        string(request.ECS),
+		"faults":     request.Faults,
+		"instance":   request.Instance,
+	}
+}
+
+func shouldReturn(queryType uint16, recordType uint16) bool {
+	if queryType == recordType {
+		return true
+	}
+	if recordType == dns.TypeCNAME {
+		return true
+	}
+	return false
+}
+
+// answerRecords is what's left of a name's records (newest first) for a query
+func answerRecords(ctx context.Context, policy Policy, records []Record, qtype uint16) []dns.RR {
+	filtered := make([]Record, 0)
+	for _, record := range records {
+		if shouldReturn(qtype, record.RR.Header().Rrtype) {
+			filtered = append(filtered, record)
+		}
+	}
+	if isPeeking(ctx) {
+		return policy.Peek(filterHealthy(filtered))
+	}
+	return policy.Order(filterHealthy(filtered))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores are the backends we can run without a server
+func testStores(t *testing.T) map[string]Store {
+	sqlite, err := openStore(context.Background(), "sqlite::memory:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	stores := map[string]Store{
+		"memory": newMemoryStore(),
+		"sqlite": sqlite,
+	}
+	// records need a subdomain to belong to
+	for _, store := range stores {
+		err = store.InsertSubdomain(context.Background(), "store")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stores
+}
+
+func TestStoreRecords(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			serial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(10), serial)
+
+			check := &HealthCheck{Kind: "tcp", Target: "192.0.2.1:80", Interval: 30, Threshold: 3}
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("www.store.flatbo.at.", "192.0.2.1"), defaultOptions()))
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("www.store.flatbo.at.", "192.0.2.2"), RecordOptions{Weight: 2, HealthCheck: check}))
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeCNAME("alias.store.flatbo.at.", "www.store.flatbo.at."), defaultOptions()))
+			assert.Equal(t, uint32(13), soaSerial)
+			// records belong to a subdomain that exists
+			assert.NotNil(t, store.InsertRecord(ctx, "nobody", makeA("www.nobody.flatbo.at.", "192.0.2.1"), defaultOptions()))
+
+			// newest first
+			answers, total, err := store.GetRecords(ctx, "www.store.flatbo.at.", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, total)
+			assert.Equal(t, "192.0.2.2", answers[0].(*dns.A).A.String())
+			assert.Equal(t, "192.0.2.1", answers[1].(*dns.A).A.String())
+			answers, total, err = store.GetRecords(ctx, "www.store.flatbo.at.", dns.TypeAAAA)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, total)
+			assert.Len(t, answers, 0)
+			answers, _, err = store.GetRecords(ctx, "alias.store.flatbo.at.", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Len(t, answers, 1)
+
+			records, err := store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, records, 3)
+			var checked int
+			for id, record := range records {
+				if record.HealthCheck != nil {
+					checked = id
+					assert.Equal(t, 2, record.Weight)
+					assert.Equal(t, "192.0.2.1:80", record.HealthCheck.Target)
+				}
+			}
+			checks, err := store.GetHealthChecks(ctx)
+			assert.Nil(t, err)
+			assert.Len(t, checks, 1)
+			assert.Equal(t, checked, checks[0].RecordID)
+			assert.Equal(t, "www.store.flatbo.at.", checks[0].Name)
+			assert.Equal(t, "store", checks[0].Subdomain)
+
+			assert.Nil(t, store.UpdateRecord(ctx, "store", checked, makeA("www.store.flatbo.at.", "192.0.2.3"), defaultOptions()))
+			checks, err = store.GetHealthChecks(ctx)
+			assert.Nil(t, err)
+			assert.Len(t, checks, 0)
+			records, err = store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, "192.0.2.3", records[checked].RR.(*dns.A).A.String())
+
+			// nobody else can touch them
+			assert.Nil(t, store.InsertSubdomain(ctx, "other"))
+			err = store.UpdateRecord(ctx, "other", checked, makeA("www.other.flatbo.at.", "192.0.2.4"), defaultOptions())
+			assert.ErrorIs(t, err, errNotFound)
+			assert.ErrorIs(t, store.DeleteRecord(ctx, "other", checked), errNotFound)
+			assert.ErrorIs(t, store.DeleteRecord(ctx, "store", 12345), errNotFound)
+			records, err = store.GetRecordsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, "192.0.2.3", records[checked].RR.(*dns.A).A.String())
+
+			assert.Nil(t, store.DeleteRecord(ctx, "store", checked))
+			count, err := store.CountRecords(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, count)
+			serial, err = store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(15), serial)
+
+			// everything is older than an hour from now
+			assert.Nil(t, store.DeleteOldRecords(ctx, -time.Hour))
+			count, err = store.CountRecords(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, count)
+		})
+	}
+}
+
+func TestStorePoliciesAndSettings(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			policy := Policy{Name: "www.store.flatbo.at.", Ordering: OrderRandom}
+			assert.Nil(t, store.SetPolicy(ctx, policy))
+			policy.AnswerCount = 1
+			assert.Nil(t, store.SetPolicy(ctx, policy))
+			policies, err := store.GetPolicies(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, []Policy{policy}, policies)
+
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("www.store.flatbo.at.", "192.0.2.1"), defaultOptions()))
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("www.store.flatbo.at.", "192.0.2.2"), defaultOptions()))
+			answers, total, err := store.GetRecords(ctx, "www.store.flatbo.at.", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, total)
+			assert.Len(t, answers, 1)
+
+			// fixed is the default, so it's not kept
+			assert.Nil(t, store.SetPolicy(ctx, Policy{Name: policy.Name, Ordering: OrderFixed}))
+			policies, err = store.GetPolicies(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, policies, 0)
+
+			settings, err := store.GetSettings(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, Settings{}, settings)
+			assert.Nil(t, store.SetSettings(ctx, "store", Settings{IPNames: true}))
+			assert.Nil(t, store.SetSettings(ctx, "store", Settings{SynthesizeHTTPS: true}))
+			settings, err = store.GetSettings(ctx, "store")
+			assert.Nil(t, err)
+			assert.Equal(t, Settings{SynthesizeHTTPS: true}, settings)
+
+			assert.Nil(t, store.InsertSubdomain(ctx, "apple"))
+			assert.Nil(t, store.InsertSubdomain(ctx, "banana"))
+			subdomains, err := store.GetSubdomains(ctx, "app")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"apple"}, subdomains)
+		})
+	}
+}
+
+func TestStoreBehaviorsAndFaults(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, store.InsertBehavior(ctx, Behavior{Name: "who.store.flatbo.at.", Kind: BehaviorWhoami, TTL: 60}))
+			behaviors, err := store.GetBehaviors(ctx, "who.store.flatbo.at.")
+			assert.Nil(t, err)
+			assert.Len(t, behaviors, 1)
+			assert.Equal(t, BehaviorWhoami, behaviors[0].Kind)
+			// only the owner can delete it
+			assert.ErrorIs(t, store.DeleteBehavior(ctx, "someone-else", behaviors[0].ID), errNotFound)
+			assert.ErrorIs(t, store.DeleteBehavior(ctx, "store", 12345), errNotFound)
+			behaviors, err = store.GetBehaviorsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, behaviors, 1)
+			assert.Nil(t, store.DeleteBehavior(ctx, "store", behaviors[0].ID))
+			behaviors, err = store.GetBehaviorsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, behaviors, 0)
+
+			serial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Nil(t, store.InsertFault(ctx, Fault{Name: "slow.store.flatbo.at.", Kind: FaultDelay, DelayMs: 100, Percent: 50}))
+			faults, err := store.GetFaults(ctx, "slow.store.flatbo.at.")
+			assert.Nil(t, err)
+			assert.Len(t, faults, 1)
+			assert.Equal(t, 100, faults[0].DelayMs)
+			// faults change the answers, so they change the serial
+			newSerial, err := store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, serial+1, newSerial)
+			// only the owner can delete it
+			assert.ErrorIs(t, store.DeleteFault(ctx, "someone-else", faults[0].ID), errNotFound)
+			assert.ErrorIs(t, store.DeleteFault(ctx, "store", 12345), errNotFound)
+			assert.Nil(t, store.DeleteFault(ctx, "store", faults[0].ID))
+			newSerial, err = store.GetSerial(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, serial+2, newSerial)
+
+			assert.Nil(t, store.InsertFault(ctx, Fault{Name: "slow.store.flatbo.at.", Kind: FaultDelay, DelayMs: 100, Percent: 50}))
+			assert.Nil(t, store.DeleteOldRecords(ctx, -time.Hour))
+			faults, err = store.GetFaultsForName(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, faults, 0)
+		})
+	}
+}
+
+func TestStoreReverseSlices(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, store.InsertReverseSlice(ctx, "192.0.2.0/24", "192.0.2.0/28", "store"))
+			assert.ErrorIs(t, store.InsertReverseSlice(ctx, "192.0.2.0/24", "192.0.2.0/28", "other"), errSliceTaken)
+			// asking again for your own is fine
+			assert.Nil(t, store.InsertReverseSlice(ctx, "192.0.2.0/24", "192.0.2.0/28", "store"))
+			slices, err := store.GetReverseSlices(ctx, "192.0.2.0/24")
+			assert.Nil(t, err)
+			assert.Equal(t, map[string]string{"192.0.2.0/28": "store"}, slices)
+			owner, err := store.GetReverseSliceOwner(ctx, "192.0.2.0/28")
+			assert.Nil(t, err)
+			assert.Equal(t, "store", owner)
+			owner, err = store.GetReverseSliceOwner(ctx, "192.0.2.16/28")
+			assert.Nil(t, err)
+			assert.Equal(t, "", owner)
+
+			// slices stick around while they have records in them
+			assert.Nil(t, store.InsertRecord(ctx, "store", makeA("www.store.flatbo.at.", "192.0.2.1"), defaultOptions()))
+			assert.Nil(t, store.DeleteOldRecords(ctx, time.Hour))
+			owner, _ = store.GetReverseSliceOwner(ctx, "192.0.2.0/28")
+			assert.Equal(t, "store", owner)
+		})
+	}
+}
+
+func TestStoreRequests(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < requestsShown+1; i++ {
+				assert.Nil(t, store.InsertRequest(ctx, LoggedRequest{
+					Name:      "www.store.flatbo.at.",
+					Subdomain: "store",
+					Request:   []byte(`{"Id":1}`),
+					Response:  []byte(`{"Id":1}`),
+					SrcIP:     "192.0.2.1",
+					Faults:    "drop",
+					Instance:  "test",
+				}))
+			}
+			assert.Nil(t, store.InsertRequest(ctx, LoggedRequest{Name: "other.flatbo.at.", Subdomain: "other"}))
+			requests, err := store.GetRequests(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, requests, requestsShown)
+			assert.Equal(t, "drop", requests[0]["faults"])
+			assert.Equal(t, "", requests[0]["ecs"])
+			assert.InDelta(t, time.Now().Unix(), requests[0]["created_at"], 5)
+			// newest first
+			assert.Greater(t, requests[0]["id"], requests[1]["id"])
+
+			assert.Nil(t, store.DeleteRequestsForDomain(ctx, "store"))
+			requests, err = store.GetRequests(ctx, "store")
+			assert.Nil(t, err)
+			assert.Len(t, requests, 0)
+
+			assert.Nil(t, store.DeleteOldRequests(ctx, time.Hour))
+			requests, _ = store.GetRequests(ctx, "other")
+			assert.Len(t, requests, 1)
+			assert.Nil(t, store.DeleteOldRequests(ctx, -time.Hour))
+			requests, _ = store.GetRequests(ctx, "other")
+			assert.Len(t, requests, 0)
+		})
+	}
+}
+
+// TestMySQLDialect checks the MySQL-only bits of SQL, since there's no MySQL
+// to run the other tests against
+func TestMySQLDialect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	store := &sqlStore{db: db, dialect: mysqlDialect}
+	mock.ExpectExec(`INSERT INTO dns_policies .* ON DUPLICATE KEY UPDATE ordering = VALUES\(ordering\), answer_count = VALUES\(answer_count\)`).
+		WithArgs("www.store.flatbo.at.", "store", OrderRandom, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM dns_requests WHERE created_at < NOW\(\) - INTERVAL \? SECOND`).
+		WithArgs(86400).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, UNIX_TIMESTAMP\(created_at\)`).
+		WithArgs("store", requestsShown).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "request", "response", "src_ip", "src_host", "ecs", "faults", "instance"}))
+	mock.ExpectCommit()
+
+	assert.Nil(t, store.SetPolicy(context.Background(), Policy{Name: "www.store.flatbo.at.", Ordering: OrderRandom}))
+	assert.Nil(t, store.DeleteOldRequests(context.Background(), 24*time.Hour))
+	_, err = store.GetRequests(context.Background(), "store")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDialect(t *testing.T) {
+	assert.Equal(t,
+		"SELECT * FROM dns_records WHERE name = $1 AND content = '?' AND id = $2",
+		postgresDialect.bind("SELECT * FROM dns_records WHERE name = ? AND content = '?' AND id = ?"),
+	)
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	store := &sqlStore{db: db, dialect: postgresDialect}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO dns_records \(.*\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6, \$7\) RETURNING id`).
+		WithArgs("www.store.flatbo.at.", "store", dns.TypeA, uint32(0), sqlmock.AnyArg(), 1, false).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(`INSERT INTO dns_health_checks .* VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(7, "tcp", "192.0.2.1:80", 30, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE dns_serials").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT serial FROM dns_serials").
+		WillReturnRows(sqlmock.NewRows([]string{"serial"}).AddRow(11))
+	mock.ExpectExec(`INSERT INTO dns_record_history \(.*\)\s+VALUES \(\$1, \$2, \$3, \$4, \$5, \$6, \$7, \$8\)`).
+		WithArgs("store", 7, ChangeCreate, "store", nil, sqlmock.AnyArg(), uint32(10), uint32(11)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE subdomains SET serial = \$1 WHERE name = \$2`).
+		WithArgs(uint32(11), "store").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`DELETE FROM dns_requests WHERE created_at < NOW\(\) - CAST\(\$1 AS INTEGER\) \* INTERVAL '1 second'`).
+		WithArgs(86400).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`INSERT INTO dns_settings .* ON CONFLICT \(subdomain\) DO UPDATE SET ip_names = EXCLUDED.ip_names`).
+		WithArgs("store", true, false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	options := RecordOptions{Weight: 1, HealthCheck: &HealthCheck{Kind: "tcp", Target: "192.0.2.1:80", Interval: 30, Threshold: 3}}
+	assert.Nil(t, store.InsertRecord(context.Background(), "store", makeA("www.store.flatbo.at.", "192.0.2.1"), options))
+	assert.Nil(t, store.DeleteOldRequests(context.Background(), 24*time.Hour))
+	assert.Nil(t, store.SetSettings(context.Background(), "store", Settings{IPNames: true}))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -3,24 +3,66 @@ package main
 // domain -> stream id -> channel
 
 import (
-	"fmt"
 	"math/rand"
+	"sync"
 )
 
-var streams = map[string]map[string]chan []byte{}
+var streams = struct {
+	sync.Mutex
+	m map[string]map[string]chan []byte
+	// set by CloseStreams, after which there are no new streams
+	closed bool
+}{m: map[string]map[string]chan []byte{}}
+
+// streamConns tracks the websockets reading from streams, so that shutting
+// down can wait for them to say goodbye. They're only added by openStream,
+// under the streams lock, so none get added once CloseStreams is done.
+var streamConns sync.WaitGroup
+
+// how many messages a stream can fall behind by before we start dropping
+// them, so a slow websocket can't hold up DNS queries
+const streamBuffer = 64
 
 type Stream struct {
 	id        string
 	subdomain string
+	c         chan []byte
 }
 
+// CreateStream makes a stream for subdomain. Once we're shutting down, the
+// stream comes back already closed.
 func CreateStream(subdomain string) Stream {
-	if _, ok := streams[subdomain]; !ok {
-		streams[subdomain] = make(map[string]chan []byte)
+	streams.Lock()
+	defer streams.Unlock()
+	return createStream(subdomain)
+}
+
+// openStream is CreateStream for a websocket, which it adds to streamConns.
+// It returns false if we're shutting down.
+func openStream(subdomain string) (Stream, bool) {
+	streams.Lock()
+	defer streams.Unlock()
+	if streams.closed {
+		return Stream{}, false
+	}
+	streamConns.Add(1)
+	return createStream(subdomain), true
+}
+
+func createStream(subdomain string) Stream {
+	if streams.closed {
+		c := make(chan []byte)
+		close(c)
+		return Stream{subdomain: subdomain, c: c}
+	}
+	if _, ok := streams.m[subdomain]; !ok {
+		streams.m[subdomain] = make(map[string]chan []byte)
 	}
 	id := randString(10)
-	streams[subdomain][id] = make(chan []byte)
-	return Stream{id: id, subdomain: subdomain}
+	c := make(chan []byte, streamBuffer)
+	streams.m[subdomain][id] = c
+	openStreams.WithLabelValues(subdomain).Inc()
+	return Stream{id: id, subdomain: subdomain, c: c}
 }
 
 func randString(n int) string {
@@ -33,24 +75,49 @@ func randString(n int) string {
 }
 
 func (s *Stream) Delete() {
-	if _, ok := streams[s.subdomain]; ok {
-		close(streams[s.subdomain][s.id])
-		delete(streams[s.subdomain], s.id)
+	streams.Lock()
+	defer streams.Unlock()
+	// the stream is already gone if CloseStreams got to it first
+	if c, ok := streams.m[s.subdomain][s.id]; ok {
+		close(c)
+		delete(streams.m[s.subdomain], s.id)
+		openStreams.WithLabelValues(s.subdomain).Dec()
+		if len(streams.m[s.subdomain]) == 0 {
+			delete(streams.m, s.subdomain)
+			openStreams.DeleteLabelValues(s.subdomain)
+		}
 	}
 }
 
+// Get returns the stream's channel, which is closed when the stream is
+// deleted or when we're shutting down
 func (s *Stream) Get() chan []byte {
-	if _, ok := streams[s.subdomain]; ok {
-		return streams[s.subdomain][s.id]
-	}
-	return nil
+	return s.c
 }
 
 func WriteToStreams(domain string, msg []byte) {
-	if _, ok := streams[domain]; ok {
-		for _, stream := range streams[domain] {
-			fmt.Println("writing to stream")
-			stream <- msg
+	streams.Lock()
+	defer streams.Unlock()
+	for _, stream := range streams.m[domain] {
+		select {
+		case stream <- msg:
+		default:
+			logger.Warn("stream is full, dropping message", "subdomain", domain)
+		}
+	}
+}
+
+// CloseStreams closes every stream, so that whoever is reading from them
+// knows to hang up
+func CloseStreams() {
+	streams.Lock()
+	defer streams.Unlock()
+	streams.closed = true
+	for subdomain, ids := range streams.m {
+		for _, c := range ids {
+			close(c)
 		}
+		delete(streams.m, subdomain)
+		openStreams.DeleteLabelValues(subdomain)
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreams(t *testing.T) {
+	stream := CreateStream("streamtest")
+	WriteToStreams("streamtest", []byte("hello"))
+	assert.Equal(t, []byte("hello"), <-stream.Get())
+
+	// a stream that isn't being read doesn't block writers
+	for i := 0; i < streamBuffer+1; i++ {
+		WriteToStreams("streamtest", []byte("hello"))
+	}
+
+	reopenStreams(t)
+	CloseStreams()
+	for range stream.Get() {
+	}
+	// deleting after the stream was closed for us is fine
+	stream.Delete()
+
+	// no new streams once we're shutting down
+	_, ok := openStream("streamtest")
+	assert.False(t, ok)
+	late := CreateStream("streamtest")
+	_, open := <-late.Get()
+	assert.False(t, open)
+	late.Delete()
+}
+
+// reopenStreams lets later tests open new streams after this one closes them
+func reopenStreams(t *testing.T) {
+	t.Cleanup(func() {
+		streams.Lock()
+		defer streams.Unlock()
+		streams.closed = false
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	store, err := openStore(context.Background(), "sqlite::memory:", true)
+	assert.Nil(t, err)
+	handler := &handler{records: store, requests: store}
+	s := &servers{
+		udp:   &dns.Server{Handler: handler, Addr: "127.0.0.1:0", Net: "udp"},
+		tcp:   &dns.Server{Handler: handler, Addr: "127.0.0.1:0", Net: "tcp"},
+		http:  &http.Server{Addr: "127.0.0.1:0", Handler: handler},
+		admin: &http.Server{Addr: "127.0.0.1:0", Handler: adminHandler()},
+	}
+	var started sync.WaitGroup
+	started.Add(2)
+	s.udp.NotifyStartedFunc = started.Done
+	s.tcp.NotifyStartedFunc = started.Done
+	errs := s.start()
+	started.Wait()
+
+	// pretend a websocket is reading a stream
+	stream, ok := openStream("shutdowntest")
+	assert.True(t, ok)
+	go func() {
+		defer streamConns.Done()
+		for range stream.Get() {
+		}
+	}()
+
+	var loops sync.WaitGroup
+	reopenStreams(t)
+	shutdown(s, &loops, store)
+	// the database was closed
+	assert.NotNil(t, store.Ping(context.Background()))
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
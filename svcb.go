@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SVCB and HTTPS records (RFC 9460). Their parameters are an interface
+// slice, which encoding/json can't read back, so in JSON we write each one
+// in presentation format instead, e.g. "alpn=h2,h3".
+
+type svcbJSON struct {
+	Hdr      dns.RR_Header
+	Priority uint16
+	Target   string
+	Value    []string
+}
+
+func svcbOf(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	}
+	return nil
+}
+
+func marshalSVCB(svcb *dns.SVCB) ([]byte, error) {
+	values := make([]string, 0, len(svcb.Value))
+	for _, kv := range svcb.Value {
+		values = append(values, kv.Key().String()+"="+kv.String())
+	}
+	return json.Marshal(svcbJSON{
+		Hdr:      svcb.Hdr,
+		Priority: svcb.Priority,
+		Target:   svcb.Target,
+		Value:    values,
+	})
+}
+
+func parseSVCB(jsonString []byte) (dns.RR, error) {
+	var s svcbJSON
+	err := json.Unmarshal(jsonString, &s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Hdr.Name == "" || s.Target == "" {
+		return nil, fmt.Errorf("invalid RR: SVCB records need a name and a target")
+	}
+	// let the zone parser deal with the parameters
+	rr, err := dns.NewRR(fmt.Sprintf(
+		"%s %d IN %s %d %s %s",
+		s.Hdr.Name,
+		s.Hdr.Ttl,
+		dns.TypeToString[s.Hdr.Rrtype],
+		s.Priority,
+		s.Target,
+		strings.Join(s.Value, " "),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RR: %s", err)
+	}
+	return rr, nil
+}
+
+// MarshalRecord is the JSON we store and send out for a record
+func MarshalRecord(rr dns.RR) ([]byte, error) {
+	if svcb := svcbOf(rr); svcb != nil {
+		return marshalSVCB(svcb)
+	}
+	return json.Marshal(rr)
+}
+
+func isServiceBinding(qtype uint16) bool {
+	return qtype == dns.TypeHTTPS || qtype == dns.TypeSVCB
+}
+
+func hasServiceBinding(records []dns.RR) bool {
+	for _, rr := range records {
+		if svcbOf(rr) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// targetName is where an SVCB record points, "." meaning the owner itself
+func targetName(svcb *dns.SVCB) string {
+	if svcb.Target == "." {
+		return svcb.Hdr.Name
+	}
+	return svcb.Target
+}
+
+func inZone(name string) bool {
+	return strings.HasSuffix(name, ".flatbo.at.") || name == "flatbo.at."
+}
+
+// longest AliasMode chain we follow
+const maxAliasChain = 8
+
+// serviceBinding follows AliasMode records to the ServiceMode records they
+// point at, as long as they're in our zone, and finds the in-zone addresses
+// of the targets to put in the additional section.
+func serviceBinding(
+	ctx context.Context,
+	store RecordStore,
+	client *Client,
+	qtype uint16,
+	records []dns.RR,
+) ([]dns.RR, []dns.RR, error) {
+	answer := records
+	seen := make(map[string]bool)
+	targets := make([]string, 0)
+	pending := records
+	for depth := 0; depth < maxAliasChain && len(pending) > 0; depth++ {
+		next := make([]dns.RR, 0)
+		for _, rr := range pending {
+			svcb := svcbOf(rr)
+			if svcb == nil {
+				continue
+			}
+			target := targetName(svcb)
+			if svcb.Priority != 0 {
+				targets = append(targets, target)
+				continue
+			}
+			// AliasMode, where "." means there's no service at all
+			if svcb.Target == "." || !inZone(target) || seen[target] {
+				continue
+			}
+			seen[target] = true
+			aliased, _, err := lookupRecords(peeking(ctx), store, client, target, qtype)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !hasServiceBinding(aliased) {
+				// clients fall back to the alias target's addresses
+				targets = append(targets, target)
+			}
+			next = append(next, aliased...)
+		}
+		answer = append(answer, next...)
+		pending = next
+	}
+	extra := make([]dns.RR, 0)
+	addresses := make(map[string]bool)
+	for _, target := range targets {
+		if !inZone(target) || addresses[target] {
+			continue
+		}
+		addresses[target] = true
+		for _, addrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			found, _, err := lookupRecords(peeking(ctx), store, client, target, addrType)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, rr := range found {
+				if rr.Header().Rrtype == addrType {
+					extra = append(extra, rr)
+				}
+			}
+		}
+	}
+	return answer, extra, nil
+}
+
+// synthesizeHTTPS makes an HTTPS record with address hints out of a name's
+// A and AAAA records, for subdomains that asked for it
+func synthesizeHTTPS(name string, addresses []dns.RR) dns.RR {
+	var v4, v6 []net.IP
+	var ttl uint32
+	for _, rr := range addresses {
+		switch rr := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, rr.A)
+		case *dns.AAAA:
+			v6 = append(v6, rr.AAAA)
+		default:
+			continue
+		}
+		if ttl == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if len(v4) == 0 && len(v6) == 0 {
+		return nil
+	}
+	https := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeHTTPS,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Priority: 1,
+		Target:   ".",
+	}}
+	if len(v4) > 0 {
+		https.Value = append(https.Value, &dns.SVCBIPv4Hint{Hint: v4})
+	}
+	if len(v6) > 0 {
+		https.Value = append(https.Value, &dns.SVCBIPv6Hint{Hint: v6})
+	}
+	return https
+}
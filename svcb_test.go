@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHTTPS(t *testing.T) {
+	jsonString := `{"Hdr":{"Name":"test.flatbo.at.","Rrtype":65,"Class":1,"Ttl":300},"Priority":1,"Target":".","Value":["alpn=h2,h3","ipv4hint=192.0.2.1"]}`
+	rr, err := ParseRecord([]byte(jsonString))
+	assert.Nil(t, err)
+	assert.Equal(t, "test.flatbo.at.\t300\tIN\tHTTPS\t1 . alpn=\"h2,h3\" ipv4hint=\"192.0.2.1\"", rr.String())
+
+	// and it survives being stored
+	stored, err := MarshalRecord(rr)
+	assert.Nil(t, err)
+	again, err := ParseRecord(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, rr.String(), again.String())
+
+	_, err = ParseRecord([]byte(`{"Hdr":{"Name":"test.flatbo.at.","Rrtype":65},"Priority":1,"Target":".","Value":["nonsense"]}`))
+	assert.NotNil(t, err)
+}
+
+func TestSynthesizeHTTPS(t *testing.T) {
+	a := makeA("test.flatbo.at.", "192.0.2.1")
+	a.Hdr.Ttl = 60
+	cname := makeCNAME("test.flatbo.at.", "example.com.")
+	https := synthesizeHTTPS("test.flatbo.at.", []dns.RR{a, cname}).(*dns.HTTPS)
+	assert.Equal(t, uint16(1), https.Priority)
+	assert.Equal(t, uint32(60), https.Hdr.Ttl)
+	assert.Equal(t, "ipv4hint=\"192.0.2.1\"", https.Value[0].Key().String()+"=\""+https.Value[0].String()+"\"")
+
+	assert.Nil(t, synthesizeHTTPS("test.flatbo.at.", []dns.RR{cname}))
+}
+
+func TestServiceModeAdditional(t *testing.T) {
+	// targets outside the zone don't need any lookups
+	https := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: "test.flatbo.at.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET},
+		Priority: 0,
+		Target:   "example.com.",
+	}}
+	answer, extra, err := serviceBinding(context.Background(), nil, makeClient(), dns.TypeHTTPS, []dns.RR{https})
+	assert.Nil(t, err)
+	assert.Equal(t, []dns.RR{https}, answer)
+	assert.Equal(t, 0, len(extra))
+}
+
+func TestServiceBindingDoesntCount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "svcb"))
+	https := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: "svcb.flatbo.at.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET},
+		Priority: 1,
+		Target:   "www.svcb.flatbo.at.",
+	}}
+	assert.Nil(t, store.InsertRecord(ctx, "svcb", makeA("www.svcb.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	assert.Nil(t, store.InsertRecord(ctx, "svcb", makeA("www.svcb.flatbo.at.", "192.0.2.2"), defaultOptions()))
+	assert.Nil(t, store.SetPolicy(ctx, Policy{Name: "www.svcb.flatbo.at.", Ordering: OrderRoundRobin}))
+	assert.Nil(t, store.InsertBehavior(ctx, Behavior{
+		Name: "www.svcb.flatbo.at.",
+		Kind: BehaviorRebind,
+		IPs:  []string{"2001:db8::1", "2001:db8::2"},
+	}))
+	query := func() []dns.RR {
+		found, _, err := lookupRecords(ctx, store, makeClient(), "www.svcb.flatbo.at.", dns.TypeA)
+		assert.Nil(t, err)
+		return found
+	}
+	first := query()
+
+	// filling in the additional section doesn't move the round robin on, or
+	// the rebind
+	for i := 0; i < 3; i++ {
+		_, extra, err := serviceBinding(ctx, store, makeClient(), dns.TypeHTTPS, []dns.RR{https})
+		assert.Nil(t, err)
+		assert.Len(t, extra, 3)
+		assert.Equal(t, "2001:db8::1", extra[2].(*dns.AAAA).AAAA.String())
+	}
+	second := query()
+	assert.NotEqual(t, first[0].String(), second[0].String())
+	assert.Equal(t, first[0].String(), query()[0].String())
+}
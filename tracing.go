@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traces go out over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set, e.g. to http://localhost:4318
+// for a local collector. The exporter and sampler read the rest of the
+// standard OTEL_* variables themselves. Without an endpoint the spans go
+// nowhere.
+
+var tracer = otel.Tracer("github.com/daaser/mess-with-dns")
+
+// shutdownTracing flushes the spans we haven't sent yet
+var shutdownTracing = func(ctx context.Context) error { return nil }
+
+func tracingEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+func setupTracing(ctx context.Context) error {
+	// always accept trace context from callers of the API, so our spans can
+	// join their traces once we do export
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if tracingEndpoint() == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("mess-with-dns"),
+		semconv.ServiceVersion(identity.Version),
+		semconv.ServiceInstanceID(identity.ID),
+	))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	shutdownTracing = provider.Shutdown
+	return nil
+}
+
+// traceQuery starts a span for a database call and times it for
+// db_query_duration_seconds, use it as
+//
+//	ctx, end := traceQuery(ctx, "GetRecords", semconv.DBSystemMySQL)
+//	defer end()
+func traceQuery(ctx context.Context, query string, attrs ...attribute.KeyValue) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(
+		ctx,
+		query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx, func() {
+		dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+// recordError marks the span as failed
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// traceID is for putting in logs, so a log line can be matched to its trace
+func traceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TestTracingExport sends spans to a stand-in OTLP collector
+func TestTracingExport(t *testing.T) {
+	var mu sync.Mutex
+	var received bytes.Buffer
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received.Write(body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		shutdownTracing = func(ctx context.Context) error { return nil }
+	}()
+
+	assert.Nil(t, setupTracing(context.Background()))
+	store, err := openStore(context.Background(), "sqlite::memory:", true)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	ctx, span := tracer.Start(context.Background(), "ServeDNS")
+	dnsResponse(ctx, store, makeChaosQuestion("hostname.bind."), makeClient())
+	_, err = store.GetSerial(ctx)
+	assert.Nil(t, err)
+	span.End()
+	assert.NotEqual(t, "", traceID(ctx))
+
+	assert.Nil(t, shutdownTracing(context.Background()))
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"ServeDNS", "dnsResponse", "GetSerial"} {
+		assert.Contains(t, received.String(), name)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
@@ -15,25 +15,8 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func getExistingSubdomains(db *sql.DB, word string) ([]string, error) {
-	var subdomains []string
-	rows, err := db.Query("SELECT name FROM subdomains WHERE name LIKE ?", word+"%")
-	if err != nil {
-		return subdomains, err
-	}
-	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
-		if err != nil {
-			return subdomains, err
-		}
-		subdomains = append(subdomains, name)
-	}
-	return subdomains, nil
-}
-
-func subdomainExists(db *sql.DB, word string) bool {
-	domains, err := getExistingSubdomains(db, word)
+func subdomainExists(ctx context.Context, store RecordStore, word string) bool {
+	domains, err := store.GetSubdomains(ctx, word)
 	if err != nil || len(domains) != 0 {
 		return true
 	}
@@ -85,46 +68,46 @@ func smallestMissing(prefix string, existing []string) string {
 	}
 }
 
-func insertAvailableSubdomain(db *sql.DB) (string, error) {
+func insertAvailableSubdomain(ctx context.Context, store RecordStore) (string, error) {
 	prefix := randomWord()
-	if subdomainExists(db, prefix) {
+	if subdomainExists(ctx, store, prefix) {
 		return "", errors.New("subdomain exists")
 	}
-	//existing, err := getExistingSubdomains(db, prefix)
+	//existing, err := store.GetSubdomains(ctx, prefix)
 	//if err != nil {
 	//	return "", err
 	//}
 	//subdomain := smallestMissing(prefix, existing)
 	subdomain := prefix
-	_, err := db.Exec("INSERT INTO subdomains (name) VALUES (?)", subdomain)
+	err := store.InsertSubdomain(ctx, subdomain)
 	if err != nil {
 		return "", err
 	}
 	return subdomain, nil
 }
 
-func createAvailableSubdomain(db *sql.DB) (string, error) {
+func createAvailableSubdomain(ctx context.Context, store RecordStore) (string, error) {
 	var err error
 	// try 3 times before giving up
 	// this is a hack to make sure we don't randomly get a subdomain that's
 	// already taken
-	subdomain, err := insertAvailableSubdomain(db)
+	subdomain, err := insertAvailableSubdomain(ctx, store)
 	if err == nil {
 		return subdomain, nil
 	}
-	subdomain, err = insertAvailableSubdomain(db)
+	subdomain, err = insertAvailableSubdomain(ctx, store)
 	if err == nil {
 		return subdomain, nil
 	}
-	subdomain, err = insertAvailableSubdomain(db)
+	subdomain, err = insertAvailableSubdomain(ctx, store)
 	if err == nil {
 		return subdomain, nil
 	}
 	return "", err
 }
 
-func loginRandom(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	subdomain, err := createAvailableSubdomain(db)
+func loginRandom(store RecordStore, w http.ResponseWriter, r *http.Request) {
+	subdomain, err := createAvailableSubdomain(r.Context(), store)
 
 	if err != nil {
 		returnError(w, err, http.StatusInternalServerError)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -42,3 +43,16 @@ func validateDomainName(domain string, username string) error {
 	}
 	return nil
 }
+
+// validateRecordName checks that the user is allowed to have a record with
+// this name: either in their subdomain, or in their slice of a reverse zone
+func validateRecordName(ctx context.Context, store RecordStore, record dns.RR, username string) error {
+	name := record.Header().Name
+	if !isReverseName(name) {
+		return validateDomainName(name, username)
+	}
+	if record.Header().Rrtype != dns.TypePTR {
+		return fmt.Errorf("only PTR records are allowed in reverse zones")
+	}
+	return validateReverseName(ctx, store, name, username)
+}
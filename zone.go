@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// GET /zone and POST /zone: the user's records as an RFC 1035 master file,
+// with $ORIGIN set to their subdomain. Weights, backups and health checks
+// aren't part of the format, so an export only has the records themselves.
+
+func userOrigin(username string) string {
+	return username + ".flatbo.at."
+}
+
+// relativeName is name the way it's written under $ORIGIN origin
+func relativeName(name string, origin string) string {
+	if strings.EqualFold(name, origin) {
+		return "@"
+	}
+	if strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(origin)) {
+		return name[:len(name)-len(origin)-1]
+	}
+	return name
+}
+
+// formatZone writes records as a master file
+func formatZone(origin string, records []dns.RR) string {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i].Header(), records[j].Header()
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Rrtype < b.Rrtype
+	})
+	var b strings.Builder
+	b.WriteString("$ORIGIN " + origin + "\n")
+	for _, rr := range records {
+		// the rest of the line is the same as in presentation format
+		b.WriteString(relativeName(rr.Header().Name, origin))
+		b.WriteString(strings.TrimPrefix(rr.String(), rr.Header().Name))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func getZone(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	records, err := store.GetRecordsForName(r.Context(), username)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error getting records: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	rrs := make([]dns.RR, 0, len(ids))
+	for _, id := range ids {
+		rrs = append(rrs, records[id].RR)
+	}
+	origin := userOrigin(username)
+	w.Header().Set("Content-Type", "text/dns")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", origin+"zone"))
+	io.WriteString(w, formatZone(origin, rrs))
+}
+
+// ZoneError is a problem with one line of an uploaded zone
+type ZoneError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// the zone parser only says where it stopped in the error message
+var parseErrorLine = regexp.MustCompile(`at line: (\d+):`)
+
+// recordLines finds the line each record in a master file starts on, in
+// the order the zone parser returns them. Records can go over several lines
+// in parentheses. $INCLUDE and $GENERATE are errors, since they don't give
+// exactly one record per entry.
+func recordLines(zone string) ([]int, []ZoneError) {
+	var lines []int
+	var errs []ZoneError
+	depth := 0
+	quoted := false
+	for i, line := range strings.Split(zone, "\n") {
+		start := depth == 0 && !quoted
+		content := false
+		escaped := false
+	scan:
+		for _, c := range line {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = !quoted
+			case quoted:
+			case c == ';':
+				break scan
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+			}
+			if c != ' ' && c != '\t' && c != '\r' {
+				content = true
+			}
+		}
+		if !start || !content {
+			continue
+		}
+		directive := strings.ToUpper(strings.Fields(line)[0])
+		switch {
+		case directive == "$INCLUDE" || directive == "$GENERATE":
+			errs = append(errs, ZoneError{Line: i + 1, Error: directive + " isn't supported"})
+		case strings.HasPrefix(directive, "$"):
+		default:
+			lines = append(lines, i+1)
+		}
+	}
+	return lines, errs
+}
+
+// parseZone reads a master file under origin, checking that every record
+// is one username is allowed to have
+func parseZone(r *http.Request, store RecordStore, username string, zone string) ([]dns.RR, []ZoneError) {
+	lines, errs := recordLines(zone)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	var records []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(zone), userOrigin(username), "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		line := 0
+		if len(records) < len(lines) {
+			line = lines[len(records)]
+		}
+		records = append(records, rr)
+		if err := validateRecordName(r.Context(), store, rr, username); err != nil {
+			errs = append(errs, ZoneError{Line: line, Error: err.Error()})
+		} else if _, err := FormatRecord(rr); err != nil {
+			errs = append(errs, ZoneError{Line: line, Error: err.Error()})
+		}
+	}
+	if err := zp.Err(); err != nil {
+		zoneErr := ZoneError{Error: err.Error()}
+		if match := parseErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			zoneErr.Line, _ = strconv.Atoi(match[1])
+		}
+		errs = append(errs, zoneErr)
+	}
+	if len(records) > maxBatchOperations {
+		errs = append(errs, ZoneError{Error: fmt.Sprintf("a zone can have at most %d records", maxBatchOperations)})
+	}
+	return records, errs
+}
+
+// postZone adds the records in an uploaded master file, all at once.
+// ?replace=true deletes the user's other records first.
+func postZone(store RecordStore, username string, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		returnError(
+			w,
+			fmt.Errorf("error reading body: %s", err.Error()),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	records, errs := parseZone(r, store, username, string(body))
+	if len(errs) > 0 {
+		writeZoneErrors(w, errs)
+		return
+	}
+	var changes []RecordChange
+	if r.URL.Query().Get("replace") == "true" {
+		changes = append(changes, RecordChange{Op: ChangeReset})
+	}
+	for _, rr := range records {
+		changes = append(changes, RecordChange{Op: ChangeCreate, Record: rr, Options: RecordOptions{Weight: defaultWeight}})
+	}
+	_, err = store.ApplyRecordChanges(r.Context(), username, changes)
+	if err != nil {
+		returnError(w, fmt.Errorf("error saving zone: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+}
+
+func writeZoneErrors(w http.ResponseWriter, errs []ZoneError) {
+	if lw, ok := w.(*loggingWriter); ok {
+		lw.err = fmt.Errorf("invalid zone: %d errors", len(errs))
+	}
+	jsonOutput, err := json.Marshal(map[string]interface{}{"errors": errs})
+	if err != nil {
+		returnError(w, fmt.Errorf("error marshalling json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(jsonOutput)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneExportImport(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeA("www.alice.flatbo.at.", "192.0.2.1"), defaultOptions()))
+	assert.Nil(t, store.InsertRecord(ctx, "alice", makeCNAME("alice.flatbo.at.", "example.com."), defaultOptions()))
+
+	w := httptest.NewRecorder()
+	getZone(store, "alice", w, httptest.NewRequest("GET", "/zone", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	zone := w.Body.String()
+	assert.Equal(t, "$ORIGIN alice.flatbo.at.\n@\t0\tIN\tCNAME\texample.com.\nwww\t0\tIN\tA\t192.0.2.1\n", zone)
+
+	// importing the export with replace gets the same records back
+	w = httptest.NewRecorder()
+	postZone(store, "alice", w, httptest.NewRequest("POST", "/zone?replace=true", strings.NewReader(zone)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	getZone(store, "alice", w, httptest.NewRequest("GET", "/zone", nil))
+	assert.Equal(t, zone, w.Body.String())
+
+	// without replace they're added
+	w = httptest.NewRecorder()
+	postZone(store, "alice", w, httptest.NewRequest("POST", "/zone", strings.NewReader("mail 300 IN MX 10 mx.example.com.\n")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	count, err := store.CountRecords(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestZoneImportErrors(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	assert.Nil(t, store.InsertSubdomain(ctx, "alice"))
+	post := func(zone string) []ZoneError {
+		w := httptest.NewRecorder()
+		postZone(store, "alice", w, httptest.NewRequest("POST", "/zone", strings.NewReader(zone)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var response struct {
+			Errors []ZoneError `json:"errors"`
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Errors
+	}
+
+	errs := post(`$TTL 300
+; a comment (with a parenthesis
+www IN A 192.0.2.1
+txt IN TXT ( "one; two"
+             "three" )
+www.bob.flatbo.at. IN A 192.0.2.2
+	IN AAAA 2001:db8::1
+other.example.com. IN A 192.0.2.3
+`)
+	assert.Equal(t, []ZoneError{
+		{Line: 6, Error: "subdomain must be 'alice'"},
+		{Line: 7, Error: "subdomain must be 'alice'"},
+		{Line: 8, Error: "subdomain must end with .flatbo.at"},
+	}, errs)
+
+	errs = post("www IN A 192.0.2.1\nwww IN A not-an-ip\n")
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 2, errs[0].Line)
+
+	errs = post("$GENERATE 1-10 host$ IN A 192.0.2.$\n")
+	assert.Equal(t, []ZoneError{{Line: 1, Error: "$GENERATE isn't supported"}}, errs)
+
+	count, err := store.CountRecords(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}